@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"assurance_service/internal/audit"
@@ -15,10 +20,41 @@ import (
 func main() {
 	cfg := config.Load()
 
-	store, err := audit.NewStore(cfg.DataDir, cfg.BatchSize)
+	if err := os.MkdirAll(cfg.DataDir, 0o755); err != nil {
+		log.Fatalf("data dir init failed: %v", err)
+	}
+	signingKey, err := audit.LoadOrCreateSigningKey(cfg.SigningKey)
+	if err != nil {
+		log.Fatalf("signing key load failed: %v", err)
+	}
+	publicKey := signingKey.Public().(ed25519.PublicKey)
+	log.Printf("Signing checkpoints with key %s (public key: %s.pub)", audit.KeyID(publicKey), cfg.SigningKey)
+
+	var masterKey []byte
+	if cfg.MasterKey != "" {
+		if masterKey, err = audit.LoadOrCreateMasterKey(cfg.MasterKey); err != nil {
+			log.Fatalf("master key load failed: %v", err)
+		}
+		log.Printf("Encrypting event payloads at rest with master key %s", audit.MasterKeyID(masterKey))
+	}
+
+	opts := cfg.StoreOptions()
+	opts.SigningKey = signingKey
+	opts.MasterKey = masterKey
+	store, err := audit.OpenStore(cfg.DataDir, opts)
 	if err != nil {
 		log.Fatalf("store init failed: %v", err)
 	}
+	if g := store.Genesis(); g != nil {
+		if g.BatchSize != cfg.BatchSize {
+			log.Printf("Log %s was created with batch size %d; ASSURE_BATCH_SIZE=%d only applies to new logs", g.LogID, g.BatchSize, cfg.BatchSize)
+		}
+		log.Printf("Serving log %s (created %s)", g.LogID, g.CreatedAt.Format(time.RFC3339))
+	}
+	if r := store.Recovery(); r != nil {
+		log.Printf("INCIDENT: quarantined torn record (%d bytes at offset %d of %s, sha256 %s) into recovery.log; logged as record %d",
+			r.Size, r.Offset, r.File, r.SHA256, r.IncidentIndex)
+	}
 
 	engine, err := policy.Load("./policies/policy.json")
 	if err != nil {
@@ -29,11 +65,13 @@ func main() {
 		Store:        store,
 		Policy:       engine,
 		SharedSecret: cfg.SharedSecret,
-		EventsPath:   fmt.Sprintf("%s/events.log", cfg.DataDir),
-		RootsPath:    fmt.Sprintf("%s/roots.log", cfg.DataDir),
-		BatchSize:    cfg.BatchSize,
+		VerifyState:  fmt.Sprintf("%s/verify.state.json", cfg.DataDir),
+		PublicKey:    publicKey,
+		BatchSize:    store.BatchSize(),
 		KAnonymity:   cfg.KAnonymity,
 		DPEpsilon:    cfg.DPEpsilon,
+
+		DisclosureToken: cfg.DisclosureToken,
 	}
 
 	addr := fmt.Sprintf(":%d", cfg.Port)
@@ -45,8 +83,39 @@ func main() {
 		IdleTimeout:  30 * time.Second,
 	}
 
-	log.Printf("Assurance service listening on %s", addr)
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatalf("server stopped: %v", err)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
+	log.Printf("Assurance service listening on %s (storage: %s, durability: %s)", addr, cfg.Storage, cfg.Durability)
+
+	var sig os.Signal
+	select {
+	case sig = <-signals:
+	case err := <-served:
+		// The listener failed, typically at startup: nothing was served,
+		// so close the log as it is rather than marking a shutdown.
+		log.Printf("server stopped: %v", err)
+		if err := store.Close(); err != nil {
+			log.Printf("close store: %v", err)
+		}
+		os.Exit(1)
+	}
+	signal.Stop(signals)
+	log.Printf("Shutting down on %s: draining requests for up to %s", sig, cfg.ShutdownTimeout)
+	drain, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	if err := srv.Shutdown(drain); err != nil {
+		log.Printf("drain requests: %v", err)
+	}
+	cancel()
+
+	// Seal what the run appended so no record is left without a root and
+	// checkpoint until the next start.
+	marker, err := store.Shutdown("signal: " + sig.String())
+	if err != nil {
+		log.Fatalf("seal on shutdown failed: %v", err)
+	}
+	if cp := store.LatestCheckpoint(); cp != nil {
+		log.Printf("Sealed log at record %d (shutdown marker); final checkpoint at size %d, root %s", marker.Index, cp.TreeSize, cp.RootHash)
 	}
 }
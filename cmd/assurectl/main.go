@@ -1,17 +1,29 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 
 	"assurance_service/internal/audit"
+	"assurance_service/internal/config"
+)
+
+var (
+	dataDir = flag.String("data", "./data", "data directory")
+	batch   = flag.Int("batch", 100, "batch size of a log created without a genesis header")
+	storage = flag.String("storage", "", "storage engine of the log: file or kv (default $ASSURE_STORAGE, else file)")
 )
 
 func main() {
-	dataDir := flag.String("data", "./data", "data directory")
-	batch := flag.Int("batch", 100, "batch size")
 	flag.Parse()
 
 	if len(flag.Args()) == 0 {
@@ -19,24 +31,569 @@ func main() {
 		os.Exit(1)
 	}
 
-	cmd := flag.Args()[0]
+	cmd, args := flag.Args()[0], flag.Args()[1:]
 	switch cmd {
 	case "verify":
-		events := filepath.Join(*dataDir, "events.log")
-		roots := filepath.Join(*dataDir, "roots.log")
-		report := audit.Verify(events, roots, *batch)
-		if report.OK {
-			fmt.Printf("OK: %d events, last index=%d\n", report.Total, report.LastIndex)
-			os.Exit(0)
-		}
-		fmt.Printf("FAIL: %v\n", report.Errors)
-		os.Exit(2)
+		os.Exit(runVerify(args))
+	case "proof":
+		os.Exit(runProof(args))
+	case "consistency":
+		os.Exit(runConsistency(args))
+	case "segments":
+		os.Exit(runSegments(args))
+	case "recover":
+		os.Exit(runRecover(args))
+	case "convert":
+		os.Exit(runConvert(args))
+	case "shred":
+		os.Exit(runShred(args))
+	case "epoch":
+		os.Exit(runEpoch(args))
+	case "genesis":
+		os.Exit(runGenesis(args))
 	default:
 		usage()
 		os.Exit(1)
 	}
 }
 
+// subcommand returns a flag set for cmd that also accepts the global flags,
+// so both "assurectl --data x verify" and "assurectl verify --data x" work.
+func subcommand(cmd string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.StringVar(dataDir, "data", *dataDir, "data directory")
+	fs.IntVar(batch, "batch", *batch, "batch size of a log created without a genesis header")
+	fs.StringVar(storage, "storage", *storage, "storage engine of the log: file or kv (default $ASSURE_STORAGE, else file)")
+	return fs
+}
+
+// openStore opens the log offline with the engine, formats and parameters
+// the server would use, taken from the same ASSURE_* settings; --storage
+// overrides the engine. Every append is fsynced and no batch is sealed by
+// age, so the command's own record is all it adds.
+func openStore(signingKey ed25519.PrivateKey, masterKey []byte) (*audit.Store, error) {
+	opts := config.Load().StoreOptions()
+	opts.BatchSize = *batch
+	opts.Storage = storageEngine()
+	opts.Durability = audit.DurabilityFsync
+	opts.MaxBatchAge = 0
+	opts.SigningKey = signingKey
+	opts.MasterKey = masterKey
+	if masterKey == nil {
+		opts.SubjectField = ""
+	}
+	return audit.OpenStore(*dataDir, opts)
+}
+
+// storageEngine is the engine of the log in --data: --storage if given,
+// else the server's ASSURE_STORAGE setting.
+func storageEngine() string {
+	if *storage != "" {
+		return *storage
+	}
+	return config.Load().StoreOptions().Storage
+}
+
+func runVerify(args []string) int {
+	fs := subcommand("verify")
+	pubkey := fs.String("pubkey", "", "trusted Ed25519 public key (PEM) to check signed checkpoints against")
+	expect := fs.String("expect", "", "trusted state the log must still contain: INDEX:HASH or a signed checkpoint JSON file")
+	asJSON := fs.Bool("json", false, "print the full report, including typed findings, as JSON")
+	full := fs.Bool("full", false, "re-verify every record instead of resuming from the saved verified position")
+	state := fs.String("state", "", "saved verified position (default <data>/verify.state.json)")
+	workers := fs.Int("workers", runtime.NumCPU(), "goroutines decoding and hashing records in parallel")
+	_ = fs.Parse(args)
+
+	opts := audit.VerifyOptions{
+		BatchSize:       *batch,
+		CheckpointsPath: filepath.Join(*dataDir, "checkpoints.log"),
+		StatePath:       *state,
+		Full:            *full,
+		Workers:         *workers,
+	}
+	if opts.StatePath == "" {
+		opts.StatePath = filepath.Join(*dataDir, "verify.state.json")
+	}
+	if *pubkey != "" {
+		pub, err := audit.LoadPublicKey(*pubkey)
+		if err != nil {
+			fmt.Printf("FAIL: %v\n", err)
+			return 1
+		}
+		opts.PublicKey = pub
+	}
+	if *expect != "" {
+		state, err := parseExpect(*expect, opts.PublicKey)
+		if err != nil {
+			fmt.Printf("FAIL: --expect: %v\n", err)
+			return 1
+		}
+		opts.Expect = append(opts.Expect, state)
+	}
+	report, status := verifyLog(opts)
+	if status != 0 {
+		return status
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+		return exitStatus(report)
+	}
+	if report.LogID != "" && flagGiven(fs, "batch") && *batch != report.BatchSize {
+		fmt.Printf("NOTE: --batch %d ignored: the genesis header fixes the batch size at %d\n", *batch, report.BatchSize)
+	}
+	if len(report.ArchivedSegments) > 0 {
+		fmt.Printf("NOTE: sealed segments %v are archived; checked from the heads in segments.json\n", report.ArchivedSegments)
+	}
+	if report.OK {
+		if report.LogID != "" {
+			fmt.Printf("OK: log %s, batch size %d\n", report.LogID, report.BatchSize)
+		} else {
+			fmt.Printf("OK: log has no genesis header, checked with --batch %d\n", report.BatchSize)
+		}
+		fmt.Printf("OK: %d events, last index=%d, tree root=%s (epoch %d, %s)\n", report.Total, report.LastIndex, report.TreeRoot, report.Epoch, report.HashAlgorithm)
+		if report.ResumedFrom > 0 {
+			fmt.Printf("OK: resumed after verified index %d (use --full to re-check everything)\n", report.ResumedFrom)
+		}
+		if opts.PublicKey != nil {
+			fmt.Printf("OK: %d signed checkpoints from key %s\n", report.CheckpointsChecked, audit.KeyID(opts.PublicKey))
+		}
+		return 0
+	}
+	if report.Truncated {
+		fmt.Printf("TRUNCATED: %v\n", report.Errors)
+	} else {
+		fmt.Printf("FAIL: %v\n", report.Errors)
+	}
+	return exitStatus(report)
+}
+
+// verifyLog verifies the log in --data with the engine that holds it. A file
+// log is read directly, so a saved position and --workers apply; a kv log is
+// opened as a store and checked through it. A log that does not exist is
+// refused rather than created, and so reported as empty. A non-zero status
+// means no report could be produced.
+func verifyLog(opts audit.VerifyOptions) (audit.VerifyReport, int) {
+	engine := storageEngine()
+	switch engine {
+	case "", audit.StorageFile:
+		events := filepath.Join(*dataDir, "events.log")
+		if _, err := os.Stat(events); err != nil {
+			fmt.Printf("FAIL: no file log in %s: %v\n", *dataDir, err)
+			return audit.VerifyReport{}, 1
+		}
+		head, err := audit.ReadTrustedState(filepath.Join(*dataDir, "head.json"))
+		if err != nil {
+			fmt.Printf("FAIL: read high-water mark: %v\n", err)
+			return audit.VerifyReport{}, 1
+		}
+		if head != nil {
+			opts.Expect = append(opts.Expect, *head)
+		}
+		return audit.VerifyWithOptions(events, filepath.Join(*dataDir, "roots.log"), opts), 0
+	case audit.StorageKV:
+		if _, err := os.Stat(filepath.Join(*dataDir, "audit.kv")); err != nil {
+			fmt.Printf("FAIL: no kv log in %s: %v\n", *dataDir, err)
+			return audit.VerifyReport{}, 1
+		}
+		// Opening replays the log against its high-water mark.
+		store, err := openStore(nil, nil)
+		if errors.Is(err, audit.ErrTruncated) {
+			fmt.Printf("TRUNCATED: %v\n", err)
+			return audit.VerifyReport{}, 3
+		}
+		if err != nil {
+			fmt.Printf("FAIL: open log: %v\n", err)
+			return audit.VerifyReport{}, 1
+		}
+		defer store.Close()
+		return store.Verify(opts), 0
+	}
+	fmt.Printf("FAIL: storage engine %q has no log to verify offline\n", engine)
+	return audit.VerifyReport{}, 1
+}
+
+// flagGiven reports whether name was set on the command line, before or
+// after the subcommand.
+func flagGiven(fs *flag.FlagSet, name string) bool {
+	given := false
+	visit := func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	}
+	flag.Visit(visit)
+	fs.Visit(visit)
+	return given
+}
+
+func exitStatus(report audit.VerifyReport) int {
+	switch {
+	case report.OK:
+		return 0
+	case report.Truncated:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// parseExpect reads an --expect value: either INDEX:HASH, or the path of a
+// checkpoint JSON file whose signature must verify against pub.
+func parseExpect(value string, pub ed25519.PublicKey) (audit.TrustedState, error) {
+	if index, hash, ok := strings.Cut(value, ":"); ok {
+		if n, err := strconv.ParseInt(index, 10, 64); err == nil {
+			return audit.TrustedState{Index: n, Hash: hash}, nil
+		}
+	}
+	var cp audit.Checkpoint
+	if err := readProof(value, "checkpoint", &cp); err != nil {
+		return audit.TrustedState{}, err
+	}
+	if pub == nil {
+		return audit.TrustedState{}, fmt.Errorf("checkpoint expectations need --pubkey")
+	}
+	if err := audit.VerifyCheckpoint(cp, pub); err != nil {
+		return audit.TrustedState{}, err
+	}
+	return cp.TrustedState(), nil
+}
+
+func runProof(args []string) int {
+	fs := subcommand("proof")
+	file := fs.String("file", "-", "inclusion proof JSON (from /audit/proof/inclusion), - for stdin")
+	root := fs.String("root", "", "trusted batch root to pin the proof to")
+	_ = fs.Parse(args)
+
+	var proof audit.InclusionProof
+	if err := readProof(*file, "proof", &proof); err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	if *root != "" && proof.RootHash != *root {
+		fmt.Printf("FAIL: proof root %s does not match trusted root %s\n", proof.RootHash, *root)
+		return 2
+	}
+	if err := audit.VerifyInclusion(proof); err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 2
+	}
+	fmt.Printf("OK: record %d included in batch %d-%d, root=%s\n",
+		proof.Record.Index, proof.FromIndex, proof.ToIndex, proof.RootHash)
+	return 0
+}
+
+func runConsistency(args []string) int {
+	fs := subcommand("consistency")
+	file := fs.String("file", "-", "consistency proof JSON (from /audit/proof/consistency), - for stdin")
+	fromRoot := fs.String("from-root", "", "tree root previously observed at the proof's from size")
+	toRoot := fs.String("to-root", "", "tree root currently served at the proof's to size")
+	_ = fs.Parse(args)
+
+	var proof audit.ConsistencyProof
+	if err := readProof(*file, "proof", &proof); err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	if *fromRoot != "" && proof.FromRoot != *fromRoot {
+		fmt.Printf("FAIL: history rewritten: root at size %d is %s, trusted %s\n", proof.FromSize, proof.FromRoot, *fromRoot)
+		return 2
+	}
+	if *toRoot != "" && proof.ToRoot != *toRoot {
+		fmt.Printf("FAIL: proof root %s does not match trusted root %s\n", proof.ToRoot, *toRoot)
+		return 2
+	}
+	if err := audit.VerifyConsistency(proof); err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 2
+	}
+	fmt.Printf("OK: log at size %d extends size %d, root=%s\n", proof.ToSize, proof.FromSize, proof.ToRoot)
+	return 0
+}
+
+func runSegments(args []string) int {
+	fs := subcommand("segments")
+	_ = fs.Parse(args)
+
+	events := filepath.Join(*dataDir, "events.log")
+	manifest, err := audit.ReadManifest(audit.ManifestPath(events))
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	for _, seg := range manifest.Segments {
+		state := "sealed"
+		if _, err := os.Stat(filepath.Join(*dataDir, seg.File)); err != nil {
+			state = "missing"
+		} else if seg.Compression != "" {
+			state = fmt.Sprintf("sealed,%s %d->%d bytes", seg.Compression, seg.Size, seg.CompressedSize)
+		}
+		alg := seg.Epoch.HashAlgorithm
+		if alg == "" {
+			alg = audit.HashSHA256
+		}
+		fmt.Printf("%s\t%d-%d\t%s\tepoch=%d/%s last_hash=%s tree_root=%s\n", seg.File, seg.FirstIndex, seg.LastIndex, state, seg.Epoch.Number, alg, seg.LastHash, seg.TreeRoot)
+	}
+	fmt.Printf("events.log\tlive\n")
+	return 0
+}
+
+// runRecover opens the store offline, which quarantines a torn trailing
+// record and appends the incident record exactly as the server would.
+func runRecover(args []string) int {
+	fs := subcommand("recover")
+	keyPath := fs.String("signing-key", "", "key to sign a checkpoint with if the incident record seals a batch (default <data>/signing.key if present)")
+	_ = fs.Parse(args)
+
+	key, err := offlineSigningKey(*keyPath)
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	master, err := offlineMasterKey(os.Getenv("ASSURE_MASTER_KEY_FILE"))
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	store, err := openStore(key, master)
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	r := store.Recovery()
+	if r == nil {
+		fmt.Println("OK: log ends on a complete record, nothing to recover")
+		return 0
+	}
+	fmt.Printf("RECOVERED: quarantined %d bytes at offset %d of %s (sha256 %s) into recovery.log; incident logged as record %d\n",
+		r.Size, r.Offset, r.File, r.SHA256, r.IncidentIndex)
+	return 0
+}
+
+// offlineSigningKey loads the key an offline command signs checkpoints with:
+// path, or <data>/signing.key if present, or none.
+func offlineSigningKey(path string) (ed25519.PrivateKey, error) {
+	if path == "" {
+		if _, err := os.Stat(filepath.Join(*dataDir, "signing.key")); err == nil {
+			path = filepath.Join(*dataDir, "signing.key")
+		}
+	}
+	if path == "" {
+		return nil, nil
+	}
+	// Never generate a key here: a checkpoint under a new key would not
+	// verify against the one auditors trust.
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return audit.LoadOrCreateSigningKey(path)
+}
+
+// offlineMasterKey loads the master key at path, or none if path is empty.
+// Like the signing key, it is never generated here.
+func offlineMasterKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return audit.LoadOrCreateMasterKey(path)
+}
+
+// runShred destroys a subject's payload keys and logs the shred. The server
+// must be stopped: it would otherwise keep the keys in memory.
+func runShred(args []string) int {
+	fs := subcommand("shred")
+	subject := fs.String("subject", "", "subject whose data to erase (the value of the subject field)")
+	reason := fs.String("reason", "erasure request", "reason recorded in the shred event")
+	masterPath := fs.String("master-key", os.Getenv("ASSURE_MASTER_KEY_FILE"), "master key file (default $ASSURE_MASTER_KEY_FILE)")
+	keyPath := fs.String("signing-key", "", "key to sign a checkpoint with if the shred event seals a batch (default <data>/signing.key if present)")
+	_ = fs.Parse(args)
+
+	if *subject == "" || *masterPath == "" {
+		fmt.Println("FAIL: --subject and --master-key are required")
+		return 1
+	}
+	master, err := offlineMasterKey(*masterPath)
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	signingKey, err := offlineSigningKey(*keyPath)
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	store, err := openStore(signingKey, master)
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	result, err := store.Shred(*subject, *reason)
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	fmt.Printf("SHREDDED: subject %s, %d keys destroyed, %d records unreadable; logged as record %d\n",
+		result.SubjectID, len(result.Keys), result.Records, result.EventIndex)
+	return 0
+}
+
+// runEpoch moves the log to a new hash algorithm by appending the link
+// record that starts the next epoch. The server must be stopped: it would
+// otherwise keep appending to the old epoch.
+func runEpoch(args []string) int {
+	fs := subcommand("epoch")
+	algorithm := fs.String("algorithm", "", "hash algorithm of the new epoch: sha256, sha512-256 or blake2b-256")
+	keyPath := fs.String("signing-key", "", "key to sign the checkpoint that closes the old epoch (default <data>/signing.key if present)")
+	_ = fs.Parse(args)
+
+	if *algorithm == "" {
+		fmt.Println("FAIL: --algorithm is required")
+		return 1
+	}
+	alg, err := audit.ParseHashAlgorithm(*algorithm)
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	signingKey, err := offlineSigningKey(*keyPath)
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	master, err := offlineMasterKey(os.Getenv("ASSURE_MASTER_KEY_FILE"))
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	store, err := openStore(signingKey, master)
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	old := store.Epoch()
+	rec, err := store.StartEpoch(alg)
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	fmt.Printf("EPOCH %d: %s -> %s after record %d; link record %d hash=%s\n",
+		old.Number+1, old.HashAlgorithm, alg, rec.Index-1, rec.Index, rec.Hash)
+	return 0
+}
+
+// runGenesis prints the log's genesis header and checks its signature,
+// against --pubkey if given.
+func runGenesis(args []string) int {
+	fs := subcommand("genesis")
+	pubkey := fs.String("pubkey", "", "trusted Ed25519 public key (PEM) the header must be signed by")
+	_ = fs.Parse(args)
+
+	g, err := audit.ReadGenesis(audit.GenesisPath(filepath.Join(*dataDir, "events.log")))
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	if g == nil {
+		fmt.Println("NONE: log has no genesis header; verify it with --batch")
+		return 0
+	}
+	var pub ed25519.PublicKey
+	if *pubkey != "" {
+		if pub, err = audit.LoadPublicKey(*pubkey); err != nil {
+			fmt.Printf("FAIL: %v\n", err)
+			return 1
+		}
+	}
+	hash, err := g.Hash()
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	fmt.Printf("log %s created %s\n", g.LogID, g.CreatedAt.Format("2006-01-02T15:04:05Z07:00"))
+	fmt.Printf("batch_size=%d tree_version=%d hash_scheme=%d hash_algorithm=%s\n", g.BatchSize, g.TreeVersion, g.HashScheme, g.HashAlgorithm)
+	if g.KeyID != "" {
+		fmt.Printf("signed by key %s\n", g.KeyID)
+	}
+	fmt.Printf("hash=%s\n", hash)
+	if err := g.Check(pub); err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 2
+	}
+	if g.Signature == "" {
+		fmt.Println("OK: genesis header is well-formed but unsigned")
+		return 0
+	}
+	fmt.Println("OK: genesis header is well-formed and signed")
+	return 0
+}
+
+// runConvert rewrites the log files between JSON lines and binary frames.
+// The server must be stopped and started again with ASSURE_LOG_FORMAT set to
+// the same format, or it keeps writing new segments in the old one.
+func runConvert(args []string) int {
+	fs := subcommand("convert")
+	to := fs.String("to", "", "target record format: json or binary")
+	_ = fs.Parse(args)
+
+	format, err := audit.ParseLogFormat(*to)
+	if err != nil || *to == "" {
+		fmt.Println("FAIL: --to must be json or binary")
+		return 1
+	}
+	stats, err := audit.ConvertLog(filepath.Join(*dataDir, "events.log"), format)
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return 1
+	}
+	fmt.Printf("OK: converted %d records in %d files to %s (%d -> %d bytes)\n",
+		stats.Records, stats.Files, format, stats.BytesBefore, stats.BytesAfter)
+	return 0
+}
+
+// readProof decodes a proof from path, accepting either the bare proof or the
+// server response that wraps it under key.
+func readProof(path, key string, v interface{}) error {
+	var (
+		data []byte
+		err  error
+	)
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	var wrapped map[string]json.RawMessage
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return fmt.Errorf("decode proof: %w", err)
+	}
+	if inner, ok := wrapped[key]; ok {
+		data = inner
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("decode proof: %w", err)
+	}
+	return nil
+}
+
 func usage() {
-	fmt.Println("Usage: assurectl [verify] --data ./data --batch 100")
+	fmt.Println("Usage: assurectl [verify|proof|consistency|segments|recover|convert|shred|epoch|genesis] --data ./data [--batch 100] [--storage file|kv]")
+	fmt.Println("       assurectl verify [--pubkey signing.key.pub] [--expect INDEX:HASH|checkpoint.json] [--json] [--full] [--workers N]")
+	fmt.Println("       assurectl proof --file proof.json [--root <hex>]")
+	fmt.Println("       assurectl consistency --file proof.json [--from-root <hex>] [--to-root <hex>]")
+	fmt.Println("       assurectl segments")
+	fmt.Println("       assurectl recover [--signing-key signing.key]")
+	fmt.Println("       assurectl convert --to json|binary")
+	fmt.Println("       assurectl shred --subject ID [--master-key master.key] [--reason TEXT]")
+	fmt.Println("       assurectl epoch --algorithm sha256|sha512-256|blake2b-256 [--signing-key signing.key]")
+	fmt.Println("       assurectl genesis [--pubkey signing.key.pub]")
 }
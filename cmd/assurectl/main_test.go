@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"assurance_service/internal/audit"
+)
+
+func TestShredKVStore(t *testing.T) {
+	dir := t.TempDir()
+	masterPath := filepath.Join(t.TempDir(), "master.key")
+	master, err := audit.LoadOrCreateMasterKey(masterPath)
+	if err != nil {
+		t.Fatalf("master key: %v", err)
+	}
+	store, err := audit.OpenStore(dir, audit.Options{
+		BatchSize:    2,
+		Storage:      audit.StorageKV,
+		MasterKey:    master,
+		SubjectField: "user",
+	})
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for _, user := range []string{"u1", "u2", "u1"} {
+		payload := map[string]interface{}{"user": user}
+		if _, _, err := store.AppendEvent(audit.Event{ID: "evt", Type: "trade", Payload: payload}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	keysPath := filepath.Join(dir, "keys.json")
+	keys, err := os.ReadFile(keysPath)
+	if err != nil {
+		t.Fatalf("read keys: %v", err)
+	}
+
+	// Opened as a file log, shred must refuse before touching keys.json.
+	t.Setenv("ASSURE_STORAGE", "")
+	if status := runShred([]string{"--data", dir, "--subject", "u1", "--master-key", masterPath}); status == 0 {
+		t.Fatalf("shred of a kv log with the file engine succeeded")
+	}
+	if after, _ := os.ReadFile(keysPath); !bytes.Equal(after, keys) {
+		t.Fatalf("refused shred changed keys.json")
+	}
+	for _, name := range []string{"events.log", "genesis.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Fatalf("refused shred created %s", name)
+		}
+	}
+
+	t.Setenv("ASSURE_STORAGE", "kv")
+	if status := runShred([]string{"--data", dir, "--subject", "u1", "--master-key", masterPath}); status != 0 {
+		t.Fatalf("shred exited %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "events.log")); err == nil {
+		t.Fatalf("shred created a file log next to the kv log")
+	}
+	store, err = audit.OpenStore(dir, audit.Options{Storage: audit.StorageKV, MasterKey: master})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	tail, err := store.Tail(1)
+	if err != nil || len(tail) != 1 {
+		t.Fatalf("tail: %v, %v", tail, err)
+	}
+	if rec := tail[0]; rec.Index != 4 || rec.Event.Type != audit.EventShred {
+		t.Fatalf("last record %d is %q, want the shred event as record 4", rec.Index, rec.Event.Type)
+	}
+	if report := store.Verify(audit.VerifyOptions{}); !report.OK {
+		t.Fatalf("log after shred: %v", report.Errors)
+	}
+}
+
+func TestVerifyKVStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := audit.OpenStore(dir, audit.Options{BatchSize: 2, Storage: audit.StorageKV})
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for _, amount := range []int{10, 11, 12, 13, 14} {
+		payload := map[string]interface{}{"amount": amount}
+		if _, _, err := store.AppendEvent(audit.Event{ID: "evt", Type: "trade", Payload: payload}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "audit.kv"))
+	if err != nil {
+		t.Fatalf("stat kv: %v", err)
+	}
+	size := info.Size()
+
+	// The file engine finds no log and must not leave one behind.
+	t.Setenv("ASSURE_STORAGE", "")
+	if status := runVerify([]string{"--data", dir}); status == 0 {
+		t.Fatalf("verify of a kv log with the file engine succeeded")
+	}
+	for _, name := range []string{"events.log", "roots.log", "checkpoints.log", "genesis.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Fatalf("verify created %s", name)
+		}
+	}
+
+	t.Setenv("ASSURE_STORAGE", "kv")
+	if status := runVerify([]string{"--data", dir}); status != 0 {
+		t.Fatalf("verify exited %d", status)
+	}
+	report, status := verifyLog(audit.VerifyOptions{})
+	if status != 0 || !report.OK || report.Total != 5 || report.RootsChecked != 2 {
+		t.Fatalf("verify: %+v", report)
+	}
+	if after, _ := os.ReadFile(filepath.Join(dir, "audit.kv")); int64(len(after)) != size {
+		t.Fatalf("verify wrote to audit.kv")
+	}
+
+	// Change record 2's payload and give its frame a valid checksum again,
+	// so only the chain can tell.
+	path := filepath.Join(dir, "audit.kv")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read kv: %v", err)
+	}
+	for off := 0; off < len(data); {
+		keyLen := int(binary.BigEndian.Uint16(data[off+4:]))
+		valLen := int(binary.BigEndian.Uint32(data[off+6:]))
+		body := data[off+10 : off+10+keyLen+valLen]
+		if string(body[:keyLen]) == "record/2" {
+			copy(body[keyLen:], bytes.Replace(body[keyLen:], []byte(`"amount":11`), []byte(`"amount":99`), 1))
+			binary.BigEndian.PutUint32(data[off:], crc32.ChecksumIEEE(body))
+		}
+		off += 10 + keyLen + valLen
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write kv: %v", err)
+	}
+	if status := runVerify([]string{"--data", dir}); status != 2 {
+		t.Fatalf("verify of a tampered log exited %d", status)
+	}
+	report, _ = verifyLog(audit.VerifyOptions{})
+	if report.OK || report.Total != 5 || len(report.Findings) == 0 || report.Findings[0].Code != audit.FindingHashMismatch {
+		t.Fatalf("tampered log: %+v", report)
+	}
+}
@@ -1,8 +1,18 @@
 package audit
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
 	"testing"
 	"testing/quick"
 	"time"
@@ -78,3 +88,2429 @@ func TestAuditChainProperty(t *testing.T) {
 		t.Fatalf("property check failed: %v", err)
 	}
 }
+
+func TestInclusionProof(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir, 5)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for i := 0; i < 12; i++ {
+		_, _, err := store.AppendEvent(Event{
+			Type:      "trade",
+			Source:    "test",
+			Timestamp: time.Now().UTC(),
+			Payload:   map[string]interface{}{"seq": i},
+		})
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	for index := int64(1); index <= 10; index++ {
+		proof, err := store.InclusionProof(index)
+		if err != nil {
+			t.Fatalf("proof %d: %v", index, err)
+		}
+		if err := VerifyInclusion(proof); err != nil {
+			t.Fatalf("verify proof %d: %v", index, err)
+		}
+	}
+
+	if _, err := store.InclusionProof(11); err != ErrNotSealed {
+		t.Fatalf("expected ErrNotSealed for pending record, got %v", err)
+	}
+	if _, err := store.InclusionProof(99); err != ErrRecordNotFound {
+		t.Fatalf("expected ErrRecordNotFound, got %v", err)
+	}
+
+	proof, _ := store.InclusionProof(3)
+	proof.Record.Event.Payload["seq"] = 42
+	if err := VerifyInclusion(proof); err == nil {
+		t.Fatalf("expected tampered record to fail")
+	}
+}
+
+func TestMerkleProofOddSizes(t *testing.T) {
+	for size := 1; size <= 9; size++ {
+		hashes := make([]string, size)
+		for i := range hashes {
+			hashes[i] = hashBytes(HashSHA256, []byte{byte(i)})
+		}
+		root := MerkleRoot(HashSHA256, hashes)
+		for i := range hashes {
+			path, err := MerkleProof(HashSHA256, hashes, i)
+			if err != nil {
+				t.Fatalf("size %d leaf %d: %v", size, i, err)
+			}
+			if !VerifyMerkleProof(HashSHA256, hashes[i], i, size, path, root) {
+				t.Fatalf("size %d leaf %d: proof rejected", size, i)
+			}
+		}
+	}
+}
+
+func TestLogConsistencyProofs(t *testing.T) {
+	hashes := make([]string, 17)
+	for i := range hashes {
+		hashes[i] = hashBytes(HashSHA256, []byte{byte(i)})
+	}
+	for n := 1; n <= len(hashes); n++ {
+		var tree logTree
+		for _, h := range hashes[:n] {
+			if err := tree.push(h); err != nil {
+				t.Fatalf("push: %v", err)
+			}
+		}
+		newRoot, _ := LogRoot(HashSHA256, hashes[:n])
+		if tree.root() != newRoot {
+			t.Fatalf("compact range root differs at size %d", n)
+		}
+		for m := 1; m < n; m++ {
+			oldRoot, _ := LogRoot(HashSHA256, hashes[:m])
+			proof, err := LogConsistencyProof(HashSHA256, hashes[:n], m)
+			if err != nil {
+				t.Fatalf("proof %d->%d: %v", m, n, err)
+			}
+			if !VerifyLogConsistency(HashSHA256, int64(m), int64(n), oldRoot, newRoot, proof) {
+				t.Fatalf("proof %d->%d rejected", m, n)
+			}
+			if VerifyLogConsistency(HashSHA256, int64(m), int64(n), newRoot, oldRoot, proof) {
+				t.Fatalf("proof %d->%d accepted with swapped roots", m, n)
+			}
+		}
+	}
+}
+
+func TestConsistencyProofDetectsRewrite(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir, 4)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	appendN := func(s *Store, n int, tag string) {
+		for i := 0; i < n; i++ {
+			if _, _, err := s.AppendEvent(Event{Type: "trade", Source: tag, Payload: map[string]interface{}{"seq": i}}); err != nil {
+				t.Fatalf("append: %v", err)
+			}
+		}
+	}
+	appendN(store, 6, "test")
+	size, root := store.TreeHead()
+	appendN(store, 5, "test")
+
+	proof, err := store.ConsistencyProof(size, 0)
+	if err != nil {
+		t.Fatalf("proof: %v", err)
+	}
+	if proof.FromRoot != root || proof.ToSize != 11 {
+		t.Fatalf("unexpected proof head: %+v", proof)
+	}
+	if err := VerifyConsistency(proof); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+
+	// Rebuild the log with different history; the old root no longer matches.
+	other, err := NewStore(t.TempDir(), 4)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	appendN(other, 11, "forged")
+	forged, err := other.ConsistencyProof(size, 0)
+	if err != nil {
+		t.Fatalf("proof: %v", err)
+	}
+	forged.FromRoot = root
+	if err := VerifyConsistency(forged); err == nil {
+		t.Fatalf("expected rewritten history to fail")
+	}
+}
+
+func TestConsistencyProofCache(t *testing.T) {
+	store, err := OpenStore(t.TempDir(), Options{BatchSize: 7, Storage: StorageMemory})
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	defer store.Close()
+	var start int
+	alg, hashes := HashSHA256, []string(nil)
+	appendN := func(n int) {
+		for i := 0; i < n; i++ {
+			rec, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}})
+			if err != nil {
+				t.Fatalf("append: %v", err)
+			}
+			hashes = append(hashes, rec.Hash)
+		}
+	}
+	check := func(from, to int) {
+		proof, err := store.ConsistencyProof(int64(start+from), int64(start+to))
+		if err != nil {
+			t.Fatalf("proof %d->%d: %v", from, to, err)
+		}
+		fromRoot, _ := LogRoot(alg, hashes[:from])
+		toRoot, _ := LogRoot(alg, hashes[:to])
+		want := []string{}
+		if from < to {
+			want, _ = LogConsistencyProof(alg, hashes[:to], from)
+		}
+		if proof.FromRoot != fromRoot || proof.ToRoot != toRoot || !reflect.DeepEqual(proof.Path, want) {
+			t.Fatalf("proof %d->%d differs from the one over all record hashes", from, to)
+		}
+		if err := VerifyConsistency(proof); err != nil {
+			t.Fatalf("verify %d->%d: %v", from, to, err)
+		}
+	}
+
+	// The first proof builds the cache from the log; later appends extend it.
+	appendN(200)
+	for _, to := range []int{1, 63, 64, 65, 128, 129, 200} {
+		for _, from := range []int{1, 2, 63, 64, 65, 127, 128, 129, 199, 200} {
+			if from <= to {
+				check(from, to)
+			}
+		}
+	}
+	appendN(140)
+	for _, to := range []int{256, 257, 340} {
+		for _, from := range []int{1, 64, 100, 192, 256, 300, 340} {
+			if from <= to {
+				check(from, to)
+			}
+		}
+	}
+
+	// A new epoch starts a tree of its own over the link and later records.
+	link, err := store.StartEpoch(HashBLAKE2b256)
+	if err != nil {
+		t.Fatalf("start epoch: %v", err)
+	}
+	start, alg, hashes = int(link.Index)-1, HashBLAKE2b256, []string{link.Hash}
+	appendN(129)
+	for _, to := range []int{1, 64, 65, 130} {
+		for _, from := range []int{1, 63, 64, 65, 129, 130} {
+			if from <= to {
+				check(from, to)
+			}
+		}
+	}
+	if _, err := store.ConsistencyProof(200, 400); !errors.Is(err, ErrEpochBoundary) {
+		t.Fatalf("cross-epoch proof: %v", err)
+	}
+}
+
+func TestSignedCheckpoints(t *testing.T) {
+	dir := t.TempDir()
+	key, err := LoadOrCreateSigningKey(filepath.Join(dir, "signing.key"))
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	pub, err := LoadPublicKey(filepath.Join(dir, "signing.key.pub"))
+	if err != nil {
+		t.Fatalf("public key: %v", err)
+	}
+	store, err := OpenStore(dir, Options{BatchSize: 3, SigningKey: key})
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for i := 0; i < 7; i++ {
+		if _, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	cp := store.LatestCheckpoint()
+	if cp == nil || cp.TreeSize != 6 {
+		t.Fatalf("expected checkpoint at size 6, got %+v", cp)
+	}
+
+	eventsPath := filepath.Join(dir, "events.log")
+	rootsPath := filepath.Join(dir, "roots.log")
+	opts := VerifyOptions{BatchSize: 3, CheckpointsPath: filepath.Join(dir, "checkpoints.log"), PublicKey: pub}
+	report := VerifyWithOptions(eventsPath, rootsPath, opts)
+	if !report.OK || report.CheckpointsChecked != 2 {
+		t.Fatalf("expected 2 valid checkpoints: %+v", report)
+	}
+
+	// Rewrite an event and recompute every hash and root, as someone with
+	// write access to the evidence files could. Only the signatures catch it.
+	forgedDir := t.TempDir()
+	forged, err := NewStore(forgedDir, 3)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for i := 0; i < 7; i++ {
+		if _, _, err := forged.AppendEvent(Event{Type: "trade", Source: "forged", Payload: map[string]interface{}{"seq": i}}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	forgedEvents := filepath.Join(forgedDir, "events.log")
+	forgedRoots := filepath.Join(forgedDir, "roots.log")
+	if report := Verify(forgedEvents, forgedRoots, 3); !report.OK {
+		t.Fatalf("forged log should be self-consistent: %+v", report)
+	}
+	if report := VerifyWithOptions(forgedEvents, forgedRoots, opts); report.OK {
+		t.Fatalf("expected forged log to fail checkpoint verification")
+	}
+
+	other, err := LoadOrCreateSigningKey(filepath.Join(t.TempDir(), "other.key"))
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	if err := VerifyCheckpoint(*cp, other.Public().(ed25519.PublicKey)); err == nil {
+		t.Fatalf("expected checkpoint from untrusted key to fail")
+	}
+}
+
+func TestTreeV2DomainSeparation(t *testing.T) {
+	a, b, c := hashBytes(HashSHA256, []byte("a")), hashBytes(HashSHA256, []byte("b")), hashBytes(HashSHA256, []byte("c"))
+	if MerkleRoot(HashSHA256, []string{a, b, c}) != MerkleRoot(HashSHA256, []string{a, b, c, c}) {
+		t.Fatalf("expected v1 trees to collide on a duplicated last leaf")
+	}
+	if BatchRoot(HashSHA256, TreeV2, []string{a, b, c}) == BatchRoot(HashSHA256, TreeV2, []string{a, b, c, c}) {
+		t.Fatalf("v2 roots must differ for a duplicated last leaf")
+	}
+	inner := BatchRoot(HashSHA256, TreeV2, []string{a, b})
+	if BatchRoot(HashSHA256, TreeV2, []string{inner}) == inner {
+		t.Fatalf("v2 leaf hash must differ from node hash")
+	}
+
+	for size := 1; size <= 9; size++ {
+		hashes := make([]string, size)
+		for i := range hashes {
+			hashes[i] = hashBytes(HashSHA256, []byte{byte(i)})
+		}
+		root := BatchRoot(HashSHA256, TreeV2, hashes)
+		for i := range hashes {
+			path, err := BatchProof(HashSHA256, TreeV2, hashes, i)
+			if err != nil {
+				t.Fatalf("size %d leaf %d: %v", size, i, err)
+			}
+			if !VerifyBatchProof(HashSHA256, TreeV2, hashes[i], i, size, path, root) {
+				t.Fatalf("size %d leaf %d: proof rejected", size, i)
+			}
+		}
+	}
+}
+
+func TestTreeVersionPerLog(t *testing.T) {
+	dir := t.TempDir()
+	legacy, err := OpenStore(dir, Options{BatchSize: 3, TreeVersion: TreeV1})
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, _, err := legacy.AppendEvent(Event{Type: "trade", Payload: map[string]interface{}{"seq": i}}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	// Reopening with the default keeps the version already recorded.
+	reopened, err := NewStore(dir, 3)
+	if err != nil {
+		t.Fatalf("store reopen: %v", err)
+	}
+	if reopened.TreeVersion() != TreeV1 {
+		t.Fatalf("expected legacy log to stay on v1, got %d", reopened.TreeVersion())
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := reopened.AppendEvent(Event{Type: "trade", Payload: map[string]interface{}{"seq": i}}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	report := Verify(filepath.Join(dir, "events.log"), filepath.Join(dir, "roots.log"), 3)
+	if !report.OK || report.RootsChecked != 2 {
+		t.Fatalf("expected legacy log to verify: %+v", report)
+	}
+	proof, err := reopened.InclusionProof(2)
+	if err != nil {
+		t.Fatalf("proof: %v", err)
+	}
+	if err := VerifyInclusion(proof); err != nil {
+		t.Fatalf("verify legacy proof: %v", err)
+	}
+
+	fresh, err := NewStore(t.TempDir(), 3)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	if fresh.TreeVersion() != TreeV2 {
+		t.Fatalf("expected new logs to default to v2")
+	}
+}
+
+func TestVerifyDetectsTailTruncation(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir, 2)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		if _, _, err := store.AppendEvent(Event{Type: "trade", Payload: map[string]interface{}{"seq": i}}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	head := store.HighWater()
+
+	eventsPath := filepath.Join(dir, "events.log")
+	rootsPath := filepath.Join(dir, "roots.log")
+	dropLastLines(t, eventsPath, 2)
+	dropLastLines(t, rootsPath, 1)
+
+	if report := Verify(eventsPath, rootsPath, 2); !report.OK {
+		t.Fatalf("truncated log is still self-consistent: %+v", report)
+	}
+	report := VerifyWithOptions(eventsPath, rootsPath, VerifyOptions{BatchSize: 2, Expect: []TrustedState{head}})
+	if report.OK || !report.Truncated {
+		t.Fatalf("expected truncation: %+v", report)
+	}
+
+	if _, err := NewStore(dir, 2); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected store to refuse truncated log, got %v", err)
+	}
+}
+
+func TestHeadCoversUnsealedRecords(t *testing.T) {
+	for _, mode := range []Durability{DurabilityNone, DurabilityFsync, DurabilityGroup} {
+		dir := t.TempDir()
+		store, err := OpenStore(dir, Options{BatchSize: 4, Durability: mode})
+		if err != nil {
+			t.Fatalf("%s: store init: %v", mode, err)
+		}
+		for i := 0; i < 6; i++ {
+			if _, _, err := store.AppendEvent(Event{Type: "trade", Payload: map[string]interface{}{"seq": i}}); err != nil {
+				t.Fatalf("%s: append: %v", mode, err)
+			}
+		}
+		// The durable modes move the mark at every sync, the others on Close.
+		if mode == DurabilityNone {
+			if err := store.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+		}
+		head, err := ReadTrustedState(filepath.Join(dir, "head.json"))
+		if err != nil || head == nil || head.Index != 6 {
+			t.Fatalf("%s: high-water mark %+v, %v; want index 6", mode, head, err)
+		}
+
+		// Record 6 is in the open batch, so no root or checkpoint covers it.
+		eventsPath := filepath.Join(dir, "events.log")
+		dropLastLines(t, eventsPath, 1)
+		report := VerifyWithOptions(eventsPath, filepath.Join(dir, "roots.log"), VerifyOptions{Expect: []TrustedState{*head}})
+		if report.OK || !report.Truncated || report.Findings[0].Code != FindingTruncated {
+			t.Fatalf("%s: expected truncation: %+v", mode, report)
+		}
+		store.Close()
+	}
+}
+
+func dropLastLines(t *testing.T, path string, n int) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	lines = lines[:len(lines)-1-n] // SplitAfter leaves a trailing empty element
+	if err := os.WriteFile(path, bytes.Join(lines, nil), 0o644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestVerifyFindings(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir, 2)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	eventsPath := filepath.Join(dir, "events.log")
+	rootsPath := filepath.Join(dir, "roots.log")
+	data, err := os.ReadFile(eventsPath)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	secondOffset := int64(len(lines[0]))
+	lines[1] = bytes.Replace(lines[1], []byte(`"source":"test"`), []byte(`"source":"evil"`), 1)
+	lines[2] = []byte("{not json\n")
+	if err := os.WriteFile(eventsPath, bytes.Join(lines, nil), 0o644); err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+
+	report := Verify(eventsPath, rootsPath, 2)
+	if report.OK || len(report.Findings) != len(report.Errors) {
+		t.Fatalf("expected findings mirrored in errors: %+v", report)
+	}
+	codes := map[FindingCode]Finding{}
+	for _, f := range report.Findings {
+		codes[f.Code] = f
+	}
+	hash, ok := codes[FindingHashMismatch]
+	if !ok || hash.Index != 2 || hash.Offset != secondOffset || hash.File != "events.log" || hash.Kind != KindChain {
+		t.Fatalf("unexpected hash finding: %+v", hash)
+	}
+	if hash.Expected == hash.Actual || hash.Actual == "" {
+		t.Fatalf("expected differing hashes: %+v", hash)
+	}
+	if decode, ok := codes[FindingDecode]; !ok || decode.Kind != KindDecode || decode.Index != 3 {
+		t.Fatalf("unexpected decode finding: %+v", decode)
+	}
+	if _, ok := codes[FindingRootMismatch]; ok {
+		t.Fatalf("roots cover stored hashes and should still match: %+v", report.Findings)
+	}
+}
+
+func TestIncrementalVerify(t *testing.T) {
+	dir := t.TempDir()
+	key, err := LoadOrCreateSigningKey(filepath.Join(dir, "signing.key"))
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	store, err := OpenStore(dir, Options{BatchSize: 3, SigningKey: key})
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	appendN := func(n int) {
+		for i := 0; i < n; i++ {
+			if _, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}}); err != nil {
+				t.Fatalf("append: %v", err)
+			}
+		}
+	}
+	eventsPath := filepath.Join(dir, "events.log")
+	rootsPath := filepath.Join(dir, "roots.log")
+	opts := VerifyOptions{
+		BatchSize:       3,
+		CheckpointsPath: filepath.Join(dir, "checkpoints.log"),
+		PublicKey:       key.Public().(ed25519.PublicKey),
+		StatePath:       filepath.Join(dir, "verify.state.json"),
+	}
+
+	appendN(5)
+	first := VerifyWithOptions(eventsPath, rootsPath, opts)
+	if !first.OK || first.ResumedFrom != 0 {
+		t.Fatalf("expected clean full first run: %+v", first)
+	}
+
+	appendN(6)
+	opts.Expect = []TrustedState{store.HighWater()}
+	resumed := VerifyWithOptions(eventsPath, rootsPath, opts)
+	full := VerifyWithOptions(eventsPath, rootsPath, VerifyOptions{
+		BatchSize:       3,
+		CheckpointsPath: opts.CheckpointsPath,
+		PublicKey:       opts.PublicKey,
+	})
+	if !resumed.OK || resumed.ResumedFrom != 5 {
+		t.Fatalf("expected run to resume after 5: %+v", resumed)
+	}
+	if resumed.Total != full.Total || resumed.TreeRoot != full.TreeRoot ||
+		resumed.RootsChecked != full.RootsChecked || resumed.CheckpointsChecked != full.CheckpointsChecked {
+		t.Fatalf("incremental report differs from full:\n%+v\n%+v", resumed, full)
+	}
+
+	idle := VerifyWithOptions(eventsPath, rootsPath, opts)
+	if !idle.OK || idle.ResumedFrom != 11 {
+		t.Fatalf("expected idle run to resume at head: %+v", idle)
+	}
+
+	// Rewriting the record the saved state points at forces a full run,
+	// which reports the tamper.
+	data, err := os.ReadFile(eventsPath)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	lines[10] = bytes.Replace(lines[10], []byte(`"source":"test"`), []byte(`"source":"evil"`), 1)
+	if err := os.WriteFile(eventsPath, bytes.Join(lines, nil), 0o644); err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+	opts.Expect = nil
+	if report := VerifyWithOptions(eventsPath, rootsPath, opts); report.OK || report.ResumedFrom != 0 {
+		t.Fatalf("expected full run to catch tamper: %+v", report)
+	}
+}
+
+func TestParallelVerifyMatchesSequential(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir, 7)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for i := 0; i < 2500; i++ {
+		if _, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		if i == 1200 {
+			// A new epoch seals a short batch, so later batches are no
+			// longer aligned to multiples of the batch size.
+			if _, err := store.StartEpoch(HashBLAKE2b256); err != nil {
+				t.Fatalf("start epoch: %v", err)
+			}
+		}
+	}
+	eventsPath := filepath.Join(dir, "events.log")
+	rootsPath := filepath.Join(dir, "roots.log")
+
+	compare := func(name string) {
+		t.Helper()
+		sequential := Verify(eventsPath, rootsPath, 7)
+		parallel := VerifyWithOptions(eventsPath, rootsPath, VerifyOptions{BatchSize: 7, Workers: 4})
+		if !reflect.DeepEqual(sequential, parallel) {
+			t.Fatalf("%s: parallel report differs:\n%+v\n%+v", name, sequential, parallel)
+		}
+	}
+	compare("clean")
+
+	// Roots that lie about their range or hash must not make the workers'
+	// batch roots stand in for the stitched batches.
+	roots, err := os.ReadFile(rootsPath)
+	if err != nil {
+		t.Fatalf("read roots: %v", err)
+	}
+	rootLines := bytes.SplitAfter(roots, []byte("\n"))
+	rootLines[20] = bytes.Replace(rootLines[20], []byte(`"from_index":141`), []byte(`"from_index":142`), 1)
+	rootLines[40] = bytes.Replace(rootLines[40], []byte(`"root_hash":"`), []byte(`"root_hash":"00`), 1)
+	if err := os.WriteFile(rootsPath, bytes.Join(rootLines, nil), 0o644); err != nil {
+		t.Fatalf("write roots: %v", err)
+	}
+	compare("forged roots")
+	if report := Verify(eventsPath, rootsPath, 7); report.OK || len(report.Findings) != 1 || report.Findings[0].ToIndex != 287 {
+		t.Fatalf("forged roots: %+v", report.Findings)
+	}
+
+	data, err := os.ReadFile(eventsPath)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	lines[3] = bytes.Replace(lines[3], []byte(`"source":"test"`), []byte(`"source":"evil"`), 1)
+	lines[1030] = []byte("{broken\n")
+	lines = append(lines[:2047], lines[2048:]...)
+	if err := os.WriteFile(eventsPath, bytes.Join(lines, nil), 0o644); err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+	compare("tampered")
+}
+
+func TestRecordOffsetIndex(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir, 4)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	var appended []Record
+	for i := 0; i < 10; i++ {
+		rec, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}})
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		appended = append(appended, rec)
+	}
+
+	check := func(name string, s *Store) {
+		t.Helper()
+		rec, err := s.Record(7)
+		if err != nil || rec.Hash != appended[6].Hash {
+			t.Fatalf("%s: record 7 = %+v, %v", name, rec, err)
+		}
+		records, err := s.Records(3, 5)
+		if err != nil || len(records) != 3 || records[0].Index != 3 || records[2].Hash != appended[4].Hash {
+			t.Fatalf("%s: records 3..5 = %+v, %v", name, records, err)
+		}
+		tail, err := s.Tail(4)
+		if err != nil || len(tail) != 4 || tail[0].Index != 7 || tail[3].Index != 10 {
+			t.Fatalf("%s: tail = %+v, %v", name, tail, err)
+		}
+		if _, err := s.Record(11); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("%s: expected ErrRecordNotFound, got %v", name, err)
+		}
+	}
+	check("live", store)
+
+	indexPath := filepath.Join(dir, "events.idx")
+	if err := os.Remove(indexPath); err != nil {
+		t.Fatalf("remove index: %v", err)
+	}
+	reopened, err := NewStore(dir, 4)
+	if err != nil {
+		t.Fatalf("reopen without index: %v", err)
+	}
+	check("rebuilt", reopened)
+
+	if err := os.WriteFile(indexPath, []byte("garbage!garbage!"), 0o644); err != nil {
+		t.Fatalf("corrupt index: %v", err)
+	}
+	reopened, err = NewStore(dir, 4)
+	if err != nil {
+		t.Fatalf("reopen with corrupt index: %v", err)
+	}
+	check("repaired", reopened)
+	if info, err := os.Stat(indexPath); err != nil || info.Size() != 10*indexEntrySize {
+		t.Fatalf("index size after repair: %v, %v", info, err)
+	}
+}
+
+func TestSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{BatchSize: 4, SegmentMaxBatches: 2}
+	store, err := OpenStore(dir, opts)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	var appended []Record
+	for i := 0; i < 21; i++ {
+		rec, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}})
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		appended = append(appended, rec)
+	}
+
+	eventsPath := filepath.Join(dir, "events.log")
+	rootsPath := filepath.Join(dir, "roots.log")
+	manifest, err := ReadManifest(ManifestPath(eventsPath))
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	if len(manifest.Segments) != 2 || manifest.Segments[1].FirstIndex != 9 || manifest.Segments[1].LastIndex != 16 {
+		t.Fatalf("unexpected segments: %+v", manifest.Segments)
+	}
+	files, err := SegmentFiles(eventsPath)
+	if err != nil || len(files) != 3 {
+		t.Fatalf("segment files = %v, %v", files, err)
+	}
+
+	records, err := store.Records(6, 18)
+	if err != nil || len(records) != 13 || records[0].Index != 6 || records[12].Hash != appended[17].Hash {
+		t.Fatalf("records across segments = %d, %v", len(records), err)
+	}
+	proof, err := store.InclusionProof(3)
+	if err != nil || VerifyInclusion(proof) != nil {
+		t.Fatalf("proof in sealed segment: %v", err)
+	}
+
+	report := Verify(eventsPath, rootsPath, 4)
+	if !report.OK || report.Total != 21 || report.RootsChecked != 5 {
+		t.Fatalf("expected clean report across segments: %+v", report)
+	}
+
+	statePath := filepath.Join(dir, "verify.state.json")
+	incremental := VerifyOptions{BatchSize: 4, StatePath: statePath}
+	if report := VerifyWithOptions(eventsPath, rootsPath, incremental); !report.OK {
+		t.Fatalf("initial incremental run: %+v", report)
+	}
+
+	reopened, err := OpenStore(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if size, root := reopened.TreeHead(); size != 21 || root != report.TreeRoot {
+		t.Fatalf("reopened tree head %d %s, want 21 %s", size, root, report.TreeRoot)
+	}
+	for i := 0; i < 3; i++ {
+		rec, _, err := reopened.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": 21 + i}})
+		if err != nil {
+			t.Fatalf("append after reopen: %v", err)
+		}
+		if i == 0 && rec.PrevHash != appended[20].Hash {
+			t.Fatalf("chain does not continue after reopen: %+v", rec)
+		}
+	}
+
+	// The saved position was in events.log, which has since been sealed as
+	// segment 3; resuming follows it there.
+	report = VerifyWithOptions(eventsPath, rootsPath, incremental)
+	if !report.OK || report.ResumedFrom != 21 || report.Total != 24 {
+		t.Fatalf("expected resume across rotation: %+v", report)
+	}
+
+	// Swapping a sealed segment for a different file is caught against the
+	// manifest even though the chain inside it is self-consistent.
+	first := filepath.Join(dir, manifest.Segments[0].File)
+	data, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatalf("read segment: %v", err)
+	}
+	if err := os.WriteFile(first, bytes.SplitAfterN(data, []byte("\n"), 2)[0], 0o644); err != nil {
+		t.Fatalf("write segment: %v", err)
+	}
+	report = Verify(eventsPath, rootsPath, 4)
+	found := false
+	for _, f := range report.Findings {
+		found = found || f.Code == FindingSegmentMismatch
+	}
+	if report.OK || !found {
+		t.Fatalf("expected segment mismatch: %+v", report.Findings)
+	}
+}
+
+func TestVerifyArchivedSegments(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("keygen: %v", err)
+	}
+	dir := t.TempDir()
+	store, err := OpenStore(dir, Options{BatchSize: 4, SegmentMaxBatches: 2, SigningKey: priv})
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	var appended []Record
+	for i := 0; i < 21; i++ {
+		rec, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}})
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		appended = append(appended, rec)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	eventsPath := filepath.Join(dir, "events.log")
+	rootsPath := filepath.Join(dir, "roots.log")
+	opts := VerifyOptions{
+		BatchSize:       4,
+		CheckpointsPath: filepath.Join(dir, "checkpoints.log"),
+		PublicKey:       pub,
+		Expect:          []TrustedState{{Index: 8, Hash: appended[7].Hash}},
+	}
+	full := VerifyWithOptions(eventsPath, rootsPath, opts)
+	if !full.OK || full.RootsChecked != 5 || full.CheckpointsChecked != 5 || len(full.ArchivedSegments) != 0 {
+		t.Fatalf("full report: %+v", full)
+	}
+
+	// Segment 1 moves to cold storage: verification picks up from its
+	// manifest head and still checks the checkpoint at its end.
+	if err := os.Remove(filepath.Join(dir, segmentFile(1))); err != nil {
+		t.Fatalf("archive segment: %v", err)
+	}
+	for _, workers := range []int{1, 2} {
+		opts.Workers = workers
+		report := VerifyWithOptions(eventsPath, rootsPath, opts)
+		if !report.OK || report.Total != 21 || report.TreeRoot != full.TreeRoot || report.RootsChecked != 3 ||
+			report.CheckpointsChecked != 4 || !reflect.DeepEqual(report.ArchivedSegments, []int{1}) {
+			t.Fatalf("workers %d: report with segment 1 archived: %+v", workers, report)
+		}
+	}
+
+	// The records after an archived segment still have to chain to the
+	// head the manifest recorded for it.
+	manifestPath := ManifestPath(eventsPath)
+	manifest, err := ReadManifest(manifestPath)
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	good := manifest
+	manifest.Segments = append([]Segment(nil), manifest.Segments...)
+	manifest.Segments[0].LastHash = appended[6].Hash
+	if err := writeJSONFile(manifestPath, manifest, false); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	report := VerifyWithOptions(eventsPath, rootsPath, opts)
+	if report.OK || len(report.Findings) != 2 || report.Findings[0].Code != FindingExpectedMismatch ||
+		report.Findings[1].Code != FindingPrevHashMismatch || report.Findings[1].Index != 9 {
+		t.Fatalf("forged manifest head accepted: %+v", report.Findings)
+	}
+	if err := writeJSONFile(manifestPath, good, false); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, segmentFile(2))); err != nil {
+		t.Fatalf("archive segment: %v", err)
+	}
+	report = VerifyWithOptions(eventsPath, rootsPath, opts)
+	if !report.OK || report.LastIndex != 21 || report.RootsChecked != 1 || !reflect.DeepEqual(report.ArchivedSegments, []int{1, 2}) {
+		t.Fatalf("report with segments 1 and 2 archived: %+v", report)
+	}
+}
+
+func TestDurabilityModes(t *testing.T) {
+	if _, err := OpenStore(t.TempDir(), Options{Durability: "sometimes"}); err == nil {
+		t.Fatalf("expected unknown durability mode to be rejected")
+	}
+	for _, mode := range []Durability{DurabilityNone, DurabilityFsync, DurabilityGroup} {
+		dir := t.TempDir()
+		store, err := OpenStore(dir, Options{BatchSize: 5, Durability: mode})
+		if err != nil {
+			t.Fatalf("%s: store init: %v", mode, err)
+		}
+		var wg sync.WaitGroup
+		errs := make(chan error, 40)
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 5; i++ {
+					_, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"w": w, "i": i}})
+					errs <- err
+				}
+			}(w)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("%s: append: %v", mode, err)
+			}
+		}
+		report := Verify(filepath.Join(dir, "events.log"), filepath.Join(dir, "roots.log"), 5)
+		if !report.OK || report.Total != 40 || report.RootsChecked != 8 {
+			t.Fatalf("%s: unexpected report: %+v", mode, report)
+		}
+		if mode == DurabilityGroup && store.group.synced != store.written {
+			t.Fatalf("group commit left appends unsynced: %d of %d", store.group.synced, store.written)
+		}
+	}
+}
+
+// failingSync is a backend whose Sync fails while fail is set.
+type failingSync struct {
+	Backend
+	fail bool
+}
+
+func (b *failingSync) Sync() error {
+	if b.fail {
+		return errors.New("sync: input/output error")
+	}
+	return b.Backend.Sync()
+}
+
+func TestFailedSyncStopsAppends(t *testing.T) {
+	for _, mode := range []Durability{DurabilityFsync, DurabilityGroup} {
+		backend := &failingSync{Backend: newMemoryBackend()}
+		store, err := OpenStore("", Options{BatchSize: 4, Durability: mode, Backend: backend})
+		if err != nil {
+			t.Fatalf("%s: store init: %v", mode, err)
+		}
+		appendOne := func() error {
+			_, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": 1}})
+			return err
+		}
+		for i := 0; i < 2; i++ {
+			if err := appendOne(); err != nil {
+				t.Fatalf("%s: append: %v", mode, err)
+			}
+		}
+		backend.fail = true
+		if err := appendOne(); err == nil {
+			t.Fatalf("%s: append with a failing sync succeeded", mode)
+		}
+		// Record 3 reached the backend even though its sync failed, so the
+		// store must not hand out index 3, or chain to record 2, again.
+		backend.fail = false
+		if err := appendOne(); !errors.Is(err, ErrFailed) {
+			t.Fatalf("%s: append after a failed sync: %v", mode, err)
+		}
+		if _, err := store.StartEpoch(HashBLAKE2b256); !errors.Is(err, ErrFailed) {
+			t.Fatalf("%s: epoch after a failed sync: %v", mode, err)
+		}
+		if report := store.Verify(VerifyOptions{}); !report.OK || report.Total != 3 {
+			t.Fatalf("%s: log after a failed sync: %+v", mode, report)
+		}
+		if err := store.Close(); err != nil {
+			t.Fatalf("%s: close: %v", mode, err)
+		}
+
+		store, err = OpenStore("", Options{BatchSize: 4, Durability: mode, Backend: backend})
+		if err != nil {
+			t.Fatalf("%s: reopen: %v", mode, err)
+		}
+		if err := appendOne(); err != nil {
+			t.Fatalf("%s: append after reopen: %v", mode, err)
+		}
+		if report := store.Verify(VerifyOptions{}); !report.OK || report.Total != 4 || report.RootsChecked != 1 {
+			t.Fatalf("%s: log after reopen: %+v", mode, report)
+		}
+	}
+}
+
+func TestRecoverTornTail(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir, 4)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	eventsPath := filepath.Join(dir, "events.log")
+	rootsPath := filepath.Join(dir, "roots.log")
+
+	// A complete record that only lost its newline is kept.
+	data, err := os.ReadFile(eventsPath)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	if err := os.WriteFile(eventsPath, bytes.TrimSuffix(data, []byte("\n")), 0o644); err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+	store, err = NewStore(dir, 4)
+	if err != nil {
+		t.Fatalf("reopen with unterminated record: %v", err)
+	}
+	if store.Recovery() != nil || store.HighWater().Index != 5 {
+		t.Fatalf("unterminated complete record should be kept: %+v", store.Recovery())
+	}
+
+	torn := []byte(`{"index":6,"timestamp":"2026-01-0`)
+	file, err := os.OpenFile(eventsPath, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	file.Write(torn)
+	file.Close()
+
+	store, err = NewStore(dir, 4)
+	if err != nil {
+		t.Fatalf("reopen with torn record: %v", err)
+	}
+	r := store.Recovery()
+	if r == nil || r.Offset != int64(len(data)) || !bytes.Equal(r.Data, torn) || r.IncidentIndex != 6 {
+		t.Fatalf("unexpected recovery: %+v", r)
+	}
+	quarantined, err := os.ReadFile(filepath.Join(dir, "recovery.log"))
+	if err != nil || !bytes.Contains(quarantined, []byte(r.SHA256)) {
+		t.Fatalf("torn record not quarantined: %s, %v", quarantined, err)
+	}
+	incident, err := store.Record(6)
+	if err != nil || incident.Event.Type != IncidentRecovery || incident.Event.Payload["sha256"] != r.SHA256 {
+		t.Fatalf("incident record = %+v, %v", incident, err)
+	}
+	if report := Verify(eventsPath, rootsPath, 4); !report.OK || report.Total != 6 {
+		t.Fatalf("expected clean log after recovery: %+v", report)
+	}
+
+	// Damage before the last line is not a torn write and is left alone.
+	data, _ = os.ReadFile(eventsPath)
+	data[0] = 'x'
+	os.WriteFile(eventsPath, data, 0o644)
+	if _, err := NewStore(dir, 4); err == nil {
+		t.Fatalf("expected corrupt record before the tail to fail startup")
+	}
+}
+
+func TestStoreClose(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(dir, Options{BatchSize: 4, Durability: DurabilityGroup})
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		if _, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+	if _, _, err := store.AppendEvent(Event{Type: "trade"}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if tail, err := store.Tail(2); err != nil || len(tail) != 2 || tail[1].Index != 6 {
+		t.Fatalf("tail after close = %+v, %v", tail, err)
+	}
+
+	// Index entries buffered at Close were written out, so reopening does not
+	// need to rebuild them.
+	info, err := os.Stat(filepath.Join(dir, "events.idx"))
+	if err != nil || info.Size() != 6*indexEntrySize {
+		t.Fatalf("index after close: %v, %v", info, err)
+	}
+	reopened, err := NewStore(dir, 4)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	if head := reopened.HighWater(); head.Index != 6 {
+		t.Fatalf("reopened at %d, want 6", head.Index)
+	}
+}
+
+// benchEvent is a trade event of roughly the size the backend sends.
+func TestStorageBackends(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("keygen: %v", err)
+	}
+	memory := NewMemoryBackend()
+	for _, storage := range []string{StorageFile, StorageKV, StorageMemory} {
+		t.Run(storage, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := Options{BatchSize: 4, SigningKey: priv, Storage: storage, Durability: DurabilityGroup}
+			if storage == StorageMemory {
+				opts.Backend = memory
+			}
+			appendN := func(store *Store, n int) {
+				for i := 0; i < n; i++ {
+					if _, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}}); err != nil {
+						t.Fatalf("append: %v", err)
+					}
+				}
+			}
+			verify := func(store *Store) {
+				report := store.Verify(VerifyOptions{BatchSize: 4, PublicKey: pub, Expect: []TrustedState{store.HighWater()}})
+				if !report.OK || report.CheckpointsChecked == 0 {
+					t.Fatalf("verify: %+v", report)
+				}
+			}
+
+			store, err := OpenStore(dir, opts)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			appendN(store, 10)
+			verify(store)
+			if tail, err := store.Tail(3); err != nil || len(tail) != 3 || tail[0].Index != 8 {
+				t.Fatalf("tail = %+v, %v", tail, err)
+			}
+			proof, err := store.InclusionProof(6)
+			if err != nil {
+				t.Fatalf("inclusion proof: %v", err)
+			}
+			if err := VerifyInclusion(proof); err != nil {
+				t.Fatalf("verify inclusion: %v", err)
+			}
+			if _, err := store.InclusionProof(10); !errors.Is(err, ErrNotSealed) {
+				t.Fatalf("expected ErrNotSealed, got %v", err)
+			}
+			consistency, err := store.ConsistencyProof(3, 10)
+			if err != nil {
+				t.Fatalf("consistency proof: %v", err)
+			}
+			if err := VerifyConsistency(consistency); err != nil {
+				t.Fatalf("verify consistency: %v", err)
+			}
+			head := store.HighWater()
+			if err := store.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+
+			// Reopening replays the backend into the same chain head and
+			// pending batch.
+			reopened, err := OpenStore(dir, opts)
+			if err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			defer reopened.Close()
+			if got := reopened.HighWater(); got.Index != head.Index || got.Hash != head.Hash || got.TreeRoot != head.TreeRoot {
+				t.Fatalf("reopened at %+v, want %+v", got, head)
+			}
+			appendN(reopened, 2)
+			if last, err := reopened.LastRoot(); err != nil || last == nil || last.ToIndex != 12 {
+				t.Fatalf("last root = %+v, %v", last, err)
+			}
+			verify(reopened)
+		})
+	}
+
+	// The chain checks are the Store's, so tampering with a record held by
+	// any backend is reported.
+	memory.(*memoryBackend).records[4].Event.Source = "forged"
+	store, err := OpenStore("", Options{BatchSize: 4, Backend: memory})
+	if err != nil {
+		t.Fatalf("open memory: %v", err)
+	}
+	if report := store.Verify(VerifyOptions{BatchSize: 4}); report.OK {
+		t.Fatalf("expected forged record to fail verification")
+	}
+}
+
+func TestKVBackendTornTail(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(dir, Options{BatchSize: 2, Storage: StorageKV})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := store.AppendEvent(Event{Type: "trade", Source: "test"}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	store.Close()
+
+	path := filepath.Join(dir, "audit.kv")
+	frame, err := encodeKVFrame("record/4", Record{Index: 4})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("open kv: %v", err)
+	}
+	file.Write(frame[:len(frame)-3])
+	file.Close()
+
+	reopened, err := OpenStore(dir, Options{BatchSize: 2, Storage: StorageKV})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	r := reopened.Recovery()
+	if r == nil || r.File != "audit.kv" || r.Size != int64(len(frame)-3) || r.IncidentIndex != 4 {
+		t.Fatalf("recovery = %+v", r)
+	}
+	if report := reopened.Verify(VerifyOptions{BatchSize: 2}); !report.OK || report.LastIndex != 4 {
+		t.Fatalf("verify after recovery: %+v", report)
+	}
+}
+
+func TestStorageEngineMismatch(t *testing.T) {
+	for _, tc := range []struct{ created, opened string }{
+		{StorageKV, StorageFile},
+		{StorageKV, ""},
+		{StorageFile, StorageKV},
+	} {
+		dir := t.TempDir()
+		store, err := OpenStore(dir, Options{BatchSize: 2, Storage: tc.created})
+		if err != nil {
+			t.Fatalf("open %s: %v", tc.created, err)
+		}
+		store.Close()
+		if _, err := OpenStore(dir, Options{BatchSize: 2, Storage: tc.opened}); err == nil {
+			t.Fatalf("%s log opened with storage %q", tc.created, tc.opened)
+		}
+	}
+}
+
+func TestBinaryLogFormat(t *testing.T) {
+	zone := time.FixedZone("test", 2*60*60)
+	event := func(i int) Event {
+		return Event{
+			ID:        "evt",
+			Type:      "trade",
+			Source:    "test",
+			Timestamp: time.Date(2026, 3, 1, 12, 0, i, 500, zone),
+			Payload:   map[string]interface{}{"seq": i, "amount": 0.1 * float64(i), "tags": []interface{}{"a", "<b>"}},
+		}
+	}
+	appendAll := func(t *testing.T, store *Store, from, to int) []Record {
+		var out []Record
+		for i := from; i < to; i++ {
+			rec, _, err := store.AppendEvent(event(i))
+			if err != nil {
+				t.Fatalf("append: %v", err)
+			}
+			out = append(out, rec)
+		}
+		return out
+	}
+
+	jsonDir, binDir := t.TempDir(), t.TempDir()
+	jsonStore, err := OpenStore(jsonDir, Options{BatchSize: 4, SegmentMaxBatches: 2})
+	if err != nil {
+		t.Fatalf("json store: %v", err)
+	}
+	// Both logs share one genesis, so their chains start from the same hash.
+	genesis, err := os.ReadFile(GenesisPath(filepath.Join(jsonDir, "events.log")))
+	if err != nil {
+		t.Fatalf("read genesis: %v", err)
+	}
+	if err := os.WriteFile(GenesisPath(filepath.Join(binDir, "events.log")), genesis, 0o644); err != nil {
+		t.Fatalf("copy genesis: %v", err)
+	}
+	binStore, err := OpenStore(binDir, Options{BatchSize: 4, SegmentMaxBatches: 2, LogFormat: FormatBinary})
+	if err != nil {
+		t.Fatalf("binary store: %v", err)
+	}
+	jsonRecords := appendAll(t, jsonStore, 0, 10)
+	binRecords := appendAll(t, binStore, 0, 10)
+	jsonStore.Close()
+	binStore.Close()
+
+	// The hash input is the event, not its storage form.
+	for i := range jsonRecords {
+		if jsonRecords[i].Hash != binRecords[i].Hash {
+			t.Fatalf("record %d hash depends on log format", i+1)
+		}
+	}
+	binEvents := filepath.Join(binDir, "events.log")
+	data, err := os.ReadFile(binEvents)
+	if err != nil || !bytes.HasPrefix(data, []byte(binaryMagic)) {
+		t.Fatalf("binary live file lacks header: %v", err)
+	}
+	segment, err := os.ReadFile(filepath.Join(binDir, segmentFile(1)))
+	if err != nil || !bytes.HasPrefix(segment, []byte(binaryMagic)) {
+		t.Fatalf("binary segment lacks header: %v", err)
+	}
+
+	binStore, err = OpenStore(binDir, Options{BatchSize: 4, SegmentMaxBatches: 2, LogFormat: FormatBinary})
+	if err != nil {
+		t.Fatalf("reopen binary: %v", err)
+	}
+	binRecords = append(binRecords, appendAll(t, binStore, 10, 13)...)
+	got, err := binStore.Records(1, 13)
+	if err != nil {
+		t.Fatalf("read binary records: %v", err)
+	}
+	for i, rec := range got {
+		if rec.Hash != binRecords[i].Hash || !rec.Event.Timestamp.Equal(binRecords[i].Event.Timestamp) || rec.Event.Payload["tags"] == nil {
+			t.Fatalf("record %d did not round-trip: %+v", i+1, rec)
+		}
+	}
+	proof, err := binStore.InclusionProof(6)
+	if err != nil || VerifyInclusion(proof) != nil {
+		t.Fatalf("proof from binary log: %v", err)
+	}
+	opts := VerifyOptions{BatchSize: 4, StatePath: filepath.Join(binDir, "verify.state.json"), Expect: []TrustedState{binStore.HighWater()}}
+	if report := binStore.Verify(opts); !report.OK || report.Total != 13 {
+		t.Fatalf("verify binary log: %+v", report)
+	}
+	appendAll(t, binStore, 13, 14)
+	opts.Expect = []TrustedState{binStore.HighWater()}
+	if report := binStore.Verify(opts); !report.OK || report.ResumedFrom != 13 {
+		t.Fatalf("incremental verify of binary log: %+v", report)
+	}
+	binStore.Close()
+
+	// Converting to binary and back reproduces the JSON log byte for byte.
+	jsonEvents := filepath.Join(jsonDir, "events.log")
+	before, _ := os.ReadFile(jsonEvents)
+	stats, err := ConvertLog(jsonEvents, FormatBinary)
+	if err != nil || stats.Records != 10 || stats.BytesAfter >= stats.BytesBefore {
+		t.Fatalf("convert to binary: %+v, %v", stats, err)
+	}
+	if report := Verify(jsonEvents, filepath.Join(jsonDir, "roots.log"), 4); !report.OK || report.Total != 10 {
+		t.Fatalf("verify converted log: %+v", report)
+	}
+	reopened, err := OpenStore(jsonDir, Options{BatchSize: 4, SegmentMaxBatches: 2})
+	if err != nil {
+		t.Fatalf("open converted log: %v", err)
+	}
+	if rec, err := reopened.Record(3); err != nil || rec.Hash != jsonRecords[2].Hash {
+		t.Fatalf("read converted record: %+v, %v", rec, err)
+	}
+	reopened.Close()
+	if _, err := ConvertLog(jsonEvents, FormatJSON); err != nil {
+		t.Fatalf("convert to json: %v", err)
+	}
+	if after, _ := os.ReadFile(jsonEvents); !bytes.Equal(before, after) {
+		t.Fatalf("round trip changed events.log")
+	}
+
+	// A frame cut short by a crash is quarantined like a torn line.
+	data, _ = os.ReadFile(binEvents)
+	frame, err := encodeFrame(FormatBinary, Record{Index: 15, Event: event(15)})
+	if err != nil {
+		t.Fatalf("encode frame: %v", err)
+	}
+	os.WriteFile(binEvents, append(append([]byte(nil), data...), frame[:len(frame)-2]...), 0o644)
+	binStore, err = OpenStore(binDir, Options{BatchSize: 4, SegmentMaxBatches: 2})
+	if err != nil {
+		t.Fatalf("reopen with torn frame: %v", err)
+	}
+	if r := binStore.Recovery(); r == nil || r.Offset != int64(len(data)) || r.Size != int64(len(frame)-2) {
+		t.Fatalf("unexpected recovery: %+v", r)
+	}
+	binStore.Close()
+
+	// A flipped byte inside a frame fails its checksum.
+	data, _ = os.ReadFile(binEvents)
+	data[len(binaryMagic)+frameHeaderSize+4] ^= 0xff
+	os.WriteFile(binEvents, data, 0o644)
+	report := Verify(binEvents, filepath.Join(binDir, "roots.log"), 4)
+	if report.OK || len(report.Findings) == 0 || report.Findings[0].Code != FindingDecode {
+		t.Fatalf("expected checksum failure: %+v", report)
+	}
+}
+
+func benchEvent() Event {
+	return Event{
+		Type:   "trade",
+		Source: "backend",
+		Payload: map[string]interface{}{
+			"mint":       "So11111111111111111111111111111111111111112",
+			"user":       "7xKXtg2CW87d97TXJSDpbD5jBkheTqA83TZRuJosgAsU",
+			"side":       "buy",
+			"amount":     1250.5,
+			"price":      0.0003127,
+			"venue":      "raydium",
+			"signature":  "5VERv8NMvzbJMEkV8xnrLkEaWRtSz9CosKDYjCJjBRnbJLgp8uirBgmQpjKhoR4tjF3ZpRzrFmBV6UjKdiSZkQUW",
+			"slot":       287654321.0,
+			"fee":        0.000005,
+			"risk_score": 0.12,
+		},
+	}
+}
+
+func BenchmarkAppendEvent(b *testing.B) {
+	for _, mode := range []Durability{DurabilityNone, DurabilityFsync, DurabilityGroup} {
+		b.Run(string(mode), func(b *testing.B) {
+			store, err := OpenStore(b.TempDir(), Options{BatchSize: 100, Durability: mode})
+			if err != nil {
+				b.Fatalf("store init: %v", err)
+			}
+			defer store.Close()
+			event := benchEvent()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := store.AppendEvent(event); err != nil {
+					b.Fatalf("append: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkAppendEventParallel models many HTTP handlers appending at once,
+// which is where group commit shares fsyncs between callers.
+func BenchmarkAppendEventParallel(b *testing.B) {
+	for _, mode := range []Durability{DurabilityNone, DurabilityFsync, DurabilityGroup} {
+		b.Run(string(mode), func(b *testing.B) {
+			store, err := OpenStore(b.TempDir(), Options{BatchSize: 100, Durability: mode})
+			if err != nil {
+				b.Fatalf("store init: %v", err)
+			}
+			defer store.Close()
+			event := benchEvent()
+			b.ReportAllocs()
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, _, err := store.AppendEvent(event); err != nil {
+						b.Errorf("append: %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestSegmentCompression(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{BatchSize: 4, SegmentMaxBatches: 2, SegmentCompression: CompressionGzip}
+	store, err := OpenStore(dir, opts)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	// Large payloads spread each segment over several compressed blocks.
+	var records []Record
+	for i := 0; i < 34; i++ {
+		note := bytes.Repeat([]byte{byte('a' + i%26)}, 24*1024)
+		rec, _, err := store.AppendEvent(Event{ID: "evt", Type: "trade", Source: "test", Timestamp: time.Now().UTC(), Payload: map[string]interface{}{"seq": i, "note": string(note)}})
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		records = append(records, rec)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	manifest, err := ReadManifest(filepath.Join(dir, manifestName))
+	if err != nil || len(manifest.Segments) != 4 {
+		t.Fatalf("manifest: %+v, %v", manifest, err)
+	}
+	for _, seg := range manifest.Segments {
+		path := filepath.Join(dir, seg.File)
+		if seg.Compression != CompressionGzip || !isCompressed(path) || seg.CompressedSize >= seg.Size/4 {
+			t.Fatalf("segment %d not compressed: %+v", seg.Seq, seg)
+		}
+		if _, err := os.Stat(filepath.Join(dir, segmentFile(seg.Seq))); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("plain segment %d left behind: %v", seg.Seq, err)
+		}
+		blocks, err := readBlockIndex(path)
+		if err != nil || len(blocks) < 3 {
+			t.Fatalf("segment %d block index: %v, %v", seg.Seq, blocks, err)
+		}
+		file, _, err := openLog(path, 0)
+		if err != nil {
+			t.Fatalf("open segment %d: %v", seg.Seq, err)
+		}
+		plain, err := io.ReadAll(file)
+		file.Close()
+		if err != nil || int64(len(plain)) != seg.Size {
+			t.Fatalf("segment %d decompressed to %d bytes, want %d: %v", seg.Seq, len(plain), seg.Size, err)
+		}
+	}
+
+	// A plain copy left by a crash after the manifest switched is removed.
+	leftover := filepath.Join(dir, segmentFile(1))
+	if err := os.WriteFile(leftover, []byte("stale"), 0o644); err != nil {
+		t.Fatalf("write leftover: %v", err)
+	}
+	store, err = OpenStore(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if _, err := os.Stat(leftover); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("leftover plain segment kept: %v", err)
+	}
+	got, err := store.Records(1, int64(len(records)))
+	if err != nil || len(got) != len(records) {
+		t.Fatalf("read records: %d, %v", len(got), err)
+	}
+	for i, rec := range got {
+		if rec.Hash != records[i].Hash {
+			t.Fatalf("record %d differs after compression", i+1)
+		}
+	}
+	if rec, err := store.Record(15); err != nil || rec.Hash != records[14].Hash {
+		t.Fatalf("seek into compressed segment: %+v, %v", rec, err)
+	}
+	proof, err := store.InclusionProof(23)
+	if err != nil || VerifyInclusion(proof) != nil {
+		t.Fatalf("proof from compressed segment: %v", err)
+	}
+	vopts := VerifyOptions{BatchSize: 4, StatePath: filepath.Join(dir, "verify.state.json"), Expect: []TrustedState{store.HighWater()}}
+	if report := store.Verify(vopts); !report.OK || report.Total != int64(len(records)) {
+		t.Fatalf("verify compressed log: %+v", report)
+	}
+	for i := 0; i < 8; i++ {
+		if _, _, err := store.AppendEvent(Event{ID: "evt", Type: "trade", Source: "test", Timestamp: time.Now().UTC()}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	store.Flush()
+	vopts.Expect = []TrustedState{store.HighWater()}
+	if report := store.Verify(vopts); !report.OK || report.ResumedFrom != int64(len(records)) {
+		t.Fatalf("incremental verify across compressed segment: %+v", report)
+	}
+	store.Close()
+
+	// Tampering with the compressed bytes is still caught.
+	events := filepath.Join(dir, "events.log")
+	if stats, err := ConvertLog(events, FormatBinary); err != nil || stats.Records == 0 {
+		t.Fatalf("convert compressed log: %+v, %v", stats, err)
+	}
+	if report := Verify(events, filepath.Join(dir, "roots.log"), 4); !report.OK {
+		t.Fatalf("verify converted compressed log: %+v", report)
+	}
+	path := filepath.Join(dir, manifest.Segments[1].File)
+	data, _ := os.ReadFile(path)
+	data[len(data)/2] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+	if report := Verify(events, filepath.Join(dir, "roots.log"), 4); report.OK {
+		t.Fatalf("corrupt compressed segment passed verification")
+	}
+}
+
+func TestPayloadEncryption(t *testing.T) {
+	dir := t.TempDir()
+	master, err := LoadOrCreateMasterKey(filepath.Join(t.TempDir(), "master.key"))
+	if err != nil {
+		t.Fatalf("master key: %v", err)
+	}
+	opts := Options{BatchSize: 2, SegmentMaxBatches: 2, MasterKey: master}
+	store, err := OpenStore(dir, opts)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		rec, _, err := store.AppendEvent(Event{ID: "evt", Type: "trade", Source: "test", Payload: map[string]interface{}{"user": "wallet-123", "amount": float64(i)}})
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		if rec.Sealed == nil || rec.Event.Payload["user"] != "wallet-123" {
+			t.Fatalf("append returned %+v", rec)
+		}
+	}
+	if _, _, err := store.AppendEvent(Event{Type: "trade", Payload: map[string]interface{}{sealedField: "x"}}); !errors.Is(err, ErrReservedPayload) {
+		t.Fatalf("reserved payload accepted: %v", err)
+	}
+	store.Close()
+
+	files, _ := SegmentFiles(filepath.Join(dir, "events.log"))
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil || bytes.Contains(data, []byte("wallet-123")) {
+			t.Fatalf("%s holds cleartext payload: %v", filepath.Base(path), err)
+		}
+	}
+	keys, err := readDataKeys(filepath.Join(dir, dataKeysName))
+	if err != nil || len(keys) != 3 {
+		t.Fatalf("want a data key per segment, got %d: %v", len(keys), err)
+	}
+
+	// Verification needs no key.
+	if report := Verify(filepath.Join(dir, "events.log"), filepath.Join(dir, "roots.log"), 2); !report.OK || report.Total != 10 {
+		t.Fatalf("verify encrypted log: %+v", report)
+	}
+
+	store, err = OpenStore(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	records, err := store.Records(1, 10)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	for _, rec := range records {
+		if rec.Event.Payload["user"] != "wallet-123" || rec.Event.Payload["amount"] != json.Number(strconv.FormatInt(rec.Index-1, 10)) {
+			t.Fatalf("record %d not decrypted: %+v", rec.Index, rec.Event.Payload)
+		}
+		payload, _ := CanonicalEvent(rec.HashScheme, rec.StoredEvent())
+		if recordHash(rec.HashAlgorithm, rec.PrevHash, rec.Index, payload) != rec.Hash {
+			t.Fatalf("record %d hash does not cover the stored envelope", rec.Index)
+		}
+	}
+	proof, err := store.InclusionProof(3)
+	if err != nil || VerifyInclusion(proof) != nil || proof.Record.Sealed != nil {
+		t.Fatalf("proof over sealed record: %+v, %v", proof.Record, err)
+	}
+	store.Close()
+
+	// Without the right master key the payloads stay sealed.
+	other := bytes.Repeat([]byte{7}, dataKeySize)
+	for _, key := range [][]byte{nil, other} {
+		store, err = OpenStore(dir, Options{BatchSize: 2, SegmentMaxBatches: 2, MasterKey: key})
+		if err != nil {
+			t.Fatalf("open without key: %v", err)
+		}
+		rec, err := store.Record(4)
+		if err != nil || sealedEnvelope(rec.Event.Payload) == nil || rec.Sealed != nil {
+			t.Fatalf("record readable without master key: %+v, %v", rec, err)
+		}
+		store.Close()
+	}
+
+	// Swapping envelopes between records breaks the chain.
+	mem := NewMemoryBackend()
+	store, err = OpenStore("", Options{BatchSize: 2, Backend: mem, MasterKey: master})
+	if err != nil {
+		t.Fatalf("memory store: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		store.AppendEvent(Event{ID: "evt", Type: "trade", Payload: map[string]interface{}{"n": float64(i)}})
+	}
+	raw := mem.(*memoryBackend).records
+	raw[0].Event.Payload, raw[1].Event.Payload = raw[1].Event.Payload, raw[0].Event.Payload
+	if report := store.Verify(VerifyOptions{BatchSize: 2}); report.OK {
+		t.Fatalf("swapped ciphertexts passed verification")
+	}
+}
+
+func TestCryptoShredding(t *testing.T) {
+	dir := t.TempDir()
+	master := bytes.Repeat([]byte{1}, dataKeySize)
+	opts := Options{BatchSize: 2, MasterKey: master, SubjectField: "user"}
+	if _, err := OpenStore(t.TempDir(), Options{SubjectField: "user"}); err == nil {
+		t.Fatalf("subject keys without a master key accepted")
+	}
+	store, err := OpenStore(dir, opts)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for _, user := range []string{"u1", "u2", "u1", "", "u1", "u2"} {
+		payload := map[string]interface{}{"mint": "M"}
+		if user != "" {
+			payload["user"] = user
+		}
+		if _, _, err := store.AppendEvent(Event{ID: "evt", Type: "trade", Payload: payload}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	keysPath := filepath.Join(dir, dataKeysName)
+	if data, _ := os.ReadFile(keysPath); bytes.Contains(data, []byte(`"u1"`)) {
+		t.Fatalf("keys.json names a subject")
+	}
+
+	result, err := store.Shred("u1", "erasure request")
+	if err != nil || len(result.Keys) != 1 || result.Records != 3 || result.EventIndex != 7 {
+		t.Fatalf("shred: %+v, %v", result, err)
+	}
+	if data, _ := os.ReadFile(keysPath); bytes.Contains(data, []byte(result.Keys[0])) {
+		t.Fatalf("shredded key still in keys.json")
+	}
+	if _, err := store.Shred("u1", ""); !errors.Is(err, ErrSubjectNotFound) {
+		t.Fatalf("second shred: %v", err)
+	}
+	store.Close()
+
+	store, err = OpenStore(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	records, err := store.Records(1, 7)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	for _, i := range []int{0, 2, 4} {
+		if records[i].Sealed != nil || sealedEnvelope(records[i].Event.Payload) == nil {
+			t.Fatalf("shredded record %d still readable: %+v", i+1, records[i].Event.Payload)
+		}
+	}
+	for _, i := range []int{1, 3, 5} {
+		if records[i].Event.Payload["mint"] != "M" {
+			t.Fatalf("record %d lost with another subject: %+v", i+1, records[i].Event.Payload)
+		}
+	}
+	shred := records[6]
+	if shred.Event.Type != EventShred || shred.Event.Payload["subject_id"] != result.SubjectID || shred.Event.Payload["records"] != json.Number("3") {
+		t.Fatalf("shred event: %+v", shred.Event)
+	}
+	if report := Verify(filepath.Join(dir, "events.log"), filepath.Join(dir, "roots.log"), 2); !report.OK || report.Total != 7 {
+		t.Fatalf("verify after shred: %+v", report)
+	}
+}
+
+func TestDerivedKeys(t *testing.T) {
+	dir := t.TempDir()
+	master := bytes.Repeat([]byte{4}, dataKeySize)
+	opts := Options{BatchSize: 2, MasterKey: master, SubjectField: "user"}
+	store, err := OpenStore(dir, opts)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for _, user := range []string{"u1", "u2"} {
+		if _, _, err := store.AppendEvent(Event{ID: "evt", Type: "trade", Payload: map[string]interface{}{"user": user}}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	store.Close()
+
+	// New keys are wrapped and filed with subkeys, never the master key.
+	keysPath := filepath.Join(dir, dataKeysName)
+	keys, err := readDataKeys(keysPath)
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("keys: %+v, %v", keys, err)
+	}
+	masterAEAD, _ := newGCM(master)
+	wrap, _ := newGCM(deriveKey(master, wrapKeyLabel))
+	for i, k := range keys {
+		wrapped, _ := base64.StdEncoding.DecodeString(k.Wrapped)
+		if _, err := openSealed(masterAEAD, wrapped, []byte(k.ID)); err == nil || k.KDF != keyKDF {
+			t.Fatalf("key %s is wrapped by the master key", k.ID)
+		}
+		if k.Subject == pseudonym(master, "u1") || k.Subject == pseudonym(master, "u2") {
+			t.Fatalf("key %s is filed under a pseudonym keyed by the master key", k.ID)
+		}
+		// Turn the keys into ones made before derivation.
+		raw, err := openSealed(wrap, wrapped, []byte(k.ID))
+		if err != nil {
+			t.Fatalf("unwrap %s: %v", k.ID, err)
+		}
+		legacy, _ := seal(masterAEAD, raw, []byte(k.ID))
+		keys[i].KDF, keys[i].Wrapped = "", base64.StdEncoding.EncodeToString(legacy)
+		keys[i].Subject = pseudonym(master, []string{"u1", "u2"}[i])
+	}
+	if err := writeDataKeys(keysPath, keys); err != nil {
+		t.Fatalf("write keys: %v", err)
+	}
+
+	// Keys made before derivation still open their records and are shredded
+	// with the subject, but new payloads go under a derived key.
+	store, err = OpenStore(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if _, _, err := store.AppendEvent(Event{ID: "evt", Type: "trade", Payload: map[string]interface{}{"user": "u1"}}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	records, err := store.Records(1, 3)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	for _, rec := range records {
+		if rec.Event.Payload["user"] == nil {
+			t.Fatalf("record %d not decrypted: %+v", rec.Index, rec.Event.Payload)
+		}
+	}
+	if records[0].Sealed.Key == records[2].Sealed.Key {
+		t.Fatalf("new payload sealed under a key wrapped by the master key")
+	}
+	result, err := store.Shred("u1", "erasure request")
+	if err != nil || len(result.Keys) != 2 || result.Records != 2 {
+		t.Fatalf("shred: %+v, %v", result, err)
+	}
+}
+
+func TestFieldCommitments(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format LogFormat
+		master []byte
+	}{
+		{"json", FormatJSON, nil},
+		{"binary", FormatBinary, nil},
+		{"encrypted", FormatJSON, bytes.Repeat([]byte{3}, dataKeySize)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := Options{BatchSize: 2, LogFormat: tc.format, MasterKey: tc.master, CommitFields: []string{"user", "ip"}}
+			store, err := OpenStore(dir, opts)
+			if err != nil {
+				t.Fatalf("store init: %v", err)
+			}
+			for i := 0; i < 4; i++ {
+				rec, _, err := store.AppendEvent(Event{ID: "evt", Type: "trade", Payload: map[string]interface{}{"user": "wallet-123", "mint": "M"}})
+				if err != nil {
+					t.Fatalf("append: %v", err)
+				}
+				if rec.Event.Payload["user"] != "wallet-123" || len(rec.Disclosures) != 1 || rec.Disclosures["user"].Salt == "" {
+					t.Fatalf("append returned %+v", rec)
+				}
+			}
+			store.Close()
+
+			files, _ := SegmentFiles(filepath.Join(dir, "events.log"))
+			data, err := os.ReadFile(files[0])
+			if err != nil {
+				t.Fatalf("read log: %v", err)
+			}
+			if tc.master != nil && bytes.Contains(data, []byte("wallet-123")) {
+				t.Fatalf("encrypted log holds a disclosed value")
+			}
+			if report := Verify(filepath.Join(dir, "events.log"), filepath.Join(dir, "roots.log"), 2); !report.OK || report.Total != 4 {
+				t.Fatalf("verify: %+v", report)
+			}
+
+			store, err = OpenStore(dir, opts)
+			if err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			defer store.Close()
+			rec, err := store.Record(2)
+			if err != nil || rec.Event.Payload["user"] != "wallet-123" {
+				t.Fatalf("record not disclosed: %+v, %v", rec, err)
+			}
+			redacted := rec.Redact()
+			if _, _, ok := commitmentOf(redacted.Event.Payload, "user"); !ok || redacted.Disclosures != nil || redacted.Event.Payload["mint"] != "M" {
+				t.Fatalf("redacted record: %+v", redacted)
+			}
+			for _, r := range []Record{rec, redacted} {
+				payload, _ := CanonicalEvent(r.HashScheme, r.StoredEvent())
+				if recordHash(r.HashAlgorithm, r.PrevHash, r.Index, payload) != r.Hash {
+					t.Fatalf("record %d hash does not cover the commitment", r.Index)
+				}
+			}
+			if err := VerifyDisclosure(redacted, "user", rec.Disclosures["user"]); err != nil {
+				t.Fatalf("disclosure rejected: %v", err)
+			}
+			forged := Disclosure{Value: "wallet-999", Salt: rec.Disclosures["user"].Salt}
+			if err := VerifyDisclosure(redacted, "user", forged); !errors.Is(err, ErrDisclosureMismatch) {
+				t.Fatalf("forged disclosure accepted: %v", err)
+			}
+			c, scheme, _ := commitmentOf(redacted.Event.Payload, "user")
+			d := rec.Disclosures["user"]
+			if want, _ := FieldCommitment(DefaultHashScheme, "user", d.Salt, "wallet-123"); scheme != DefaultHashScheme || d.Scheme != scheme || c != want {
+				t.Fatalf("commitment made under scheme %d, disclosure says %d", scheme, d.Scheme)
+			}
+			proof, err := store.InclusionProof(2)
+			if err != nil || VerifyInclusion(proof) != nil || proof.Record.Disclosures != nil {
+				t.Fatalf("proof: %+v, %v", proof.Record, err)
+			}
+		})
+	}
+
+	// Commitments without a recorded scheme serialize the value with
+	// StableJSON, whatever the record's scheme; a nested value tells them
+	// apart from JCS.
+	value := map[string]interface{}{"b": 1, "a": []interface{}{"x"}}
+	legacy, _ := FieldCommitment(0, "ctx", "00", value)
+	jcs, _ := FieldCommitment(HashSchemeJCSExact, "ctx", "00", value)
+	if legacy == jcs {
+		t.Fatalf("commitment does not depend on the scheme")
+	}
+	for _, tc := range []struct {
+		marker map[string]interface{}
+		scheme int
+	}{
+		{map[string]interface{}{commitField: legacy}, 0},
+		{map[string]interface{}{commitField: jcs, commitScheme: json.Number("3")}, HashSchemeJCSExact},
+	} {
+		rec := Record{HashScheme: HashSchemeJCSExact, Event: Event{Payload: map[string]interface{}{"ctx": tc.marker}}}
+		if err := VerifyDisclosure(rec, "ctx", Disclosure{Value: value, Salt: "00", Scheme: tc.scheme}); err != nil {
+			t.Fatalf("scheme %d commitment: %v", tc.scheme, err)
+		}
+	}
+	bad := Record{Event: Event{Payload: map[string]interface{}{"ctx": map[string]interface{}{commitField: jcs, commitScheme: 9}}}}
+	if err := VerifyDisclosure(bad, "ctx", Disclosure{Value: value, Salt: "00"}); err == nil {
+		t.Fatalf("commitment under an unknown scheme accepted")
+	}
+
+	// A disclosure altered on disk does not break the chain but is reported.
+	mem := NewMemoryBackend()
+	store, err := OpenStore("", Options{BatchSize: 2, Backend: mem, CommitFields: []string{"user"}})
+	if err != nil {
+		t.Fatalf("memory store: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		store.AppendEvent(Event{ID: "evt", Type: "trade", Payload: map[string]interface{}{"user": "wallet-123"}})
+	}
+	raw := mem.(*memoryBackend).records
+	d := raw[1].Disclosures["user"]
+	d.Value = "wallet-999"
+	raw[1].Disclosures = map[string]Disclosure{"user": d}
+	report := store.Verify(VerifyOptions{BatchSize: 2})
+	if report.OK || len(report.Findings) != 1 || report.Findings[0].Code != FindingDisclosureMismatch || report.Findings[0].Index != 2 {
+		t.Fatalf("altered disclosure: %+v", report.Findings)
+	}
+	if _, err := store.Record(2); !errors.Is(err, ErrDisclosureMismatch) {
+		t.Fatalf("altered disclosure served: %v", err)
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "jcs_vectors.json"))
+	if err != nil {
+		t.Fatalf("read vectors: %v", err)
+	}
+	var vectors struct {
+		Objects []struct {
+			Name   string `json:"name"`
+			Input  string `json:"input"`
+			Output string `json:"output"`
+		} `json:"objects"`
+		Numbers []struct {
+			Bits   string `json:"bits"`
+			Output string `json:"output"`
+		} `json:"numbers"`
+		Records []struct {
+			Name      string `json:"name"`
+			Record    Record `json:"record"`
+			Canonical string `json:"canonical"`
+		} `json:"records"`
+	}
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatalf("decode vectors: %v", err)
+	}
+	for _, v := range vectors.Objects {
+		var input interface{}
+		if err := json.Unmarshal([]byte(v.Input), &input); err != nil {
+			t.Fatalf("%s: %v", v.Name, err)
+		}
+		if got, err := CanonicalJSON(input); err != nil || string(got) != v.Output {
+			t.Errorf("%s:\n got %s (%v)\nwant %s", v.Name, got, err, v.Output)
+		}
+	}
+	for _, v := range vectors.Numbers {
+		bits, _ := strconv.ParseUint(v.Bits, 16, 64)
+		if got, err := CanonicalJSON(math.Float64frombits(bits)); err != nil || string(got) != v.Output {
+			t.Errorf("%s: got %s (%v), want %s", v.Bits, got, err, v.Output)
+		}
+	}
+	for _, v := range vectors.Records {
+		got, err := CanonicalEvent(v.Record.HashScheme, v.Record.Event)
+		if err != nil || string(got) != v.Canonical {
+			t.Fatalf("%s:\n got %s (%v)\nwant %s", v.Name, got, err, v.Canonical)
+		}
+		if recordHash(v.Record.HashAlgorithm, v.Record.PrevHash, v.Record.Index, got) != v.Record.Hash {
+			t.Fatalf("%s: hash does not match", v.Name)
+		}
+	}
+	if _, err := CanonicalJSON(math.NaN()); err == nil {
+		t.Fatalf("NaN canonicalized")
+	}
+
+	// New records carry their scheme; legacy ones still verify next to them.
+	dir := t.TempDir()
+	legacy, err := OpenStore(dir, Options{BatchSize: 2, HashScheme: HashSchemeStable})
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		legacy.AppendEvent(Event{ID: "evt", Type: "trade", Payload: map[string]interface{}{"n": float64(i) + 0.5}})
+	}
+	legacy.Close()
+	store, err := OpenStore(dir, Options{BatchSize: 2, LogFormat: FormatBinary, SegmentMaxBatches: 1})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		store.AppendEvent(Event{ID: "evt", Type: "trade", Payload: map[string]interface{}{"n": 1e21}})
+	}
+	records, err := store.Records(1, 8)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	for _, rec := range records {
+		want := DefaultHashScheme
+		if rec.Index <= 3 {
+			want = HashSchemeStable
+		}
+		if normalizeHashScheme(rec.HashScheme) != want {
+			t.Fatalf("record %d has hash scheme %d, want %d", rec.Index, rec.HashScheme, want)
+		}
+	}
+	store.Close()
+	if report := Verify(filepath.Join(dir, "events.log"), filepath.Join(dir, "roots.log"), 2); !report.OK || report.Total != 8 {
+		t.Fatalf("verify mixed schemes: %+v", report)
+	}
+	if _, err := OpenStore(t.TempDir(), Options{HashScheme: 9}); err == nil {
+		t.Fatalf("unknown hash scheme accepted")
+	}
+}
+
+func TestLosslessNumbers(t *testing.T) {
+	// Numbers written by the float64 encoder hash the same once read back as
+	// json.Number, so records from before lossless decoding still verify.
+	for _, f := range []float64{0, math.Copysign(0, -1), 0.1, 1.5, 1e21, 12345678901234567000, 5e-324, math.MaxFloat64, -3.25e-7} {
+		before := map[string]interface{}{"n": f}
+		data, _ := json.Marshal(before)
+		var after map[string]interface{}
+		if err := DecodeJSON(data, &after); err != nil {
+			t.Fatalf("decode %s: %v", data, err)
+		}
+		for scheme := HashSchemeStable; scheme <= HashSchemeJCSExact; scheme++ {
+			a, _ := CanonicalEvent(scheme, Event{Payload: before})
+			b, _ := CanonicalEvent(scheme, Event{Payload: after})
+			if !bytes.Equal(a, b) {
+				t.Fatalf("scheme %d: %v hashes as %s, read back as %s", scheme, f, a, b)
+			}
+		}
+	}
+
+	big := json.Number("18446744073709551615")
+	for _, scheme := range []int{HashSchemeStable, HashSchemeJCSExact} {
+		a, _ := CanonicalEvent(scheme, Event{Payload: map[string]interface{}{"n": json.Number("9007199254740993")}})
+		b, _ := CanonicalEvent(scheme, Event{Payload: map[string]interface{}{"n": json.Number("9007199254740992")}})
+		if bytes.Equal(a, b) || !bytes.Contains(a, []byte("9007199254740993")) {
+			t.Fatalf("scheme %d loses integer precision: %s", scheme, a)
+		}
+	}
+	// Plain JCS stays what every RFC 8785 implementation writes, so records
+	// hashed under it before exact integers still verify.
+	if got, _ := CanonicalJSON(map[string]interface{}{"n": json.Number("9007199254740993")}); string(got) != `{"n":9007199254740992}` {
+		t.Fatalf("JCS wrote a large integer as %s", got)
+	}
+	if got, _ := CanonicalJSON(map[string]interface{}{"n": big}); string(got) != `{"n":18446744073709552000}` {
+		t.Fatalf("JCS wrote a large integer as %s", got)
+	}
+	// Under exact integers the literal's form counts only beyond 2^53.
+	for _, tc := range []struct {
+		a, b json.Number
+		same bool
+	}{{"10", "1e1", true}, {"9007199254740992", "9.007199254740992e15", true}, {"100000000000000000000000", "1e23", false}} {
+		a, _ := canonicalJSONExact(tc.a)
+		b, _ := canonicalJSONExact(tc.b)
+		if bytes.Equal(a, b) != tc.same {
+			t.Fatalf("%s and %s canonicalize as %s and %s", tc.a, tc.b, a, b)
+		}
+	}
+	if err := CheckNumbers(map[string]interface{}{"n": []interface{}{big, json.Number("1e400")}}); err == nil {
+		t.Fatalf("1e400 passed the number check")
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{"json", Options{BatchSize: 2}},
+		{"binary", Options{BatchSize: 2, LogFormat: FormatBinary}},
+		{"kv", Options{BatchSize: 2, Storage: StorageKV}},
+		{"legacy", Options{BatchSize: 2, HashScheme: HashSchemeStable}},
+		{"jcs", Options{BatchSize: 2, HashScheme: HashSchemeJCS}},
+		{"encrypted", Options{BatchSize: 2, MasterKey: bytes.Repeat([]byte{5}, dataKeySize), CommitFields: []string{"id"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := OpenStore(dir, tc.opts)
+			if err != nil {
+				t.Fatalf("store init: %v", err)
+			}
+			var event Event
+			body := `{"type":"transfer","payload":{"lamports":18446744073709551615,"id":9007199254740993,"fee":0.5}}`
+			if err := DecodeJSON([]byte(body), &event); err != nil {
+				t.Fatalf("decode event: %v", err)
+			}
+			for i := 0; i < 2; i++ {
+				if _, _, err := store.AppendEvent(event); err != nil {
+					t.Fatalf("append: %v", err)
+				}
+			}
+			store.Close()
+
+			store, err = OpenStore(dir, tc.opts)
+			if err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			defer store.Close()
+			rec, err := store.Record(2)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if rec.Event.Payload["lamports"] != big || rec.Event.Payload["id"] != json.Number("9007199254740993") {
+				t.Fatalf("numbers drifted: %+v", rec.Event.Payload)
+			}
+			if report := store.Verify(VerifyOptions{BatchSize: 2}); !report.OK {
+				t.Fatalf("verify: %+v", report.Findings)
+			}
+		})
+	}
+}
+
+func TestHashEpochs(t *testing.T) {
+	for _, v := range []struct {
+		alg   HashAlgorithm
+		input string
+		want  string
+	}{
+		{HashBLAKE2b256, "", "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+		{HashBLAKE2b256, "abc", "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+		{HashBLAKE2b256, string(bytes.Repeat([]byte("a"), 128)), "ae2aa48507885c4c950fb809b2076f959cde9f8ea6da260d9a3587df33dac450"},
+		{HashBLAKE2b256, string(bytes.Repeat([]byte("a"), 129)), "2f64744a6de0d2c0b56e64cf6e29a5aaa255010d415d51c75ccc82f73dccd865"},
+		{HashSHA512_256, "abc", "53048e2681941ef99b2e29b76b4c7dabe4c2d0c634fc6d46e0e2f13107e7af23"},
+	} {
+		if got := hashBytes(v.alg, []byte(v.input)); got != v.want {
+			t.Fatalf("%s(%d bytes) = %s, want %s", v.alg, len(v.input), got, v.want)
+		}
+	}
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("keygen: %v", err)
+	}
+	dir := t.TempDir()
+	opts := Options{BatchSize: 4, SegmentMaxBatches: 2, SigningKey: priv, LogFormat: FormatBinary}
+	store, err := OpenStore(dir, opts)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	appendN := func(n int) {
+		for i := 0; i < n; i++ {
+			if _, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}}); err != nil {
+				t.Fatalf("append: %v", err)
+			}
+		}
+	}
+	appendN(6)
+	if _, err := store.StartEpoch(HashSHA256); err == nil {
+		t.Fatalf("started an epoch with the current algorithm")
+	}
+	link, err := store.StartEpoch(HashBLAKE2b256)
+	if err != nil {
+		t.Fatalf("start epoch: %v", err)
+	}
+	if link.Index != 7 || link.HashAlgorithm != HashBLAKE2b256 || link.Event.Payload["previous_hash"] != link.PrevHash {
+		t.Fatalf("link record: %+v", link)
+	}
+	roots, _ := store.Roots()
+	if last := roots[len(roots)-1]; last.FromIndex != 5 || last.ToIndex != 6 || last.HashAlgorithm != "" {
+		t.Fatalf("open batch not sealed before the link: %+v", last)
+	}
+	appendN(9)
+
+	vopts := VerifyOptions{BatchSize: 4, PublicKey: pub, Workers: 2}
+	report := store.Verify(vopts)
+	if !report.OK || report.Epoch != 1 || report.HashAlgorithm != HashBLAKE2b256 || report.LastIndex != 16 {
+		t.Fatalf("verify: %+v", report)
+	}
+	if cp := store.LatestCheckpoint(); cp == nil || cp.HashAlgorithm != HashBLAKE2b256 || cp.EpochStart != 6 || cp.TreeSize != 14 {
+		t.Fatalf("checkpoint: %+v", cp)
+	}
+
+	proof, err := store.InclusionProof(9)
+	if err != nil || proof.HashAlgorithm != HashBLAKE2b256 {
+		t.Fatalf("inclusion proof: %+v, %v", proof, err)
+	}
+	if err := VerifyInclusion(proof); err != nil {
+		t.Fatalf("verify inclusion: %v", err)
+	}
+	proof.HashAlgorithm = HashSHA512_256
+	if err := VerifyInclusion(proof); err == nil {
+		t.Fatalf("proof accepted under another algorithm")
+	}
+	if old, err := store.InclusionProof(2); err != nil || VerifyInclusion(old) != nil {
+		t.Fatalf("proof in the old epoch: %v", err)
+	}
+	cons, err := store.ConsistencyProof(8, 16)
+	if err != nil {
+		t.Fatalf("consistency proof: %v", err)
+	}
+	if err := VerifyConsistency(cons); err != nil {
+		t.Fatalf("verify consistency: %v", err)
+	}
+	if _, err := store.ConsistencyProof(3, 16); !errors.Is(err, ErrEpochBoundary) {
+		t.Fatalf("cross-epoch proof: %v", err)
+	}
+	if cons, err := store.ConsistencyProof(2, 5); err != nil || VerifyConsistency(cons) != nil {
+		t.Fatalf("consistency in the old epoch: %v", err)
+	}
+	size, root := store.TreeHead()
+	store.Close()
+
+	// The log keeps its algorithm whatever a restart asks for, and a later
+	// migration links to the BLAKE2b epoch the same way.
+	opts.HashAlgorithm = HashSHA512_256
+	store, err = OpenStore(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if s, r := store.TreeHead(); s != size || r != root || store.Epoch() != (Epoch{Number: 1, Start: 6, HashAlgorithm: HashBLAKE2b256}) {
+		t.Fatalf("reopened at %d %s in %+v, want %d %s", s, r, store.Epoch(), size, root)
+	}
+	if _, err := store.StartEpoch(HashSHA512_256); err != nil {
+		t.Fatalf("second epoch: %v", err)
+	}
+	appendN(3)
+	if report := store.Verify(vopts); !report.OK || report.Epoch != 2 || report.HashAlgorithm != HashSHA512_256 {
+		t.Fatalf("verify after second epoch: %+v", report)
+	}
+
+	// A record hashed with another algorithm but not linked is caught.
+	mem, err := OpenStore("", Options{BatchSize: 4, Storage: StorageMemory})
+	if err != nil {
+		t.Fatalf("memory store: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := mem.AppendEvent(Event{Type: "trade"}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	mem.tree.epoch.HashAlgorithm = HashSHA512_256
+	if _, _, err := mem.AppendEvent(Event{Type: "trade"}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	report = mem.Verify(VerifyOptions{BatchSize: 4})
+	if report.OK || report.Findings[0].Code != FindingEpochLink {
+		t.Fatalf("unlinked algorithm change: %+v", report.Findings)
+	}
+}
+
+func TestGenesis(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("keygen: %v", err)
+	}
+	dir := t.TempDir()
+	events := filepath.Join(dir, "events.log")
+	store, err := OpenStore(dir, Options{BatchSize: 4, SigningKey: priv})
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	appendN := func(store *Store, n int) {
+		for i := 0; i < n; i++ {
+			if _, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}}); err != nil {
+				t.Fatalf("append: %v", err)
+			}
+		}
+	}
+	appendN(store, 10)
+	first, err := store.Record(1)
+	if err != nil {
+		t.Fatalf("record 1: %v", err)
+	}
+	g := store.Genesis()
+	if hash, err := g.Hash(); err != nil || first.PrevHash != hash {
+		t.Fatalf("record 1 prev_hash %q does not chain to genesis %q: %v", first.PrevHash, hash, err)
+	}
+	if g.BatchSize != 4 || g.KeyID != KeyID(pub) || g.Check(pub) != nil {
+		t.Fatalf("genesis: %+v", g)
+	}
+	store.Close()
+
+	// The batch size comes from the genesis, not the caller.
+	report := VerifyWithOptions(events, filepath.Join(dir, "roots.log"), VerifyOptions{BatchSize: 50})
+	if !report.OK || report.BatchSize != 4 || report.LogID != g.LogID || report.RootsChecked != 2 {
+		t.Fatalf("verify with wrong batch size: %+v", report)
+	}
+	store, err = OpenStore(dir, Options{BatchSize: 50, SigningKey: priv})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if store.BatchSize() != 4 {
+		t.Fatalf("reopened batch size %d", store.BatchSize())
+	}
+	appendN(store, 2)
+	if last, _ := store.LastRoot(); last == nil || last.ToIndex != 12 {
+		t.Fatalf("batch not sealed at genesis size: %+v", last)
+	}
+	store.Close()
+	_, other, _ := ed25519.GenerateKey(nil)
+	if _, err := OpenStore(dir, Options{SigningKey: other}); err == nil {
+		t.Fatalf("opened log under another signing key")
+	}
+
+	// Rewriting the header breaks its signature and the chain.
+	path := GenesisPath(events)
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read genesis: %v", err)
+	}
+	tampered := *g
+	tampered.BatchSize = 6
+	if err := writeJSONFile(path, tampered, false); err != nil {
+		t.Fatalf("write genesis: %v", err)
+	}
+	report = VerifyWithOptions(events, filepath.Join(dir, "roots.log"), VerifyOptions{PublicKey: pub, CheckpointsPath: filepath.Join(dir, "checkpoints.log")})
+	if report.OK || report.Findings[0].Code != FindingGenesis || report.Findings[1].Code != FindingGenesis || report.Findings[1].Index != 1 {
+		t.Fatalf("tampered genesis: %+v", report.Findings)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("remove genesis: %v", err)
+	}
+	report = Verify(events, filepath.Join(dir, "roots.log"), 4)
+	if report.OK || report.Findings[0].Code != FindingGenesis || report.LogID != "" {
+		t.Fatalf("missing genesis: %+v", report.Findings)
+	}
+	if err := os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatalf("restore genesis: %v", err)
+	}
+
+	// The kv engine keeps the header in its own file.
+	kvDir := t.TempDir()
+	kv, err := OpenStore(kvDir, Options{BatchSize: 3, Storage: StorageKV})
+	if err != nil {
+		t.Fatalf("kv store: %v", err)
+	}
+	appendN(kv, 4)
+	id := kv.Genesis().LogID
+	kv.Close()
+	if kv, err = OpenStore(kvDir, Options{BatchSize: 5, Storage: StorageKV}); err != nil {
+		t.Fatalf("reopen kv: %v", err)
+	}
+	defer kv.Close()
+	if report := kv.Verify(VerifyOptions{}); !report.OK || report.LogID != id || report.BatchSize != 3 || report.RootsChecked != 1 {
+		t.Fatalf("kv verify: %+v", report)
+	}
+}
+
+func TestBatchMaxAge(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("keygen: %v", err)
+	}
+	dir := t.TempDir()
+	opts := Options{BatchSize: 4, MaxBatchAge: 30 * time.Millisecond, SigningKey: priv}
+	store, err := OpenStore(dir, opts)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	appendN := func(store *Store, n int) {
+		for i := 0; i < n; i++ {
+			if _, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}}); err != nil {
+				t.Fatalf("append: %v", err)
+			}
+		}
+	}
+	waitRoot := func(store *Store, to int64) RootRecord {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if last, err := store.LastRoot(); err == nil && last != nil && last.ToIndex == to {
+				return *last
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("no root ending at %d", to)
+		return RootRecord{}
+	}
+
+	// A quiet log seals what it has; a busy one still seals full batches.
+	appendN(store, 3)
+	if root := waitRoot(store, 3); root.FromIndex != 1 || root.SealReason != SealMaxAge {
+		t.Fatalf("aged root: %+v", root)
+	}
+	if cp := store.LatestCheckpoint(); cp == nil || cp.TreeSize != 3 {
+		t.Fatalf("no checkpoint for aged batch: %+v", cp)
+	}
+	appendN(store, 4)
+	if root := waitRoot(store, 7); root.FromIndex != 4 || root.SealReason != "" {
+		t.Fatalf("full root: %+v", root)
+	}
+	appendN(store, 1)
+	waitRoot(store, 8)
+	store.Close()
+
+	// A batch left open by a restart keeps its age.
+	opts.MaxBatchAge = 0
+	if store, err = OpenStore(dir, opts); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	appendN(store, 2)
+	store.Close()
+	opts.MaxBatchAge = 30 * time.Millisecond
+	if store, err = OpenStore(dir, opts); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if root := waitRoot(store, 10); root.FromIndex != 9 || root.SealReason != SealMaxAge {
+		t.Fatalf("root after restart: %+v", root)
+	}
+
+	vopts := VerifyOptions{PublicKey: pub, Workers: 2}
+	if report := store.Verify(vopts); !report.OK || report.RootsChecked != 4 || report.CheckpointsChecked != 4 {
+		t.Fatalf("verify: %+v", report)
+	}
+
+	// A short root that does not say why it is short is still a mismatch.
+	rootsPath := filepath.Join(dir, "roots.log")
+	data, err := os.ReadFile(rootsPath)
+	if err != nil {
+		t.Fatalf("read roots: %v", err)
+	}
+	stripped := bytes.Replace(data, []byte(`"seal_reason":"max_age",`), nil, 1)
+	if err := os.WriteFile(rootsPath, stripped, 0o644); err != nil {
+		t.Fatalf("write roots: %v", err)
+	}
+	report := VerifyWithOptions(filepath.Join(dir, "events.log"), rootsPath, VerifyOptions{})
+	if report.OK || report.Findings[0].Code != FindingRootMismatch {
+		t.Fatalf("short root without a reason: %+v", report.Findings)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("keygen: %v", err)
+	}
+	dir := t.TempDir()
+	opts := Options{BatchSize: 4, SigningKey: priv, Durability: DurabilityGroup}
+	store, err := OpenStore(dir, opts)
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	appendN := func(store *Store, n int) {
+		for i := 0; i < n; i++ {
+			if _, _, err := store.AppendEvent(Event{Type: "trade", Source: "test", Payload: map[string]interface{}{"seq": i}}); err != nil {
+				t.Fatalf("append: %v", err)
+			}
+		}
+	}
+	appendN(store, 6)
+	marker, err := store.Shutdown("signal: terminated")
+	if err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if marker.Index != 7 || marker.Event.Type != EventShutdown || marker.Event.Payload["reason"] != "signal: terminated" {
+		t.Fatalf("marker: %+v", marker)
+	}
+	if last, _ := store.LastRoot(); last == nil || last.FromIndex != 5 || last.ToIndex != 7 || last.SealReason != SealShutdown {
+		t.Fatalf("pending batch not sealed: %+v", last)
+	}
+	if cp := store.LatestCheckpoint(); cp == nil || cp.TreeSize != 7 || VerifyCheckpoint(*cp, pub) != nil {
+		t.Fatalf("final checkpoint: %+v", cp)
+	}
+	if _, _, err := store.AppendEvent(Event{Type: "trade"}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("append after shutdown: %v", err)
+	}
+	if _, err := store.Shutdown("again"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("second shutdown: %v", err)
+	}
+
+	// The next run starts on a batch boundary; a marker that fills its
+	// batch seals it as a full one.
+	if store, err = OpenStore(dir, opts); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if root := store.CurrentBatchRoot(); root != "" {
+		t.Fatalf("open batch after clean shutdown: %s", root)
+	}
+	appendN(store, 3)
+	if marker, err = store.Shutdown("deploy"); err != nil || marker.Index != 11 {
+		t.Fatalf("shutdown on full batch: %+v, %v", marker, err)
+	}
+	if last, _ := store.LastRoot(); last == nil || last.FromIndex != 8 || last.ToIndex != 11 || last.SealReason != "" {
+		t.Fatalf("full batch: %+v", last)
+	}
+	report := VerifyWithOptions(filepath.Join(dir, "events.log"), filepath.Join(dir, "roots.log"),
+		VerifyOptions{PublicKey: pub, CheckpointsPath: filepath.Join(dir, "checkpoints.log")})
+	if !report.OK || report.RootsChecked != 3 || report.CheckpointsChecked != 3 {
+		t.Fatalf("verify: %+v", report)
+	}
+}
@@ -0,0 +1,136 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Backend stores one log's records, batch roots, checkpoints and high-water
+// mark. The Store owns all chain logic (hashing, batching, trees, signing,
+// durability policy) and only hands finished values to a Backend, so a new
+// storage engine cannot change what a valid log is.
+//
+// The Store serializes appends, but reads and Sync may arrive concurrently
+// with them, so implementations must be safe for concurrent use.
+type Backend interface {
+	// Base is the chain head the backend can vouch for without replaying
+	// records: the last sealed segment for the file backend, the empty log
+	// for backends that replay everything. Replay then visits every record
+	// after Base in order.
+	Base() (LogHead, error)
+	Replay(visit func(Record) error) error
+	// Head returns the persisted high-water mark, or nil if there is none.
+	Head() (*TrustedState, error)
+
+	AppendRecord(rec Record) error
+	// AppendRoot stores a batch root; head is the log state after the
+	// batch's last record.
+	AppendRoot(root RootRecord, head LogHead) error
+	AppendCheckpoint(c Checkpoint) error
+	SaveHead(state TrustedState) error
+
+	// ReadRange returns records from..to inclusive; the Store has already
+	// checked that they exist.
+	ReadRange(from, to int64) ([]Record, error)
+	// ReadTail returns up to limit of the most recent records, oldest first.
+	ReadTail(limit int) ([]Record, error)
+	// Scan visits every readable record in order.
+	Scan(visit func(Record) error) error
+	Roots() ([]RootRecord, error)
+	LastRoot() (*RootRecord, error)
+	Checkpoints() ([]Checkpoint, error)
+
+	// DataKeys returns the wrapped payload encryption keys. SaveDataKeys
+	// replaces them and must be durable when it returns: records sealed
+	// under a lost key can no longer be decrypted.
+	DataKeys() ([]DataKey, error)
+	SaveDataKeys(keys []DataKey) error
+
+	// Genesis returns the log's genesis header, or nil if it has none.
+	// SaveGenesis writes it once, before the first record, and must be
+	// durable when it returns.
+	Genesis() (*Genesis, error)
+	SaveGenesis(g Genesis) error
+
+	// Flush makes appended records visible to readers; Sync also commits
+	// them to stable storage.
+	Flush() error
+	Sync() error
+	Close() error
+}
+
+// LogHead is the chain and log tree state after record Index. The tree is
+// that of Epoch.
+type LogHead struct {
+	Index     int64    `json:"index"`
+	Hash      string   `json:"hash"`
+	TreeRoot  string   `json:"tree_root"`
+	TreeNodes []string `json:"tree_nodes"`
+	Epoch     Epoch    `json:"epoch"`
+}
+
+// Files that mark a data directory as holding a log of one engine.
+const (
+	eventsName = "events.log"
+	kvName     = "audit.kv"
+)
+
+// Storage engines selectable through Options.Storage.
+const (
+	StorageFile   = "file"
+	StorageKV     = "kv"
+	StorageMemory = "memory"
+)
+
+func openBackend(dataDir string, opts Options, durable bool) (Backend, error) {
+	if err := checkEngine(dataDir, opts.Storage); err != nil {
+		return nil, err
+	}
+	switch opts.Storage {
+	case "", StorageFile:
+		return openFileBackend(dataDir, fileOptions{
+			segmentMaxBytes:   opts.SegmentMaxBytes,
+			segmentMaxBatches: opts.SegmentMaxBatches,
+			durable:           durable,
+			format:            opts.LogFormat,
+			compression:       opts.SegmentCompression,
+		})
+	case StorageKV:
+		return openKVBackend(filepath.Join(dataDir, kvName), durable)
+	case StorageMemory:
+		return newMemoryBackend(), nil
+	}
+	return nil, fmt.Errorf("unknown storage engine %q", opts.Storage)
+}
+
+// tailRange returns the index range ReadTail covers for a log ending at last.
+func tailRange(last int64, limit int) (int64, int64) {
+	from := last - int64(limit) + 1
+	if from < 1 {
+		from = 1
+	}
+	return from, last
+}
+
+// checkEngine refuses to open a data directory with an engine other than
+// the one whose log it holds. The other engine would otherwise start a new,
+// empty log next to the real one, and shred or epoch would act on that log
+// while changing keys shared with the real one.
+func checkEngine(dataDir, storage string) error {
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dataDir, name))
+		return err == nil
+	}
+	switch storage {
+	case "", StorageFile:
+		if exists(kvName) && !exists(eventsName) {
+			return fmt.Errorf("%s holds a kv log (%s); open it with storage kv", dataDir, kvName)
+		}
+	case StorageKV:
+		if exists(eventsName) && !exists(kvName) {
+			return fmt.Errorf("%s holds a file log (%s); open it with storage file", dataDir, eventsName)
+		}
+	}
+	return nil
+}
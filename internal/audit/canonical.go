@@ -3,11 +3,17 @@ package audit
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"sort"
+	"strconv"
+	"strings"
 )
 
-// StableJSON encodes v with deterministic key ordering for tamper-evident hashing.
+// StableJSON encodes v with deterministic key ordering for tamper-evident
+// hashing. A json.Number holding an integer is written exactly as given;
+// any other number is written as the nearest float64.
 func StableJSON(v interface{}) ([]byte, error) {
 	stable, err := normalize(v)
 	if err != nil {
@@ -50,7 +56,10 @@ func normalize(v interface{}) (interface{}, error) {
 		}
 		return out, nil
 	case json.Number:
-		return val.String(), nil
+		if isIntegerLiteral(val) {
+			return val, nil
+		}
+		return val.Float64()
 	case string, float64, bool, nil:
 		return val, nil
 	default:
@@ -59,9 +68,63 @@ func normalize(v interface{}) (interface{}, error) {
 			return nil, fmt.Errorf("normalize: %w", err)
 		}
 		var decoded interface{}
-		if err := json.Unmarshal(b, &decoded); err != nil {
+		if err := DecodeJSON(b, &decoded); err != nil {
 			return nil, fmt.Errorf("normalize: %w", err)
 		}
 		return normalize(decoded)
 	}
 }
+
+// DecodeJSON is json.Unmarshal with numbers decoded as json.Number, so that
+// integers beyond 2^53 keep every digit. Events are ingested and records
+// read back this way; decoding them into float64 would change what is
+// hashed.
+func DecodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after top-level value")
+	}
+	return nil
+}
+
+// CheckNumbers reports a number in v that is not a finite double, such as
+// 1e400. Only an integer literal of that size canonicalizes, and then not
+// under every scheme, so ingest rejects all of them as bad input rather
+// than failing the append.
+func CheckNumbers(v interface{}) error {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for _, item := range val {
+			if err := CheckNumbers(item); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range val {
+			if err := CheckNumbers(item); err != nil {
+				return err
+			}
+		}
+	case json.Number:
+		if _, err := strconv.ParseFloat(string(val), 64); err != nil {
+			return fmt.Errorf("number %s is out of range", val)
+		}
+	}
+	return nil
+}
+
+// isIntegerLiteral reports whether n is written without a fraction or
+// exponent. Under HashSchemeJCSExact such a literal is hashed with all its
+// digits and any other number as the nearest double, so the form of a
+// literal is part of what is committed to: 100000000000000000000000 and
+// 1e23 are the same value but hash differently, because that double is
+// 99999999999999991611392. The two forms agree for every integer up to
+// 2^53. A producer that needs one value to hash one way must always send
+// it in the same form, and amounts are best sent as integers.
+func isIntegerLiteral(n json.Number) bool {
+	return !strings.ContainsAny(string(n), ".eE")
+}
@@ -0,0 +1,186 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Checkpoint is a signed tree head: the service's signed statement that the
+// log held TreeSize records with log tree root RootHash at Timestamp. The
+// tree is that of the epoch starting after EpochStart records and hashed with
+// HashAlgorithm; both are empty for epoch 0 of a SHA-256 log.
+type Checkpoint struct {
+	TreeSize      int64         `json:"tree_size"`
+	RootHash      string        `json:"root_hash"`
+	HashAlgorithm HashAlgorithm `json:"hash_algorithm,omitempty"`
+	EpochStart    int64         `json:"epoch_start,omitempty"`
+	Timestamp     time.Time     `json:"timestamp"`
+	KeyID         string        `json:"key_id"`
+	Signature     string        `json:"signature"`
+}
+
+// TrustedState converts a verified checkpoint into a verification expectation.
+func (c Checkpoint) TrustedState() TrustedState {
+	return TrustedState{Index: c.TreeSize, TreeRoot: c.RootHash, UpdatedAt: c.Timestamp}
+}
+
+const (
+	checkpointHeader = "assurance-service checkpoint v1"
+	// checkpointHeaderV2 adds the hash algorithm and epoch start, so a
+	// signature cannot be moved to the same root under another algorithm.
+	checkpointHeaderV2 = "assurance-service checkpoint v2"
+)
+
+// signedBody is the exact byte string covered by the signature. Checkpoints
+// of epoch 0 of a SHA-256 log keep the v1 body.
+func (c Checkpoint) signedBody() []byte {
+	ts := c.Timestamp.UTC().Format(time.RFC3339Nano)
+	if c.HashAlgorithm == "" && c.EpochStart == 0 {
+		return []byte(fmt.Sprintf("%s\n%d\n%s\n%s\n%s\n",
+			checkpointHeader, c.TreeSize, c.RootHash, ts, c.KeyID))
+	}
+	return []byte(fmt.Sprintf("%s\n%d\n%s\n%s\n%d\n%s\n%s\n",
+		checkpointHeaderV2, c.TreeSize, c.RootHash, c.HashAlgorithm.normalize(), c.EpochStart, ts, c.KeyID))
+}
+
+// SignCheckpoint produces a checkpoint for the given tree head of epoch.
+func SignCheckpoint(key ed25519.PrivateKey, epoch Epoch, size int64, root string, ts time.Time) Checkpoint {
+	c := Checkpoint{
+		TreeSize:      size,
+		RootHash:      root,
+		HashAlgorithm: epoch.HashAlgorithm.recorded(),
+		EpochStart:    epoch.Start,
+		Timestamp:     ts.UTC(),
+		KeyID:         KeyID(key.Public().(ed25519.PublicKey)),
+	}
+	c.Signature = hex.EncodeToString(ed25519.Sign(key, c.signedBody()))
+	return c
+}
+
+// VerifyCheckpoint checks the checkpoint signature against a trusted key.
+func VerifyCheckpoint(c Checkpoint, pub ed25519.PublicKey) error {
+	if c.KeyID != KeyID(pub) {
+		return fmt.Errorf("checkpoint signed by key %s, trusted key is %s", c.KeyID, KeyID(pub))
+	}
+	sig, err := hex.DecodeString(c.Signature)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	if !ed25519.Verify(pub, c.signedBody(), sig) {
+		return fmt.Errorf("invalid signature on checkpoint at size %d", c.TreeSize)
+	}
+	return nil
+}
+
+// KeyID is a short, stable identifier for a public key.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// LoadOrCreateSigningKey reads a PEM (PKCS#8) Ed25519 private key from path,
+// generating one if the file does not exist. The public key is written next
+// to it as path + ".pub" so it can be handed to auditors.
+func LoadOrCreateSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			return nil, err
+		}
+		return key, writePublicKey(path+".pub", key.Public().(ed25519.PublicKey))
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	if _, err := os.Stat(path + ".pub"); errors.Is(err, os.ErrNotExist) {
+		if err := writePublicKey(path+".pub", key.Public().(ed25519.PublicKey)); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// LoadPublicKey reads a PEM (PKIX) Ed25519 public key.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", path)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	pub, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return pub, nil
+}
+
+func writePublicKey(path string, pub ed25519.PublicKey) error {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644)
+}
+
+func readCheckpoints(path string) ([]Checkpoint, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Checkpoint{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	out := []Checkpoint{}
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var c Checkpoint
+		if err := json.Unmarshal(line, &c); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, scanner.Err()
+}
@@ -0,0 +1,287 @@
+package audit
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Configured payload fields are hashed as salted commitments instead of
+// their values. The hashed payload holds, in place of each such field,
+//
+//	{"$commit": hex(sha256("assurance-service commitment v1\n" +
+//	                       field + "\n" + salt + "\n" + canonical(value))),
+//	 "$scheme": scheme}
+//
+// where canonical is the record's hash scheme (see CanonicalEvent), so a
+// verifier serializes the value the same way it serializes the event.
+// Commitments made before the scheme was recorded have no "$scheme" member
+// and serialize the value with StableJSON, as do those of HashSchemeStable
+// records. The value and salt travel next to the event in Record.Disclosures,
+// outside the hash. A record can then be served or exported with any
+// disclosure removed (Redact) and its hash still recomputes; whoever holds a
+// disclosure can check it against the commitment (VerifyDisclosure). When
+// payloads are encrypted at rest, each disclosure is stored encrypted under
+// the record's payload key as well.
+
+const (
+	commitField     = "$commit"
+	commitScheme    = "$scheme"
+	commitLabel     = "assurance-service commitment v1"
+	commitSaltBytes = 16
+)
+
+// Disclosure opens one committed payload field.
+type Disclosure struct {
+	Value interface{} `json:"value,omitempty"`
+	Salt  string      `json:"salt,omitempty"`
+	// Scheme is the hash scheme the commitment serializes Value with, zero
+	// for a commitment without a "$scheme" member.
+	Scheme int `json:"scheme,omitempty"`
+	// Sealed is the value and salt encrypted under the record's payload
+	// key, as "<key id>:<base64>", when payloads are encrypted at rest.
+	Sealed string `json:"sealed,omitempty"`
+}
+
+// ErrDisclosureMismatch is returned when a disclosure does not open the
+// commitment in the hashed payload.
+var ErrDisclosureMismatch = errors.New("disclosure does not match commitment")
+
+// FieldCommitment computes the commitment to value for field under salt,
+// serializing value with hash scheme scheme; zero means StableJSON.
+func FieldCommitment(scheme int, field, salt string, value interface{}) (string, error) {
+	data, err := canonicalize(scheme, value)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(commitLabel + "\n" + field + "\n" + salt + "\n" + string(data)))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// commitMarker is the value a hashed payload holds for a committed field.
+func commitMarker(c string, scheme int) map[string]interface{} {
+	if scheme == 0 {
+		return map[string]interface{}{commitField: c}
+	}
+	return map[string]interface{}{commitField: c, commitScheme: scheme}
+}
+
+// commitmentOf returns the commitment a hashed payload holds for field and
+// the hash scheme it was made with.
+func commitmentOf(payload map[string]interface{}, field string) (string, int, bool) {
+	marker, ok := payload[field].(map[string]interface{})
+	if !ok {
+		return "", 0, false
+	}
+	scheme := 0
+	switch len(marker) {
+	case 1:
+	case 2:
+		// The scheme is an int when the marker was just built and a
+		// json.Number once read back.
+		n, err := strconv.Atoi(fmt.Sprint(marker[commitScheme]))
+		if err != nil || n == 0 || !validHashScheme(n) {
+			return "", 0, false
+		}
+		scheme = n
+	default:
+		return "", 0, false
+	}
+	c, ok := marker[commitField].(string)
+	return c, scheme, ok
+}
+
+// VerifyDisclosure checks that d opens the commitment rec holds for field.
+// rec is a record as stored or redacted, with the commitment in its payload.
+func VerifyDisclosure(rec Record, field string, d Disclosure) error {
+	want, scheme, ok := commitmentOf(rec.Event.Payload, field)
+	if !ok {
+		return fmt.Errorf("record %d has no commitment for %q", rec.Index, field)
+	}
+	got, err := FieldCommitment(scheme, field, d.Salt, d.Value)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("record %d field %q: %w", rec.Index, field, ErrDisclosureMismatch)
+	}
+	return nil
+}
+
+// commitFields returns payload with each of fields that it has replaced by
+// a fresh commitment under hash scheme scheme, and the disclosures that
+// open them.
+func commitFields(payload map[string]interface{}, fields []string, scheme int) (map[string]interface{}, map[string]Disclosure, error) {
+	if normalizeHashScheme(scheme) == HashSchemeStable {
+		scheme = 0
+	}
+	var out map[string]interface{}
+	var disclosures map[string]Disclosure
+	for _, field := range fields {
+		value, ok := payload[field]
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]interface{}, len(payload))
+			for k, v := range payload {
+				out[k] = v
+			}
+			disclosures = make(map[string]Disclosure)
+		}
+		salt := make([]byte, commitSaltBytes)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, nil, err
+		}
+		d := Disclosure{Value: value, Salt: hex.EncodeToString(salt), Scheme: scheme}
+		c, err := FieldCommitment(scheme, field, d.Salt, value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("commit %q: %w", field, err)
+		}
+		out[field] = commitMarker(c, scheme)
+		disclosures[field] = d
+	}
+	if out == nil {
+		return payload, nil, nil
+	}
+	return out, disclosures, nil
+}
+
+// StoredPayload returns the payload as it was committed: with a commitment
+// in place of every field the record discloses. It does not undo
+// encryption; see StoredEvent.
+func (r Record) StoredPayload() map[string]interface{} {
+	if len(r.Disclosures) == 0 {
+		return r.Event.Payload
+	}
+	out := make(map[string]interface{}, len(r.Event.Payload))
+	for k, v := range r.Event.Payload {
+		out[k] = v
+	}
+	for field, d := range r.Disclosures {
+		if d.Salt == "" {
+			continue
+		}
+		if c, err := FieldCommitment(d.Scheme, field, d.Salt, d.Value); err == nil {
+			out[field] = commitMarker(c, d.Scheme)
+		}
+	}
+	return out
+}
+
+// Redact returns the record with every disclosure removed, leaving only the
+// commitments. Its hash still recomputes from StoredEvent.
+func (r Record) Redact() Record {
+	if len(r.Disclosures) == 0 {
+		return r
+	}
+	r.Event.Payload = r.StoredPayload()
+	r.Disclosures = nil
+	return r
+}
+
+// disclose puts the disclosed values of rec back into its payload, which
+// must already be decrypted. Disclosures that are still sealed are left
+// alone, and the commitment stays in the payload.
+func disclose(rec Record) (Record, error) {
+	if len(rec.Disclosures) == 0 || sealedEnvelope(rec.Event.Payload) != nil {
+		return rec, nil
+	}
+	payload := make(map[string]interface{}, len(rec.Event.Payload))
+	for k, v := range rec.Event.Payload {
+		payload[k] = v
+	}
+	for field, d := range rec.Disclosures {
+		if d.Sealed != "" {
+			continue
+		}
+		if err := VerifyDisclosure(Record{Index: rec.Index, Event: Event{Payload: rec.Event.Payload}}, field, d); err != nil {
+			return rec, err
+		}
+		payload[field] = d.Value
+	}
+	rec.Event.Payload = payload
+	return rec, nil
+}
+
+// checkDisclosures verifies the plain disclosures of a stored record
+// against its commitments. Sealed ones need the key and are skipped.
+func checkDisclosures(rec Record) error {
+	if sealedEnvelope(rec.Event.Payload) != nil {
+		return nil
+	}
+	for field, d := range rec.Disclosures {
+		if d.Sealed != "" {
+			continue
+		}
+		if err := VerifyDisclosure(rec, field, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealDisclosures encrypts each disclosure under the payload key.
+func (r *keyRing) sealDisclosures(key DataKey, index int64, eventID string, disclosures map[string]Disclosure) (map[string]Disclosure, error) {
+	out := make(map[string]Disclosure, len(disclosures))
+	for field, d := range disclosures {
+		plain, err := json.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := seal(r.aeads[key.ID], plain, disclosureAAD(index, eventID, field))
+		if err != nil {
+			return nil, err
+		}
+		out[field] = Disclosure{Sealed: key.ID + ":" + base64.StdEncoding.EncodeToString(sealed)}
+	}
+	return out, nil
+}
+
+// openDisclosures decrypts the sealed disclosures of rec whose key is
+// available.
+func (r *keyRing) openDisclosures(rec Record) (Record, error) {
+	if len(rec.Disclosures) == 0 {
+		return rec, nil
+	}
+	out := make(map[string]Disclosure, len(rec.Disclosures))
+	for field, d := range rec.Disclosures {
+		out[field] = d
+		if d.Sealed == "" {
+			continue
+		}
+		id, data, ok := strings.Cut(d.Sealed, ":")
+		if !ok {
+			return rec, fmt.Errorf("record %d disclosure %q: malformed", rec.Index, field)
+		}
+		aead, ok := r.aeads[id]
+		if !ok {
+			continue
+		}
+		sealed, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return rec, fmt.Errorf("record %d disclosure %q: %w", rec.Index, field, err)
+		}
+		plain, err := openSealed(aead, sealed, disclosureAAD(rec.Index, rec.Event.ID, field))
+		if err != nil {
+			return rec, fmt.Errorf("decrypt record %d disclosure %q: %w", rec.Index, field, err)
+		}
+		var opened Disclosure
+		if err := DecodeJSON(plain, &opened); err != nil {
+			return rec, fmt.Errorf("record %d disclosure %q: %w", rec.Index, field, err)
+		}
+		out[field] = opened
+	}
+	rec.Disclosures = out
+	return rec, nil
+}
+
+func disclosureAAD(index int64, eventID, field string) []byte {
+	return []byte(fmt.Sprintf("%s\n%d\n%s\n%s\n", commitLabel, index, eventID, field))
+}
@@ -0,0 +1,331 @@
+package audit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A compressed segment, events-NNNNNN.log.gz, is its plain file cut into
+// 64 KiB blocks, each written as a separate gzip member. Concatenated members
+// are an ordinary gzip stream, so gunzip restores the original bytes. The
+// sidecar events-NNNNNN.gzi lists every block as a pair of 8-byte big-endian
+// offsets: where it starts in the plain file and where its member starts in
+// the compressed one. The segment's .idx keeps plain-file offsets, so a read
+// at any record decompresses from the start of one block instead of the
+// start of the file.
+
+// CompressionGzip is the only segment compression so far.
+const CompressionGzip = "gzip"
+
+const (
+	gzipSuffix        = ".gz"
+	compressBlockSize = 64 * 1024
+	blockEntrySize    = 16
+)
+
+// ParseCompression validates a segment compression name. The empty string
+// leaves sealed segments uncompressed.
+func ParseCompression(s string) (string, error) {
+	switch s {
+	case "", "none":
+		return "", nil
+	case CompressionGzip:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown segment compression %q", s)
+}
+
+func isCompressed(path string) bool {
+	return strings.HasSuffix(path, gzipSuffix)
+}
+
+// blockIndexFile names the block index of a compressed log file.
+func blockIndexFile(path string) string {
+	plain := strings.TrimSuffix(path, gzipSuffix)
+	return plain[:len(plain)-len(filepath.Ext(plain))] + ".gzi"
+}
+
+type blockEntry struct {
+	plain      int64
+	compressed int64
+}
+
+// compressLogFile writes src as a block-compressed dst with its block index
+// and returns the compressed size. Both files are synced and renamed into
+// place only when complete.
+func compressLogFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	blocks, err := os.Create(blockIndexFile(dst) + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(blocks.Name())
+	defer blocks.Close()
+
+	counter := &countingWriter{w: bufio.NewWriterSize(out, writeBufferSize)}
+	index := bufio.NewWriter(blocks)
+	zw, err := gzip.NewWriterLevel(counter, gzip.BestCompression)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, compressBlockSize)
+	for plain := int64(0); ; {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			var entry [blockEntrySize]byte
+			binary.BigEndian.PutUint64(entry[0:8], uint64(plain))
+			binary.BigEndian.PutUint64(entry[8:16], uint64(counter.n))
+			if _, err := index.Write(entry[:]); err != nil {
+				return 0, err
+			}
+			zw.Reset(counter)
+			if _, err := zw.Write(buf[:n]); err != nil {
+				return 0, err
+			}
+			if err := zw.Close(); err != nil {
+				return 0, err
+			}
+			plain += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, step := range []func() error{counter.w.(*bufio.Writer).Flush, out.Sync, index.Flush, blocks.Sync} {
+		if err := step(); err != nil {
+			return 0, err
+		}
+	}
+	if err := os.Rename(blocks.Name(), blockIndexFile(dst)); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(out.Name(), dst); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readBlockIndex loads the block index of a compressed log file.
+func readBlockIndex(path string) ([]blockEntry, error) {
+	data, err := os.ReadFile(blockIndexFile(path))
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%blockEntrySize != 0 {
+		return nil, fmt.Errorf("%s: size %d is not a multiple of %d", filepath.Base(blockIndexFile(path)), len(data), blockEntrySize)
+	}
+	out := make([]blockEntry, len(data)/blockEntrySize)
+	for i := range out {
+		entry := data[i*blockEntrySize:]
+		out[i] = blockEntry{
+			plain:      int64(binary.BigEndian.Uint64(entry[0:8])),
+			compressed: int64(binary.BigEndian.Uint64(entry[8:16])),
+		}
+	}
+	return out, nil
+}
+
+// logReader reads a log file from a plain-file byte offset, decompressing
+// if needed.
+type logReader struct {
+	io.Reader
+	file *os.File
+	zr   *gzip.Reader
+}
+
+func (r *logReader) Close() error {
+	if r.zr != nil {
+		r.zr.Close()
+	}
+	return r.file.Close()
+}
+
+// openLog opens the log file at path for reading records from byte offset
+// of its plain contents and reports its format. A sealed segment compressed
+// since its path was looked up is found under its compressed name.
+func openLog(path string, offset int64) (*logReader, LogFormat, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && !isCompressed(path) {
+		path += gzipSuffix
+		file, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if !isCompressed(path) {
+		format, err := detectFormat(file, FormatJSON)
+		if err == nil {
+			_, err = file.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			file.Close()
+			return nil, "", err
+		}
+		return &logReader{Reader: file, file: file}, format, nil
+	}
+
+	r, format, err := openCompressed(file, path, offset)
+	if err != nil {
+		file.Close()
+		return nil, "", fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return r, format, nil
+}
+
+func openCompressed(file *os.File, path string, offset int64) (*logReader, LogFormat, error) {
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, "", err
+	}
+	head := make([]byte, len(binaryMagic))
+	n, err := io.ReadFull(zr, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, "", err
+	}
+	format := formatOf(head[:n], FormatJSON)
+
+	// Start from the last block at or before offset. Without a block index
+	// the file is decompressed from the start.
+	start := blockEntry{}
+	if blocks, err := readBlockIndex(path); err == nil {
+		i := sort.Search(len(blocks), func(i int) bool { return blocks[i].plain > offset })
+		if i > 0 {
+			start = blocks[i-1]
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, "", err
+	}
+	if _, err := file.Seek(start.compressed, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	if err := zr.Reset(bufio.NewReader(file)); err != nil {
+		return nil, "", err
+	}
+	if _, err := io.CopyN(io.Discard, zr, offset-start.plain); err != nil {
+		return nil, "", err
+	}
+	return &logReader{Reader: zr, file: file, zr: zr}, format, nil
+}
+
+// startCompression compresses sealed segments in the background if
+// compression is enabled.
+func (b *fileBackend) startCompression() {
+	if b.compression == "" {
+		return
+	}
+	b.compressing.Add(1)
+	go func() {
+		defer b.compressing.Done()
+		b.compressSegments()
+	}()
+}
+
+// compressSegments compresses every sealed segment still stored plain.
+// It runs in the background after a rotation and once at startup; a failure
+// leaves the plain segment in place, which is still valid, and is reported
+// by Close.
+func (b *fileBackend) compressSegments() {
+	b.compressMu.Lock()
+	defer b.compressMu.Unlock()
+	b.mu.Lock()
+	segments := append([]Segment(nil), b.manifest.Segments...)
+	b.mu.Unlock()
+	for _, seg := range segments {
+		if seg.Compression != "" {
+			continue
+		}
+		if err := b.compressSegment(seg); err != nil && !errors.Is(err, os.ErrNotExist) {
+			b.mu.Lock()
+			b.compressErr = fmt.Errorf("compress segment %d: %w", seg.Seq, err)
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// compressSegment replaces one plain segment with its compressed form. The
+// manifest switches to the compressed file before the plain one is removed,
+// so readers always find one of them.
+func (b *fileBackend) compressSegment(seg Segment) error {
+	src := filepath.Join(b.dataDir, seg.File)
+	dst := src + gzipSuffix
+	size, err := compressLogFile(src, dst)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	manifest := Manifest{Segments: append([]Segment(nil), b.manifest.Segments...)}
+	for i := range manifest.Segments {
+		if manifest.Segments[i].Seq == seg.Seq {
+			manifest.Segments[i].File = seg.File + gzipSuffix
+			manifest.Segments[i].Compression = b.compression
+			manifest.Segments[i].CompressedSize = size
+		}
+	}
+	err = writeJSONFile(b.manifestPath, manifest, b.durable)
+	if err == nil {
+		b.manifest = manifest
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	if err := os.Remove(src); err != nil {
+		return err
+	}
+	if b.durable {
+		return syncPath(b.dataDir)
+	}
+	return nil
+}
+
+// removeCompressedLeftovers deletes plain segments whose compressed
+// replacement was recorded before the process stopped.
+func (b *fileBackend) removeCompressedLeftovers() error {
+	for _, seg := range b.manifest.Segments {
+		if seg.Compression == "" {
+			continue
+		}
+		path := filepath.Join(b.dataDir, seg.File)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := os.Remove(strings.TrimSuffix(path, gzipSuffix)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package audit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ConvertStats summarizes a ConvertLog run.
+type ConvertStats struct {
+	Files       int   `json:"files"`
+	Records     int64 `json:"records"`
+	BytesBefore int64 `json:"bytes_before"`
+	BytesAfter  int64 `json:"bytes_after"`
+}
+
+// ConvertLog rewrites every file of the log ending in eventsPath into format
+// to, with a fresh offset index for each, and records the new sizes in the
+// segment manifest. Sealed segments that are not on disk are skipped. The
+// store must not be running. Records are re-encoded field for field, so
+// their hashes, and every root, checkpoint and proof over them, are
+// unchanged; a saved incremental verification position is not, and the next
+// run starts over.
+func ConvertLog(eventsPath string, to LogFormat) (ConvertStats, error) {
+	var stats ConvertStats
+	if to != FormatJSON && to != FormatBinary {
+		return stats, fmt.Errorf("unknown log format %q", to)
+	}
+	manifestPath := ManifestPath(eventsPath)
+	manifest, err := ReadManifest(manifestPath)
+	if err != nil {
+		return stats, fmt.Errorf("read manifest: %w", err)
+	}
+	dir := filepath.Dir(eventsPath)
+	for i := range manifest.Segments {
+		seg := &manifest.Segments[i]
+		path := filepath.Join(dir, seg.File)
+		if seg.Compression != "" {
+			err := convertCompressedFile(path, seg, to, &stats)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return stats, fmt.Errorf("%s: %w", seg.File, err)
+			}
+			continue
+		}
+		size, err := convertLogFile(path, to, &stats)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return stats, fmt.Errorf("%s: %w", seg.File, err)
+		}
+		seg.Size = size
+	}
+	if _, err := convertLogFile(eventsPath, to, &stats); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return stats, fmt.Errorf("%s: %w", filepath.Base(eventsPath), err)
+	}
+	if len(manifest.Segments) > 0 {
+		if err := writeJSONFile(manifestPath, manifest, true); err != nil {
+			return stats, fmt.Errorf("write manifest: %w", err)
+		}
+	}
+	return stats, syncPath(dir)
+}
+
+// convertCompressedFile converts a compressed segment by way of a plain
+// copy and compresses the result again. Like convertLogFile it removes the
+// old offset and block indexes before the segment is replaced.
+func convertCompressedFile(path string, seg *Segment, to LogFormat, stats *ConvertStats) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	src, format, err := openLog(path, 0)
+	if err != nil {
+		return err
+	}
+	if format == to || seg.Size == 0 {
+		src.Close()
+		stats.BytesBefore += info.Size()
+		stats.BytesAfter += info.Size()
+		return nil
+	}
+	plain := path + ".convert"
+	tmp, err := os.Create(plain)
+	if err == nil {
+		_, err = io.Copy(tmp, src)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+	}
+	src.Close()
+	defer os.Remove(plain)
+	defer os.Remove(indexFile(plain))
+	if err != nil {
+		return err
+	}
+
+	var plainStats ConvertStats
+	size, err := convertLogFile(plain, to, &plainStats)
+	if err != nil {
+		return err
+	}
+	for _, old := range []string{indexFile(path), blockIndexFile(path)} {
+		if err := os.Remove(old); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	compressed, err := compressLogFile(plain, path)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(indexFile(plain), indexFile(path)); err != nil {
+		return err
+	}
+	seg.Size, seg.CompressedSize = size, compressed
+	stats.Files++
+	stats.Records += plainStats.Records
+	stats.BytesBefore += info.Size()
+	stats.BytesAfter += compressed
+	return nil
+}
+
+// convertLogFile rewrites one log file and its index and returns the new
+// size. The old index is removed before the log is replaced, so a crash in
+// between leaves a file that is read by scanning rather than through stale
+// offsets.
+func convertLogFile(path string, to LogFormat, stats *ConvertStats) (int64, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	from, err := detectFormat(src, to)
+	if err != nil {
+		return 0, err
+	}
+	stats.BytesBefore += info.Size()
+	if from == to || info.Size() == 0 {
+		stats.BytesAfter += info.Size()
+		return info.Size(), nil
+	}
+
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	idx, err := os.Create(indexFile(path) + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(idx.Name())
+	defer idx.Close()
+
+	out := bufio.NewWriterSize(tmp, writeBufferSize)
+	index := bufio.NewWriter(idx)
+	size := to.headerSize()
+	if to == FormatBinary {
+		if _, err := out.WriteString(binaryMagic); err != nil {
+			return 0, err
+		}
+	}
+	var records int64
+	scanner := newFrameScanner(src, from, 0)
+	for scanner.Scan() {
+		rec, err := decodeFrame(from, scanner.Bytes())
+		if err != nil {
+			return 0, fmt.Errorf("record at offset %d: %w", scanner.Offset(), err)
+		}
+		frame, err := encodeFrame(to, rec)
+		if err != nil {
+			return 0, err
+		}
+		if err := writeIndexEntry(index, size); err != nil {
+			return 0, err
+		}
+		if _, err := out.Write(frame); err != nil {
+			return 0, err
+		}
+		size += int64(len(frame))
+		records++
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	for _, step := range []func() error{out.Flush, tmp.Sync, index.Flush, idx.Sync} {
+		if err := step(); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := os.Remove(indexFile(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(idx.Name(), indexFile(path)); err != nil {
+		return 0, err
+	}
+	stats.Files++
+	stats.Records += records
+	stats.BytesAfter += size
+	return size, nil
+}
@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Durability selects when AppendEvent considers a record written.
+type Durability string
+
+const (
+	// DurabilityNone returns once the record is handed to the OS. A crash
+	// of the machine, not just the process, can lose acknowledged records.
+	DurabilityNone Durability = "none"
+	// DurabilityFsync syncs every record before AppendEvent returns.
+	DurabilityFsync Durability = "fsync"
+	// DurabilityGroup also returns only once the record is synced, but
+	// callers that append while a sync is running share the next one.
+	DurabilityGroup Durability = "group"
+)
+
+// ParseDurability validates a durability mode name. The empty string means
+// DurabilityNone.
+func ParseDurability(s string) (Durability, error) {
+	switch d := Durability(s); d {
+	case "":
+		return DurabilityNone, nil
+	case DurabilityNone, DurabilityFsync, DurabilityGroup:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown durability mode %q", s)
+}
+
+// groupCommit hands out fsyncs of the live file. Appends are numbered in
+// write order; a waiter either finds its number already synced, waits for
+// the sync in flight, or runs the next sync itself on behalf of everyone
+// who wrote in the meantime.
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	synced  uint64
+	syncing bool
+}
+
+func newGroupCommit() *groupCommit {
+	g := &groupCommit{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// wait returns once append seq is on disk. sync reports the highest append
+// number its fsync covers.
+func (g *groupCommit) wait(seq uint64, sync func() (uint64, error)) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.synced < seq {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		g.mu.Unlock()
+		covered, err := sync()
+		g.mu.Lock()
+		g.syncing = false
+		if err == nil && covered > g.synced {
+			g.synced = covered
+		}
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// advance records that a sync made outside wait covered appends up to seq.
+func (g *groupCommit) advance(seq uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if seq > g.synced {
+		g.synced = seq
+		g.cond.Broadcast()
+	}
+}
+
+// syncEvents is the group commit sync: one backend sync covering every
+// append made before it read the counter, after which the high-water mark
+// moves up to the last of them.
+func (s *Store) syncEvents() (uint64, error) {
+	s.mu.Lock()
+	covered, head := s.written, s.headLocked()
+	s.mu.Unlock()
+	if err := s.backend.Sync(); err != nil {
+		s.mu.Lock()
+		s.failLocked(err)
+		s.mu.Unlock()
+		return 0, err
+	}
+	if s.syncHead {
+		if err := s.saveHead(head); err != nil {
+			return 0, fmt.Errorf("save high-water mark: %w", err)
+		}
+	}
+	return covered, nil
+}
+
+// syncLiveLocked makes every record written so far at least as durable as
+// the batch root about to describe it. The caller holds s.mu.
+func (s *Store) syncLiveLocked() error {
+	if s.durability != DurabilityGroup {
+		return s.backend.Flush()
+	}
+	if err := s.backend.Sync(); err != nil {
+		return err
+	}
+	s.group.advance(s.written)
+	return nil
+}
+
+func (s *Store) durable() bool {
+	return s.durability == DurabilityFsync || s.durability == DurabilityGroup
+}
+
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
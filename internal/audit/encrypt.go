@@ -0,0 +1,467 @@
+package audit
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// With a master key configured, event payloads are encrypted before they are
+// hashed. The stored payload is replaced by an envelope
+//
+//	{"$sealed": {"key": <data key id>, "nonce": <base64>, "data": <base64>}}
+//
+// holding the AES-256-GCM encryption of the payload's JSON, bound to the
+// record index and event ID. The record hash covers the envelope, so Verify,
+// roots, checkpoints and proofs work without any key. Each log segment gets
+// its own random data key, stored only wrapped (AES-256-GCM) by a key derived
+// from the master key; readers holding the master key see the payload
+// decrypted.
+
+const (
+	sealedField     = "$sealed"
+	dataKeySize     = 32
+	payloadAADLabel = "assurance-service payload v1"
+
+	// The master key is never used directly: HKDF derives one subkey to
+	// wrap data keys and another to key subject pseudonyms.
+	keyKDF          = "hkdf-sha256"
+	wrapKeyLabel    = "assurance-service key wrapping v1"
+	subjectKeyLabel = "assurance-service subject id v1"
+)
+
+var (
+	// ErrReservedPayload rejects events that already carry a sealed
+	// envelope, which only the store may write.
+	ErrReservedPayload = errors.New("payload field " + sealedField + " is reserved")
+	// ErrKeyUnavailable is returned when a record's data key cannot be
+	// unwrapped with the configured master key.
+	ErrKeyUnavailable = errors.New("data key unavailable")
+)
+
+// SealedPayload is an encrypted event payload as it is stored and hashed.
+type SealedPayload struct {
+	Key   string `json:"key"`
+	Nonce string `json:"nonce"`
+	Data  string `json:"data"`
+}
+
+// DataKey is a payload key wrapped by the master key. A segment key has
+// Segment set to the backend's live segment when it was created; engines
+// without segments use a single one. A subject key has Subject set to the
+// subject's SubjectID instead and seals every payload of that subject.
+type DataKey struct {
+	ID          string `json:"id"`
+	Segment     int    `json:"segment,omitempty"`
+	Subject     string `json:"subject,omitempty"`
+	MasterKeyID string `json:"master_key_id"`
+	// KDF names how the wrapping key was derived from the master key. It is
+	// empty for keys made before derivation, which the master key wraps
+	// itself and whose Subject is keyed by the master key too.
+	KDF       string    `json:"kdf,omitempty"`
+	Wrapped   string    `json:"wrapped"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// StoredEvent returns the event exactly as it was hashed: with the sealed
+// envelope in place of a payload that was decrypted on read, and with
+// commitments in place of disclosed fields.
+func (r Record) StoredEvent() Event {
+	event := r.Event
+	if r.Sealed != nil {
+		event.Payload = r.Sealed.payload()
+	} else {
+		event.Payload = r.StoredPayload()
+	}
+	return event
+}
+
+func (p SealedPayload) payload() map[string]interface{} {
+	return map[string]interface{}{sealedField: map[string]interface{}{
+		"key":   p.Key,
+		"nonce": p.Nonce,
+		"data":  p.Data,
+	}}
+}
+
+// sealedEnvelope returns the envelope of a stored payload, or nil if the
+// payload is not sealed.
+func sealedEnvelope(payload map[string]interface{}) *SealedPayload {
+	fields, ok := payload[sealedField].(map[string]interface{})
+	if !ok || len(payload) != 1 {
+		return nil
+	}
+	key, _ := fields["key"].(string)
+	nonce, _ := fields["nonce"].(string)
+	data, _ := fields["data"].(string)
+	return &SealedPayload{Key: key, Nonce: nonce, Data: data}
+}
+
+// keys.json holds the wrapped data keys of the file and kv engines. It is
+// rewritten whole on every change, never appended to, so a key removed by
+// Shred is gone from the data directory rather than superseded.
+const dataKeysName = "keys.json"
+
+func readDataKeys(path string) ([]DataKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []DataKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return keys, nil
+}
+
+func writeDataKeys(path string, keys []DataKey) error {
+	if keys == nil {
+		keys = []DataKey{}
+	}
+	if err := writeJSONFile(path, keys, true); err != nil {
+		return err
+	}
+	return syncPath(filepath.Dir(path))
+}
+
+// LoadOrCreateMasterKey reads a hex-encoded 32-byte master key from path,
+// generating one if the file does not exist.
+func LoadOrCreateMasterKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, dataKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0o600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != dataKeySize {
+		return nil, fmt.Errorf("%s: want %d hex-encoded bytes", path, dataKeySize)
+	}
+	return key, nil
+}
+
+// MasterKeyID is a short, stable identifier for a master key.
+func MasterKeyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("master key\n"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// deriveKey expands master into the subkey for label with HKDF-SHA256
+// (RFC 5869) and no salt.
+func deriveKey(master []byte, label string) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(master)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(label))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// keyRing holds the data keys of one log and the keys derived from the
+// master key that wrap and file them.
+type keyRing struct {
+	wrap       cipher.AEAD
+	subjectKey []byte
+	masterID   string
+	keys       []DataKey
+	aeads      map[string]cipher.AEAD
+	// legacyWrap and legacyMAC are the master key itself, used only to
+	// open and recognise keys made before derivation.
+	legacyWrap cipher.AEAD
+	legacyMAC  []byte
+}
+
+// newKeyRing unwraps every data key made under master. Keys wrapped by
+// another master key stay listed but cannot be used.
+func newKeyRing(master []byte, keys []DataKey) (*keyRing, error) {
+	legacy, err := newGCM(master)
+	if err != nil {
+		return nil, fmt.Errorf("master key: %w", err)
+	}
+	wrap, err := newGCM(deriveKey(master, wrapKeyLabel))
+	if err != nil {
+		return nil, err
+	}
+	r := &keyRing{
+		wrap:       wrap,
+		subjectKey: deriveKey(master, subjectKeyLabel),
+		masterID:   MasterKeyID(master),
+		keys:       keys,
+		aeads:      make(map[string]cipher.AEAD),
+		legacyWrap: legacy,
+		legacyMAC:  append([]byte(nil), master...),
+	}
+	for _, k := range keys {
+		if k.MasterKeyID != r.masterID {
+			continue
+		}
+		wrapper := r.wrap
+		switch k.KDF {
+		case keyKDF:
+		case "":
+			wrapper = r.legacyWrap
+		default:
+			return nil, fmt.Errorf("data key %s: unknown kdf %q", k.ID, k.KDF)
+		}
+		wrapped, err := base64.StdEncoding.DecodeString(k.Wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("data key %s: %w", k.ID, err)
+		}
+		raw, err := openSealed(wrapper, wrapped, []byte(k.ID))
+		if err != nil {
+			return nil, fmt.Errorf("unwrap data key %s: %w", k.ID, err)
+		}
+		if r.aeads[k.ID], err = newGCM(raw); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// current returns the newest usable key for segment, or for subject if
+// subject is set. Keys made before derivation are only read, never
+// sealed under again.
+func (r *keyRing) current(segment int, subject string) (DataKey, bool) {
+	for i := len(r.keys) - 1; i >= 0; i-- {
+		k := r.keys[i]
+		if _, ok := r.aeads[k.ID]; !ok || k.KDF != keyKDF || k.Subject != subject {
+			continue
+		}
+		if subject != "" || k.Segment == segment {
+			return k, true
+		}
+	}
+	return DataKey{}, false
+}
+
+// subjectID is the pseudonym a subject's keys are filed under. It is keyed
+// by a subkey of the master key so keys.json cannot be searched for a
+// guessed subject.
+func (r *keyRing) subjectID(subject string) string {
+	return pseudonym(r.subjectKey, subject)
+}
+
+// filedUnder reports whether k is a key of subject, under the pseudonym of
+// its own derivation.
+func (r *keyRing) filedUnder(k DataKey, subject string) bool {
+	if k.Subject == "" {
+		return false
+	}
+	if k.KDF == "" {
+		return k.Subject == pseudonym(r.legacyMAC, subject)
+	}
+	return k.Subject == r.subjectID(subject)
+}
+
+func pseudonym(key []byte, subject string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("subject\n" + subject))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// add creates and wraps a fresh data key for segment, or for the subject
+// with pseudonym subject if it is set. The caller persists r.keys before
+// using it and drops the key if that fails.
+func (r *keyRing) add(segment int, subject string) (DataKey, error) {
+	raw := make([]byte, dataKeySize)
+	id := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return DataKey{}, err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return DataKey{}, err
+	}
+	k := DataKey{
+		ID:          hex.EncodeToString(id),
+		Segment:     segment,
+		Subject:     subject,
+		MasterKeyID: r.masterID,
+		KDF:         keyKDF,
+		CreatedAt:   time.Now().UTC(),
+	}
+	wrapped, err := seal(r.wrap, raw, []byte(k.ID))
+	if err != nil {
+		return DataKey{}, err
+	}
+	k.Wrapped = base64.StdEncoding.EncodeToString(wrapped)
+	aead, err := newGCM(raw)
+	if err != nil {
+		return DataKey{}, err
+	}
+	r.keys = append(r.keys, k)
+	r.aeads[k.ID] = aead
+	return k, nil
+}
+
+func (r *keyRing) drop(id string) {
+	delete(r.aeads, id)
+	for i, k := range r.keys {
+		if k.ID == id {
+			r.keys = append(r.keys[:i:i], r.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// seal encrypts event's payload under key for the record at index.
+func (r *keyRing) seal(key DataKey, index int64, event Event) (SealedPayload, error) {
+	plain, err := json.Marshal(event.Payload)
+	if err != nil {
+		return SealedPayload{}, err
+	}
+	out, err := seal(r.aeads[key.ID], plain, payloadAAD(index, event.ID))
+	if err != nil {
+		return SealedPayload{}, err
+	}
+	nonce := out[:r.aeads[key.ID].NonceSize()]
+	return SealedPayload{
+		Key:   key.ID,
+		Nonce: base64.StdEncoding.EncodeToString(nonce),
+		Data:  base64.StdEncoding.EncodeToString(out[len(nonce):]),
+	}, nil
+}
+
+// open returns rec with its payload decrypted and the envelope moved to
+// rec.Sealed. A record whose data key is not available is returned as
+// stored along with ErrKeyUnavailable.
+func (r *keyRing) open(rec Record) (Record, error) {
+	env := sealedEnvelope(rec.Event.Payload)
+	if env == nil {
+		return rec, nil
+	}
+	aead, ok := r.aeads[env.Key]
+	if !ok {
+		return rec, fmt.Errorf("record %d: %w: %s", rec.Index, ErrKeyUnavailable, env.Key)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(env.Nonce)
+	if err != nil {
+		return rec, fmt.Errorf("record %d nonce: %w", rec.Index, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(env.Data)
+	if err != nil {
+		return rec, fmt.Errorf("record %d ciphertext: %w", rec.Index, err)
+	}
+	plain, err := openSealed(aead, append(nonce, data...), payloadAAD(rec.Index, rec.Event.ID))
+	if err != nil {
+		return rec, fmt.Errorf("decrypt record %d: %w", rec.Index, err)
+	}
+	var payload map[string]interface{}
+	if err := DecodeJSON(plain, &payload); err != nil {
+		return rec, fmt.Errorf("record %d payload: %w", rec.Index, err)
+	}
+	rec.Event.Payload = payload
+	rec.Sealed = env
+	return rec, nil
+}
+
+func payloadAAD(index int64, eventID string) []byte {
+	return []byte(fmt.Sprintf("%s\n%d\n%s\n", payloadAADLabel, index, eventID))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns a random nonce followed by the ciphertext of plain.
+func seal(aead cipher.AEAD, plain, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, aad), nil
+}
+
+func openSealed(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], aad)
+}
+
+// sealLocked encrypts event's payload, and the disclosures of its committed
+// fields, for the record at index. A payload naming a subject is sealed under
+// that subject's key; any other under the key of the current segment,
+// started whenever the backend has moved to a new one. The caller holds
+// s.mu.
+func (s *Store) sealLocked(index int64, event Event, disclosures map[string]Disclosure) (SealedPayload, map[string]Disclosure, error) {
+	segment, subject := 0, ""
+	v, ok := event.Payload[s.subjectField]
+	if d, committed := disclosures[s.subjectField]; committed {
+		v = d.Value
+	}
+	if ok && s.subjectField != "" && v != nil {
+		subject = s.keys.subjectID(fmt.Sprint(v))
+	} else if sb, ok := s.backend.(interface{ LiveSegment() int }); ok {
+		segment = sb.LiveSegment()
+	}
+	key, ok := s.keys.current(segment, subject)
+	if !ok {
+		var err error
+		if key, err = s.keys.add(segment, subject); err != nil {
+			return SealedPayload{}, nil, err
+		}
+		if err := s.backend.SaveDataKeys(s.keys.keys); err != nil {
+			s.keys.drop(key.ID)
+			return SealedPayload{}, nil, fmt.Errorf("save data keys: %w", err)
+		}
+	}
+	env, err := s.keys.seal(key, index, event)
+	if err != nil || len(disclosures) == 0 {
+		return env, nil, err
+	}
+	sealed, err := s.keys.sealDisclosures(key, index, event.ID, disclosures)
+	return env, sealed, err
+}
+
+// openRecords decrypts records read back from the backend and puts their
+// disclosed fields back into the payload. Records whose data key is
+// unavailable are returned sealed.
+func (s *Store) openRecords(records []Record) ([]Record, error) {
+	for i, rec := range records {
+		if s.keys != nil {
+			opened, err := s.keys.open(rec)
+			if errors.Is(err, ErrKeyUnavailable) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if rec, err = s.keys.openDisclosures(opened); err != nil {
+				return nil, err
+			}
+		}
+		disclosed, err := disclose(rec)
+		if err != nil {
+			return nil, err
+		}
+		records[i] = disclosed
+	}
+	return records, nil
+}
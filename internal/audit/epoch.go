@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// A log is divided into epochs, each hashed with one algorithm. Epoch 0
+// starts at the first record with the algorithm the log was created with;
+// Store.StartEpoch begins the next one. The first record of every later
+// epoch is a link record: an EventEpoch, hashed with the new algorithm, that
+// chains to the last record of the old epoch through its prev_hash like any
+// record and names the old epoch's algorithm, head and log tree root. Each
+// epoch has its own log tree, which starts empty at the link record but keeps
+// counting sizes from the start of the log, so checkpoint and proof sizes
+// stay record counts.
+
+// EventEpoch is the event type of the link record that starts a new epoch.
+const EventEpoch = "audit.epoch"
+
+// ErrEpochBoundary is returned for a consistency proof between sizes that
+// fall in different epochs; the link record connects those instead.
+var ErrEpochBoundary = errors.New("sizes are in different hash epochs")
+
+// Epoch is a stretch of the log hashed with one algorithm. Its log tree
+// starts after Start records, so its first record has index Start+1.
+type Epoch struct {
+	Number        int           `json:"number"`
+	Start         int64         `json:"start"`
+	HashAlgorithm HashAlgorithm `json:"hash_algorithm"`
+}
+
+func (e Epoch) normalize() Epoch {
+	e.HashAlgorithm = e.HashAlgorithm.normalize()
+	return e
+}
+
+// epochLink is the payload of a link record.
+type epochLink struct {
+	Epoch                 int           `json:"epoch"`
+	HashAlgorithm         HashAlgorithm `json:"hash_algorithm"`
+	PreviousHashAlgorithm HashAlgorithm `json:"previous_hash_algorithm"`
+	PreviousIndex         int64         `json:"previous_index"`
+	PreviousHash          string        `json:"previous_hash"`
+	PreviousTreeRoot      string        `json:"previous_tree_root"`
+}
+
+func (l epochLink) payload() (map[string]interface{}, error) {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]interface{}
+	if err := DecodeJSON(data, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func parseEpochLink(payload map[string]interface{}) (epochLink, error) {
+	var l epochLink
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return l, err
+	}
+	if err := json.Unmarshal(data, &l); err != nil {
+		return l, fmt.Errorf("epoch link: %w", err)
+	}
+	return l, nil
+}
+
+// check compares a link record's payload with the epoch it closes: old is
+// the closing epoch's log tree and prevHash the hash of its last record.
+func (l epochLink) check(old logTree, prevHash string, alg HashAlgorithm) error {
+	switch {
+	case l.Epoch != old.epoch.Number+1:
+		return fmt.Errorf("link names epoch %d, log is in epoch %d", l.Epoch, old.epoch.Number)
+	case l.HashAlgorithm.normalize() != alg:
+		return fmt.Errorf("link names algorithm %s, record is hashed with %s", l.HashAlgorithm, alg)
+	case l.PreviousHashAlgorithm.normalize() != old.epoch.HashAlgorithm.normalize():
+		return fmt.Errorf("link names previous algorithm %s, log used %s", l.PreviousHashAlgorithm, old.epoch.HashAlgorithm.normalize())
+	case l.PreviousIndex != old.size:
+		return fmt.Errorf("link follows index %d, previous epoch ends at %d", l.PreviousIndex, old.size)
+	case l.PreviousHash != prevHash:
+		return fmt.Errorf("link names previous hash %s, chain has %s", l.PreviousHash, prevHash)
+	case l.PreviousTreeRoot != old.root():
+		return fmt.Errorf("link names previous tree root %s, recomputed %s", l.PreviousTreeRoot, old.root())
+	}
+	return nil
+}
+
+// StartEpoch moves the log to a new hash algorithm. The open batch is sealed
+// first, short if need be, so no batch root or checkpoint mixes algorithms;
+// then the link record is appended as the first record of the new epoch.
+// Records already written keep the algorithm they were hashed with.
+func (s *Store) StartEpoch(alg HashAlgorithm) (Record, error) {
+	alg, err := ParseHashAlgorithm(string(alg))
+	if err != nil {
+		return Record{}, err
+	}
+	s.mu.Lock()
+	rec, err := s.startEpochLocked(alg)
+	seq := s.written
+	s.mu.Unlock()
+	if err != nil || s.durability != DurabilityGroup {
+		return rec, err
+	}
+	if err := s.group.wait(seq, s.syncEvents); err != nil {
+		return rec, fmt.Errorf("sync events: %w", err)
+	}
+	return rec, nil
+}
+
+func (s *Store) startEpochLocked(alg HashAlgorithm) (Record, error) {
+	if s.closed {
+		return Record{}, ErrClosed
+	}
+	if s.failed != nil {
+		return Record{}, fmt.Errorf("%w: %v", ErrFailed, s.failed)
+	}
+	old := s.tree
+	if alg == old.epoch.HashAlgorithm.normalize() {
+		return Record{}, fmt.Errorf("log already uses %s", alg)
+	}
+	if s.lastIndex == 0 {
+		return Record{}, errors.New("log is empty: choose its algorithm with Options.HashAlgorithm")
+	}
+	if len(s.batchHashes) > 0 {
+		if _, err := s.sealBatchLocked(SealEpoch); err != nil {
+			return Record{}, fmt.Errorf("seal batch: %w", err)
+		}
+	}
+	link := epochLink{
+		Epoch:                 old.epoch.Number + 1,
+		HashAlgorithm:         alg,
+		PreviousHashAlgorithm: old.epoch.HashAlgorithm.normalize(),
+		PreviousIndex:         s.lastIndex,
+		PreviousHash:          s.lastHash,
+		PreviousTreeRoot:      old.root(),
+	}
+	payload, err := link.payload()
+	if err != nil {
+		return Record{}, err
+	}
+	s.tree = logTree{epoch: Epoch{Number: link.Epoch, Start: s.lastIndex, HashAlgorithm: alg}, size: s.lastIndex}
+	rec, _, err := s.appendLocked(Event{Type: EventEpoch, Source: "assurance-service", Payload: payload}, true)
+	if err != nil && rec.Index == 0 {
+		s.tree = old
+	}
+	return rec, err
+}
+
+// Epoch returns the epoch new records are appended to.
+func (s *Store) Epoch() Epoch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.epoch.normalize()
+}
@@ -0,0 +1,342 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// recoveryLogName is the quarantine file for torn records.
+const recoveryLogName = "recovery.log"
+
+type fileOptions struct {
+	segmentMaxBytes   int64
+	segmentMaxBatches int
+	durable           bool
+	format            LogFormat
+	compression       string
+}
+
+// fileBackend is the original on-disk layout: JSON lines in events.log and
+// its sealed segments, roots.log, checkpoints.log and head.json, plus the
+// genesis header, offset index and segment manifest.
+type fileBackend struct {
+	mu              sync.Mutex
+	dataDir         string
+	eventsPath      string
+	indexPath       string
+	rootsPath       string
+	checkpointsPath string
+	headPath        string
+	keysPath        string
+	genesisPath     string
+	manifestPath    string
+	recoveryPath    string
+	durable         bool
+	// format is used for new live files; liveFormat is the format of the
+	// current one, which may predate a change of format.
+	format     LogFormat
+	liveFormat LogFormat
+
+	manifest       Manifest
+	liveFirst      int64
+	lastIndex      int64
+	eventsSize     int64
+	recovery       *Recovery
+	segmentBatches int
+
+	segmentMaxBytes   int64
+	segmentMaxBatches int
+
+	// compression, when set, compresses sealed segments in the background;
+	// compressMu keeps one pass at a time and Close waits for them.
+	compression string
+	compressMu  sync.Mutex
+	compressing sync.WaitGroup
+	compressErr error
+
+	events      *appendFile
+	index       *appendFile
+	roots       *appendFile
+	checkpoints *appendFile
+	closed      bool
+}
+
+// openFileBackend finishes any interrupted rotation and quarantines a torn
+// trailing record. The files are not opened for appending until Replay has
+// checked the live file and rebuilt its index.
+func openFileBackend(dataDir string, opts fileOptions) (*fileBackend, error) {
+	b := &fileBackend{
+		dataDir:         dataDir,
+		eventsPath:      filepath.Join(dataDir, eventsName),
+		indexPath:       filepath.Join(dataDir, "events.idx"),
+		rootsPath:       filepath.Join(dataDir, "roots.log"),
+		checkpointsPath: filepath.Join(dataDir, "checkpoints.log"),
+		headPath:        filepath.Join(dataDir, "head.json"),
+		keysPath:        filepath.Join(dataDir, dataKeysName),
+		genesisPath:     filepath.Join(dataDir, genesisName),
+		manifestPath:    filepath.Join(dataDir, manifestName),
+		recoveryPath:    filepath.Join(dataDir, recoveryLogName),
+		durable:         opts.durable,
+		format:          opts.format,
+
+		segmentMaxBytes:   opts.segmentMaxBytes,
+		segmentMaxBatches: opts.segmentMaxBatches,
+		compression:       opts.compression,
+	}
+	var err error
+	if b.manifest, err = ReadManifest(b.manifestPath); err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	if err := b.recoverRotation(); err != nil {
+		return nil, err
+	}
+	if err := b.removeCompressedLeftovers(); err != nil {
+		return nil, fmt.Errorf("remove compressed segment leftovers: %w", err)
+	}
+	if b.recovery, err = recoverTornTail(b.eventsPath, b.recoveryPath, b.format); err != nil {
+		return nil, fmt.Errorf("recover torn record: %w", err)
+	}
+	return b, nil
+}
+
+// Base is the head of the last sealed segment, so only the live file has to
+// be replayed.
+func (b *fileBackend) Base() (LogHead, error) {
+	b.liveFirst = 1
+	n := len(b.manifest.Segments)
+	if n == 0 {
+		return LogHead{}, nil
+	}
+	last := b.manifest.Segments[n-1]
+	b.liveFirst = last.LastIndex + 1
+	b.lastIndex = last.LastIndex
+	return LogHead{Index: last.LastIndex, Hash: last.LastHash, TreeRoot: last.TreeRoot, TreeNodes: last.TreeNodes, Epoch: last.Epoch}, nil
+}
+
+// Replay scans the live file, rebuilding its offset index on the way, and
+// then opens the files for appending.
+func (b *fileBackend) Replay(visit func(Record) error) error {
+	file, err := os.OpenFile(b.eventsPath, os.O_RDONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if b.liveFormat, err = detectFormat(file, b.format); err != nil {
+		return err
+	}
+
+	index, err := newIndexBuilder(b.indexPath)
+	if err != nil {
+		return fmt.Errorf("offset index: %w", err)
+	}
+	defer func() {
+		if index != nil {
+			index.abort()
+		}
+	}()
+
+	scanner := newFrameScanner(file, b.liveFormat, 0)
+	for scanner.Scan() {
+		rec, err := decodeFrame(b.liveFormat, scanner.Bytes())
+		if err != nil {
+			return fmt.Errorf("decode record: %w", err)
+		}
+		if err := index.add(scanner.Offset()); err != nil {
+			return fmt.Errorf("offset index: %w", err)
+		}
+		if err := visit(rec); err != nil {
+			return err
+		}
+		b.lastIndex = rec.Index
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	b.eventsSize = info.Size()
+	err = index.finish()
+	index = nil
+	if err != nil {
+		return fmt.Errorf("offset index: %w", err)
+	}
+
+	roots, err := readRoots(b.rootsPath)
+	if err != nil {
+		return err
+	}
+	for _, r := range roots {
+		if r.FromIndex >= b.liveFirst {
+			b.segmentBatches++
+		}
+	}
+	if err := b.openWriters(); err != nil {
+		return err
+	}
+	if b.durable {
+		if err := syncPath(b.dataDir); err != nil {
+			return fmt.Errorf("sync data dir: %w", err)
+		}
+	}
+	b.startCompression()
+	return nil
+}
+
+func (b *fileBackend) Head() (*TrustedState, error) {
+	return ReadTrustedState(b.headPath)
+}
+
+func (b *fileBackend) AppendRecord(rec Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	line, err := encodeFrame(b.liveFormat, rec)
+	if err != nil {
+		return err
+	}
+	if _, err := b.events.Write(line); err != nil {
+		return err
+	}
+	if err := writeIndexEntry(b.index, b.eventsSize); err != nil {
+		return err
+	}
+	b.eventsSize += int64(len(line))
+	b.lastIndex = rec.Index
+	return nil
+}
+
+// AppendRoot writes the batch root and rotates the live file into a sealed
+// segment once it has reached a limit.
+func (b *fileBackend) AppendRoot(root RootRecord, head LogHead) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	if err := b.roots.writeLine(root, b.durable); err != nil {
+		return err
+	}
+	b.segmentBatches++
+	if b.shouldRotate() {
+		if err := b.rotate(head); err != nil {
+			return err
+		}
+		b.startCompression()
+	}
+	return nil
+}
+
+func (b *fileBackend) AppendCheckpoint(c Checkpoint) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	return b.checkpoints.writeLine(c, b.durable)
+}
+
+func (b *fileBackend) SaveHead(state TrustedState) error {
+	return writeJSONFile(b.headPath, state, b.durable)
+}
+
+func (b *fileBackend) ReadTail(limit int) ([]Record, error) {
+	b.mu.Lock()
+	from, to := tailRange(b.lastIndex, limit)
+	b.mu.Unlock()
+	if to == 0 {
+		return []Record{}, nil
+	}
+	return b.ReadRange(from, to)
+}
+
+// Scan reads every file of the log in order. A sealed segment that is no
+// longer on disk, such as one moved to cold storage, is skipped.
+func (b *fileBackend) Scan(visit func(Record) error) error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	files, err := SegmentFiles(b.eventsPath)
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		if err := scanLogFile(path, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanLogFile(path string, visit func(Record) error) error {
+	file, format, err := openLog(path, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := newFrameScanner(file, format, 0)
+	for scanner.Scan() {
+		rec, err := decodeFrame(format, scanner.Bytes())
+		if err != nil {
+			return err
+		}
+		if err := visit(rec); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (b *fileBackend) Roots() ([]RootRecord, error) {
+	return readRoots(b.rootsPath)
+}
+
+func (b *fileBackend) LastRoot() (*RootRecord, error) {
+	return readLastRoot(b.rootsPath)
+}
+
+func (b *fileBackend) Checkpoints() ([]Checkpoint, error) {
+	return readCheckpoints(b.checkpointsPath)
+}
+
+func (b *fileBackend) DataKeys() ([]DataKey, error) {
+	return readDataKeys(b.keysPath)
+}
+
+func (b *fileBackend) SaveDataKeys(keys []DataKey) error {
+	return writeDataKeys(b.keysPath, keys)
+}
+
+func (b *fileBackend) Genesis() (*Genesis, error) {
+	return ReadGenesis(b.genesisPath)
+}
+
+func (b *fileBackend) SaveGenesis(g Genesis) error {
+	if err := writeJSONFile(b.genesisPath, g, true); err != nil {
+		return err
+	}
+	return syncPath(b.dataDir)
+}
+
+// LiveSegment numbers the file records are currently appended to, so the
+// store can start a data key per segment.
+func (b *fileBackend) LiveSegment() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.manifest.Segments) + 1
+}
+
+// Recovery reports the torn record quarantined when the backend was opened.
+func (b *fileBackend) Recovery() *Recovery {
+	return b.recovery
+}
@@ -0,0 +1,92 @@
+package audit
+
+// FindingCode identifies one class of verification failure. Codes are part
+// of the API: dashboards and alert rules match on them, so never rename one.
+type FindingCode string
+
+const (
+	FindingIO                 FindingCode = "io_error"
+	FindingDecode             FindingCode = "decode_error"
+	FindingIndexMismatch      FindingCode = "index_mismatch"
+	FindingPrevHashMismatch   FindingCode = "prev_hash_mismatch"
+	FindingCanonicalization   FindingCode = "canonicalization_error"
+	FindingHashMismatch       FindingCode = "hash_mismatch"
+	FindingMissingRoot        FindingCode = "missing_root"
+	FindingRootMismatch       FindingCode = "root_mismatch"
+	FindingTreeVersion        FindingCode = "tree_version"
+	FindingCheckpointMissing  FindingCode = "checkpoint_missing"
+	FindingCheckpointInvalid  FindingCode = "checkpoint_signature"
+	FindingCheckpointMismatch FindingCode = "checkpoint_mismatch"
+	FindingExpectedMismatch   FindingCode = "expected_state_mismatch"
+	FindingTruncated          FindingCode = "truncated"
+	FindingSegmentMismatch    FindingCode = "segment_mismatch"
+	FindingDisclosureMismatch FindingCode = "disclosure_mismatch"
+	FindingHashAlgorithm      FindingCode = "hash_algorithm"
+	FindingEpochLink          FindingCode = "epoch_link"
+	FindingGenesis            FindingCode = "genesis_invalid"
+)
+
+// FindingKind groups codes into the broad classes alerting routes on.
+type FindingKind string
+
+const (
+	KindIO         FindingKind = "io"
+	KindDecode     FindingKind = "decode"
+	KindChain      FindingKind = "chain"
+	KindRoot       FindingKind = "root"
+	KindCheckpoint FindingKind = "checkpoint"
+	KindTruncation FindingKind = "truncation"
+	KindSegment    FindingKind = "segment"
+	KindDisclosure FindingKind = "disclosure"
+	KindEpoch      FindingKind = "epoch"
+	KindGenesis    FindingKind = "genesis"
+)
+
+var findingKinds = map[FindingCode]FindingKind{
+	FindingIO:                 KindIO,
+	FindingDecode:             KindDecode,
+	FindingCanonicalization:   KindDecode,
+	FindingIndexMismatch:      KindChain,
+	FindingPrevHashMismatch:   KindChain,
+	FindingHashMismatch:       KindChain,
+	FindingExpectedMismatch:   KindChain,
+	FindingMissingRoot:        KindRoot,
+	FindingRootMismatch:       KindRoot,
+	FindingTreeVersion:        KindRoot,
+	FindingCheckpointMissing:  KindCheckpoint,
+	FindingCheckpointInvalid:  KindCheckpoint,
+	FindingCheckpointMismatch: KindCheckpoint,
+	FindingTruncated:          KindTruncation,
+	FindingSegmentMismatch:    KindSegment,
+	FindingDisclosureMismatch: KindDisclosure,
+	FindingHashAlgorithm:      KindEpoch,
+	FindingEpochLink:          KindEpoch,
+	FindingGenesis:            KindGenesis,
+}
+
+// Finding is one machine-readable verification failure. Fields that do not
+// apply to a code are left empty; Offset is meaningful only when File is set
+// and is the byte offset of the offending line in that file.
+type Finding struct {
+	Code      FindingCode `json:"code"`
+	Kind      FindingKind `json:"kind"`
+	Message   string      `json:"message"`
+	Index     int64       `json:"index,omitempty"`
+	FromIndex int64       `json:"from_index,omitempty"`
+	ToIndex   int64       `json:"to_index,omitempty"`
+	Expected  string      `json:"expected,omitempty"`
+	Actual    string      `json:"actual,omitempty"`
+	File      string      `json:"file,omitempty"`
+	Offset    int64       `json:"offset"`
+}
+
+// fail records a finding, keeping the legacy Errors list in step with it.
+func (r *VerifyReport) fail(f Finding) {
+	f.Kind = findingKinds[f.Code]
+	r.OK = false
+	if f.Code == FindingTruncated {
+		r.Truncated = true
+	}
+	r.Findings = append(r.Findings, f)
+	r.Errors = append(r.Errors, f.Message)
+}
@@ -0,0 +1,404 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// A log file holds its records either as JSON lines or as binary frames. A
+// binary file starts with binaryMagic; each frame after it is
+//
+//	payload length uint32 | crc32c(payload) uint32 | payload
+//
+// where the payload is the record's fields as varint-prefixed strings, with
+// hashes packed to raw bytes and the event payload as compact JSON. Optional
+// fields follow as tag varint | bytes, and only when set: the hash scheme,
+// the hash algorithm and the disclosures. Only the storage form changes:
+// record hashes are still computed over the canonical event, so roots,
+// checkpoints and proofs are the same in both formats. The format is
+// detected per file, so one log can mix them across segments.
+
+// LogFormat selects how records are written to new log files.
+type LogFormat string
+
+const (
+	FormatJSON   LogFormat = "json"
+	FormatBinary LogFormat = "binary"
+)
+
+const (
+	binaryMagic      = "ASRLOG\x00\x01"
+	frameHeaderSize  = 8
+	maxFramePayload  = 5 * 1024 * 1024
+	binaryHashTag    = 1
+	binaryStringTag  = 0
+	binaryHashLength = 32
+
+	// Tags of the optional trailing fields of a binary record.
+	binaryDisclosuresTag   = 1
+	binaryHashSchemeTag    = 2
+	binaryHashAlgorithmTag = 3
+)
+
+var (
+	frameTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errFrameChecksum  = errors.New("frame checksum mismatch")
+	errFrameTruncated = errors.New("frame truncated")
+)
+
+// ParseLogFormat validates a log format name. The empty string means
+// FormatJSON.
+func ParseLogFormat(s string) (LogFormat, error) {
+	switch f := LogFormat(s); f {
+	case "":
+		return FormatJSON, nil
+	case FormatJSON, FormatBinary:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown log format %q", s)
+}
+
+// headerSize is the number of bytes before the first record.
+func (f LogFormat) headerSize() int64 {
+	if f == FormatBinary {
+		return int64(len(binaryMagic))
+	}
+	return 0
+}
+
+// detectFormat reports the format of a log file from its first bytes. An
+// empty file has no format yet and reports def.
+func detectFormat(r io.ReaderAt, def LogFormat) (LogFormat, error) {
+	head := make([]byte, len(binaryMagic))
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return formatOf(head[:n], def), nil
+}
+
+// formatOf reports the format of a log file starting with head.
+func formatOf(head []byte, def LogFormat) LogFormat {
+	switch {
+	case len(head) == 0:
+		return def
+	case bytes.HasPrefix([]byte(binaryMagic), head):
+		return FormatBinary
+	}
+	return FormatJSON
+}
+
+// encodeFrame returns rec as it is stored in a file of format f.
+func encodeFrame(f LogFormat, rec Record) ([]byte, error) {
+	if f != FormatBinary {
+		return encodeJSONLine(rec)
+	}
+	payload, err := encodeBinaryRecord(rec)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > maxFramePayload {
+		return nil, fmt.Errorf("record %d: %d bytes exceeds frame limit", rec.Index, len(payload))
+	}
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, frameTable))
+	return append(frame, payload...), nil
+}
+
+// decodeFrame decodes one record as returned by a frameScanner.
+func decodeFrame(f LogFormat, frame []byte) (Record, error) {
+	var rec Record
+	if f != FormatBinary {
+		err := DecodeJSON(frame, &rec)
+		return rec, err
+	}
+	if len(frame) < frameHeaderSize {
+		return rec, errFrameTruncated
+	}
+	payload := frame[frameHeaderSize:]
+	if int(binary.BigEndian.Uint32(frame[0:4])) != len(payload) {
+		return rec, errFrameTruncated
+	}
+	if crc32.Checksum(payload, frameTable) != binary.BigEndian.Uint32(frame[4:8]) {
+		return rec, errFrameChecksum
+	}
+	return decodeBinaryRecord(payload)
+}
+
+func encodeBinaryRecord(rec Record) ([]byte, error) {
+	var payload []byte
+	if rec.Event.Payload != nil {
+		var err error
+		if payload, err = json.Marshal(rec.Event.Payload); err != nil {
+			return nil, err
+		}
+	}
+	recordTime, err := rec.Timestamp.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	// The event timestamp keeps its exact text, zone offset included,
+	// because it is part of the hashed event.
+	eventTime, err := rec.Event.Timestamp.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	buf := binary.AppendUvarint(nil, uint64(rec.Index))
+	buf = appendBytes(buf, recordTime)
+	buf = appendHash(buf, rec.PrevHash)
+	buf = appendHash(buf, rec.Hash)
+	buf = appendBytes(buf, []byte(rec.Event.ID))
+	buf = appendBytes(buf, []byte(rec.Event.Type))
+	buf = appendBytes(buf, []byte(rec.Event.Source))
+	buf = appendBytes(buf, eventTime)
+	buf = appendBytes(buf, payload)
+	if len(rec.Disclosures) > 0 {
+		disclosures, err := json.Marshal(rec.Disclosures)
+		if err != nil {
+			return nil, err
+		}
+		buf = binary.AppendUvarint(buf, binaryDisclosuresTag)
+		buf = appendBytes(buf, disclosures)
+	}
+	if rec.HashScheme != 0 {
+		buf = binary.AppendUvarint(buf, binaryHashSchemeTag)
+		buf = appendBytes(buf, binary.AppendUvarint(nil, uint64(rec.HashScheme)))
+	}
+	if rec.HashAlgorithm != "" {
+		buf = binary.AppendUvarint(buf, binaryHashAlgorithmTag)
+		buf = appendBytes(buf, []byte(rec.HashAlgorithm))
+	}
+	return buf, nil
+}
+
+func decodeBinaryRecord(payload []byte) (Record, error) {
+	var rec Record
+	d := binaryDecoder{buf: payload}
+	rec.Index = int64(d.uvarint())
+	recordTime := d.bytes()
+	rec.PrevHash = d.hash()
+	rec.Hash = d.hash()
+	rec.Event.ID = string(d.bytes())
+	rec.Event.Type = string(d.bytes())
+	rec.Event.Source = string(d.bytes())
+	eventTime := d.bytes()
+	eventPayload := d.bytes()
+	var disclosures []byte
+	for d.err == nil && len(d.buf) > 0 {
+		tag := d.uvarint()
+		field := d.bytes()
+		switch tag {
+		case binaryDisclosuresTag:
+			disclosures = field
+		case binaryHashSchemeTag:
+			scheme := binaryDecoder{buf: field}
+			rec.HashScheme = int(scheme.uvarint())
+			if scheme.err != nil {
+				return rec, scheme.err
+			}
+		case binaryHashAlgorithmTag:
+			rec.HashAlgorithm = HashAlgorithm(field)
+		default:
+			return rec, fmt.Errorf("unknown record field %d", tag)
+		}
+	}
+	if d.err != nil {
+		return rec, d.err
+	}
+	if err := rec.Timestamp.UnmarshalText(recordTime); err != nil {
+		return rec, err
+	}
+	if err := rec.Event.Timestamp.UnmarshalText(eventTime); err != nil {
+		return rec, err
+	}
+	if len(eventPayload) > 0 {
+		if err := DecodeJSON(eventPayload, &rec.Event.Payload); err != nil {
+			return rec, err
+		}
+	}
+	if len(disclosures) > 0 {
+		if err := DecodeJSON(disclosures, &rec.Disclosures); err != nil {
+			return rec, err
+		}
+	}
+	return rec, nil
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// appendHash stores a well-formed 32-byte hex hash as its raw bytes and
+// anything else, such as a tampered hash, verbatim.
+func appendHash(buf []byte, h string) []byte {
+	if raw, err := hex.DecodeString(h); err == nil && len(raw) == binaryHashLength && hex.EncodeToString(raw) == h {
+		return append(append(buf, binaryHashTag), raw...)
+	}
+	return appendBytes(append(buf, binaryStringTag), []byte(h))
+}
+
+type binaryDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errors.New("bad varint in record")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *binaryDecoder) take(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = errors.New("record field runs past frame")
+		return nil
+	}
+	out := d.buf[:n]
+	d.buf = d.buf[n:]
+	return out
+}
+
+func (d *binaryDecoder) bytes() []byte {
+	return d.take(d.uvarint())
+}
+
+func (d *binaryDecoder) hash() string {
+	tag := d.take(1)
+	switch {
+	case d.err != nil:
+		return ""
+	case tag[0] == binaryHashTag:
+		return hex.EncodeToString(d.take(binaryHashLength))
+	case tag[0] == binaryStringTag:
+		return string(d.bytes())
+	}
+	d.err = fmt.Errorf("bad hash tag %d", tag[0])
+	return ""
+}
+
+// frameScanner splits a log file into records. For JSON lines a frame is one
+// non-empty line; for binary files it is a whole frame, header included,
+// and a frame cut short by the end of the file is returned as-is so that
+// decodeFrame reports it.
+type frameScanner struct {
+	format  LogFormat
+	r       *bufio.Reader
+	lines   *bufio.Scanner
+	frame   []byte
+	offset  int64
+	end     int64
+	err     error
+	stopped bool
+}
+
+// newFrameScanner reads frames of format from r, which is positioned at
+// byte offset of its file. At offset zero a binary file's header is skipped.
+func newFrameScanner(r io.Reader, format LogFormat, offset int64) *frameScanner {
+	s := &frameScanner{format: format, end: offset}
+	if format != FormatBinary {
+		s.lines = bufio.NewScanner(r)
+		s.lines.Buffer(make([]byte, 0, 64*1024), maxFramePayload)
+		return s
+	}
+	s.r = bufio.NewReaderSize(r, 64*1024)
+	if offset == 0 {
+		head := make([]byte, len(binaryMagic))
+		n, err := io.ReadFull(s.r, head)
+		s.end = int64(n)
+		if err != nil && err != io.EOF {
+			s.stopped = true
+			if err != io.ErrUnexpectedEOF {
+				s.err = err
+			}
+		} else if n > 0 && string(head) != binaryMagic {
+			s.stopped = true
+			s.err = errors.New("bad binary log header")
+		}
+	}
+	return s
+}
+
+func (s *frameScanner) Scan() bool {
+	if s.stopped {
+		return false
+	}
+	if s.lines != nil {
+		for s.lines.Scan() {
+			line := s.lines.Bytes()
+			s.offset = s.end
+			s.end += int64(len(line)) + 1
+			if len(line) == 0 {
+				continue
+			}
+			s.frame = line
+			return true
+		}
+		s.err = s.lines.Err()
+		s.stopped = true
+		return false
+	}
+
+	s.offset = s.end
+	header, err := s.r.Peek(frameHeaderSize)
+	if len(header) == 0 && err == io.EOF {
+		s.stopped = true
+		return false
+	}
+	if err != nil && err != io.EOF {
+		s.err, s.stopped = err, true
+		return false
+	}
+	size := frameHeaderSize
+	if len(header) == frameHeaderSize {
+		n := binary.BigEndian.Uint32(header[0:4])
+		if n > maxFramePayload {
+			s.err, s.stopped = fmt.Errorf("frame at offset %d claims %d bytes", s.offset, n), true
+			return false
+		}
+		size += int(n)
+	}
+	frame := make([]byte, size)
+	n, err := io.ReadFull(s.r, frame)
+	s.frame = frame[:n]
+	s.end += int64(n)
+	if err != nil {
+		// A short frame is the last thing in the file.
+		s.stopped = true
+		if err != io.ErrUnexpectedEOF && err != io.EOF {
+			s.err = err
+			return false
+		}
+	}
+	return true
+}
+
+// Bytes returns the current frame. It is only valid until the next Scan.
+func (s *frameScanner) Bytes() []byte { return s.frame }
+
+// Offset is the byte offset of the current frame.
+func (s *frameScanner) Offset() int64 { return s.offset }
+
+// End is the byte offset just past the current frame.
+func (s *frameScanner) End() int64 { return s.end }
+
+func (s *frameScanner) Err() error { return s.err }
@@ -0,0 +1,225 @@
+package audit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Every log created since genesis headers were introduced starts with one:
+// a signed statement of the parameters the log was created with, written
+// once, before the first record, to genesis.json (or the "genesis" key of the
+// kv engine). The first record's prev_hash is the genesis hash instead of the
+// empty string, so the header cannot be swapped without breaking the chain.
+// The store, Verify and assurectl take the batch size and tree version from
+// it rather than from their own configuration. Logs created before it have
+// no genesis and keep working from configuration.
+
+const (
+	genesisName    = "genesis.json"
+	genesisHeader  = "assurance-service genesis v1"
+	genesisVersion = 1
+)
+
+// Genesis describes a log as it was created.
+type Genesis struct {
+	Version   int       `json:"genesis_version"`
+	LogID     string    `json:"log_id"`
+	CreatedAt time.Time `json:"created_at"`
+	BatchSize int       `json:"batch_size"`
+	// TreeVersion, HashScheme and HashAlgorithm are the batch tree
+	// construction, event serialization and hash function of the first
+	// record. Records carry their own scheme and epochs their own
+	// algorithm, so only the tree version binds the whole log.
+	TreeVersion   int           `json:"tree_version"`
+	HashScheme    int           `json:"hash_scheme"`
+	HashAlgorithm HashAlgorithm `json:"hash_algorithm"`
+	// PublicKey is the hex Ed25519 key that signs the genesis and the log's
+	// checkpoints; both it and Signature are empty for a log without a
+	// signing key.
+	PublicKey string `json:"public_key,omitempty"`
+	KeyID     string `json:"key_id,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// GenesisPath returns the genesis header that sits next to eventsPath.
+func GenesisPath(eventsPath string) string {
+	return filepath.Join(filepath.Dir(eventsPath), genesisName)
+}
+
+// ReadGenesis reads a genesis header, returning nil if the file does not
+// exist.
+func ReadGenesis(path string) (*Genesis, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var g Genesis
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func newGenesis(opts Options, alg HashAlgorithm) (Genesis, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Genesis{}, err
+	}
+	g := Genesis{
+		Version:       genesisVersion,
+		LogID:         hex.EncodeToString(id),
+		CreatedAt:     time.Now().UTC(),
+		BatchSize:     opts.BatchSize,
+		TreeVersion:   opts.TreeVersion,
+		HashScheme:    opts.HashScheme,
+		HashAlgorithm: alg,
+	}
+	if opts.SigningKey != nil {
+		pub := opts.SigningKey.Public().(ed25519.PublicKey)
+		g.PublicKey = hex.EncodeToString(pub)
+		g.KeyID = KeyID(pub)
+		body, err := g.signedBody()
+		if err != nil {
+			return Genesis{}, err
+		}
+		g.Signature = hex.EncodeToString(ed25519.Sign(opts.SigningKey, body))
+	}
+	return g, nil
+}
+
+// signedBody is the header line followed by the RFC 8785 encoding of every
+// field but the signature. It is what the signature covers and what Hash
+// hashes.
+func (g Genesis) signedBody() ([]byte, error) {
+	g.Signature = ""
+	body, err := CanonicalJSON(g)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(genesisHeader+"\n"), body...), nil
+}
+
+// Hash is the prev_hash of the log's first record, computed with the log's
+// first hash algorithm.
+func (g Genesis) Hash() (string, error) {
+	body, err := g.signedBody()
+	if err != nil {
+		return "", err
+	}
+	return hashBytes(g.HashAlgorithm, body), nil
+}
+
+// Check validates the header on its own: known parameters and, when it names
+// a key, a valid signature by that key. trusted, when set, must be that key.
+func (g Genesis) Check(trusted ed25519.PublicKey) error {
+	switch {
+	case g.Version != genesisVersion:
+		return fmt.Errorf("unknown genesis version %d", g.Version)
+	case g.BatchSize <= 0:
+		return fmt.Errorf("genesis batch size %d", g.BatchSize)
+	case !validTreeVersion(g.TreeVersion):
+		return fmt.Errorf("genesis names unknown tree version %d", g.TreeVersion)
+	case !validHashScheme(g.HashScheme):
+		return fmt.Errorf("genesis names unknown hash scheme %d", g.HashScheme)
+	case g.HashAlgorithm == "" || !g.HashAlgorithm.valid():
+		return fmt.Errorf("genesis names unknown hash algorithm %q", g.HashAlgorithm)
+	}
+	if g.PublicKey == "" {
+		if trusted != nil {
+			return fmt.Errorf("genesis of log %s is not signed", g.LogID)
+		}
+		return nil
+	}
+	raw, err := hex.DecodeString(g.PublicKey)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return fmt.Errorf("genesis public key is malformed")
+	}
+	pub := ed25519.PublicKey(raw)
+	if g.KeyID != KeyID(pub) {
+		return fmt.Errorf("genesis key ID %s does not match its key %s", g.KeyID, KeyID(pub))
+	}
+	if trusted != nil && !pub.Equal(trusted) {
+		return fmt.Errorf("genesis signed by key %s, trusted key is %s", g.KeyID, KeyID(trusted))
+	}
+	sig, err := hex.DecodeString(g.Signature)
+	if err != nil {
+		return fmt.Errorf("decode genesis signature: %w", err)
+	}
+	body, err := g.signedBody()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, body, sig) {
+		return fmt.Errorf("invalid signature on genesis of log %s", g.LogID)
+	}
+	return nil
+}
+
+// Genesis returns the log's genesis header, or nil for a log created before
+// headers existed.
+func (s *Store) Genesis() *Genesis {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.genesis == nil {
+		return nil
+	}
+	g := *s.genesis
+	return &g
+}
+
+// BatchSize reports the number of records per batch: the genesis value, or
+// the configured one for a log without a genesis.
+func (s *Store) BatchSize() int {
+	return s.batchSize
+}
+
+// loadGenesis reads the log's genesis, writing one first for a new log, and
+// adopts its parameters. A log that already has records but no genesis
+// predates headers and keeps running from opts.
+func (s *Store) loadGenesis(opts Options) error {
+	g, err := s.backend.Genesis()
+	if err != nil {
+		return fmt.Errorf("read genesis: %w", err)
+	}
+	if g == nil {
+		if s.lastIndex > 0 {
+			return nil
+		}
+		created, err := newGenesis(opts, s.tree.epoch.HashAlgorithm)
+		if err != nil {
+			return err
+		}
+		if err := s.backend.SaveGenesis(created); err != nil {
+			return fmt.Errorf("save genesis: %w", err)
+		}
+		g = &created
+	}
+	if err := g.Check(nil); err != nil {
+		return err
+	}
+	if opts.SigningKey != nil && g.PublicKey != "" {
+		if id := KeyID(opts.SigningKey.Public().(ed25519.PublicKey)); id != g.KeyID {
+			return fmt.Errorf("signing key %s is not the key %s of log %s", id, g.KeyID, g.LogID)
+		}
+	}
+	s.genesis = g
+	s.batchSize = g.BatchSize
+	s.treeVersion = g.TreeVersion
+	if s.lastIndex == 0 {
+		s.tree.epoch.HashAlgorithm = g.HashAlgorithm
+		if s.lastHash, err = g.Hash(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,13 +2,136 @@ package audit
 
 import (
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
+	"fmt"
+	"hash"
 )
 
-func hashBytes(parts ...[]byte) string {
-	h := sha256.New()
+// HashAlgorithm is the hash function behind record hashes, batch roots and
+// the log tree. It is a property of a log epoch: every record, root and
+// checkpoint of an epoch uses the same one; see Store.StartEpoch.
+type HashAlgorithm string
+
+const (
+	// HashSHA256 is the original algorithm. Records, roots and checkpoints
+	// hashed with it do not name it, so logs that never migrate keep their
+	// exact bytes, and an empty algorithm reads as HashSHA256.
+	HashSHA256     HashAlgorithm = "sha256"
+	HashSHA512_256 HashAlgorithm = "sha512-256"
+	HashBLAKE2b256 HashAlgorithm = "blake2b-256"
+
+	DefaultHashAlgorithm = HashSHA256
+)
+
+// ParseHashAlgorithm validates a configured algorithm name. The empty string
+// selects DefaultHashAlgorithm.
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	a := HashAlgorithm(name).normalize()
+	if !a.valid() {
+		return "", fmt.Errorf("unknown hash algorithm %q (want %s, %s or %s)", name, HashSHA256, HashSHA512_256, HashBLAKE2b256)
+	}
+	return a, nil
+}
+
+func (a HashAlgorithm) normalize() HashAlgorithm {
+	if a == "" {
+		return HashSHA256
+	}
+	return a
+}
+
+func (a HashAlgorithm) valid() bool {
+	switch a.normalize() {
+	case HashSHA256, HashSHA512_256, HashBLAKE2b256:
+		return true
+	}
+	return false
+}
+
+// recorded is a as written into records, roots and checkpoints: empty for
+// HashSHA256.
+func (a HashAlgorithm) recorded() HashAlgorithm {
+	if a.normalize() == HashSHA256 {
+		return ""
+	}
+	return a
+}
+
+// new returns a hasher for a. Callers validate algorithms read from outside
+// before hashing with them.
+func (a HashAlgorithm) new() hash.Hash {
+	switch a.normalize() {
+	case HashSHA256:
+		return sha256.New()
+	case HashSHA512_256:
+		return sha512.New512_256()
+	case HashBLAKE2b256:
+		return newBlake2b256()
+	}
+	panic(fmt.Sprintf("audit: unknown hash algorithm %q", string(a)))
+}
+
+func hashBytes(alg HashAlgorithm, parts ...[]byte) string {
+	h := alg.new()
 	for _, p := range parts {
 		h.Write(p)
 	}
 	return hex.EncodeToString(h.Sum(nil))
 }
+
+// Hash schemes recorded in Record.HashScheme select how an event is
+// serialized for its record hash.
+const (
+	// HashSchemeStable is the original StableJSON encoding, which turns
+	// objects into [k, v, ...] arrays and formats numbers the way Go does.
+	// Records written before schemes were recorded carry none and are read
+	// as HashSchemeStable.
+	HashSchemeStable = 1
+	// HashSchemeJCS is the RFC 8785 JSON Canonicalization Scheme, which
+	// verifiers in other languages can reproduce; see CanonicalJSON.
+	// Integers above 2^53 are hashed as the nearest double.
+	HashSchemeJCS = 2
+	// HashSchemeJCSExact is HashSchemeJCS with integers written with all
+	// their digits, so the hash covers large amounts exactly. A verifier
+	// must parse such integers exactly (as a BigInt, say) rather than as
+	// doubles. See isIntegerLiteral for which literals count as integers.
+	HashSchemeJCSExact = 3
+
+	DefaultHashScheme = HashSchemeJCSExact
+)
+
+func normalizeHashScheme(scheme int) int {
+	if scheme == 0 {
+		return HashSchemeStable
+	}
+	return scheme
+}
+
+func validHashScheme(scheme int) bool {
+	s := normalizeHashScheme(scheme)
+	return s == HashSchemeStable || s == HashSchemeJCS || s == HashSchemeJCSExact
+}
+
+// CanonicalEvent serializes event under a hash scheme.
+func CanonicalEvent(scheme int, event Event) ([]byte, error) {
+	return canonicalize(scheme, event)
+}
+
+// canonicalize serializes any value under a hash scheme.
+func canonicalize(scheme int, v interface{}) ([]byte, error) {
+	switch normalizeHashScheme(scheme) {
+	case HashSchemeStable:
+		return StableJSON(v)
+	case HashSchemeJCS:
+		return CanonicalJSON(v)
+	case HashSchemeJCSExact:
+		return canonicalJSONExact(v)
+	}
+	return nil, fmt.Errorf("unknown hash scheme %d", scheme)
+}
+
+// recordHash links an event payload to its position and predecessor in the chain.
+func recordHash(alg HashAlgorithm, prevHash string, index int64, payload []byte) string {
+	return hashBytes(alg, []byte(prevHash), []byte(fmt.Sprintf("|%d|", index)), payload)
+}
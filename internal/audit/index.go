@@ -0,0 +1,180 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// events.idx is a sidecar to events.log holding one 8-byte big-endian byte
+// offset per record, so the file's k-th record starts at the offset stored
+// at (k-1)*8. Sealed segments keep their index under the same base name. It
+// is derived data: Replay rebuilds it whenever it is missing or disagrees
+// with the log, and Verify never trusts it.
+
+const indexEntrySize = 8
+
+// indexBuilder recomputes the offset index while the log is scanned and
+// notes whether the index on disk already matches it.
+type indexBuilder struct {
+	path     string
+	existing *bufio.Reader
+	file     *os.File
+	tmp      *os.File
+	out      *bufio.Writer
+	stale    bool
+}
+
+func newIndexBuilder(path string) (*indexBuilder, error) {
+	b := &indexBuilder{path: path}
+	file, err := os.Open(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		b.stale = true
+	case err != nil:
+		return nil, err
+	default:
+		b.file = file
+		b.existing = bufio.NewReader(file)
+	}
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		b.closeExisting()
+		return nil, err
+	}
+	b.tmp = tmp
+	b.out = bufio.NewWriter(tmp)
+	return b, nil
+}
+
+func (b *indexBuilder) add(offset int64) error {
+	var entry [indexEntrySize]byte
+	binary.BigEndian.PutUint64(entry[:], uint64(offset))
+	if !b.stale {
+		var have [indexEntrySize]byte
+		if _, err := io.ReadFull(b.existing, have[:]); err != nil || have != entry {
+			b.stale = true
+		}
+	}
+	_, err := b.out.Write(entry[:])
+	return err
+}
+
+// finish replaces the index with the rebuilt one if the old index was
+// missing, short, long or wrong anywhere.
+func (b *indexBuilder) finish() error {
+	if !b.stale {
+		if _, err := b.existing.ReadByte(); err != io.EOF {
+			b.stale = true
+		}
+	}
+	b.closeExisting()
+	if err := b.out.Flush(); err != nil {
+		b.tmp.Close()
+		return err
+	}
+	if err := b.tmp.Close(); err != nil {
+		return err
+	}
+	if !b.stale {
+		return os.Remove(b.tmp.Name())
+	}
+	return os.Rename(b.tmp.Name(), b.path)
+}
+
+func (b *indexBuilder) abort() {
+	b.closeExisting()
+	b.tmp.Close()
+	os.Remove(b.tmp.Name())
+}
+
+func (b *indexBuilder) closeExisting() {
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+}
+
+func writeIndexEntry(w io.Writer, offset int64) error {
+	var entry [indexEntrySize]byte
+	binary.BigEndian.PutUint64(entry[:], uint64(offset))
+	_, err := w.Write(entry[:])
+	return err
+}
+
+func readIndexEntry(path string, index int64) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var entry [indexEntrySize]byte
+	if _, err := file.ReadAt(entry[:], (index-1)*indexEntrySize); err != nil {
+		return 0, fmt.Errorf("offset index entry %d: %w", index, err)
+	}
+	return int64(binary.BigEndian.Uint64(entry[:])), nil
+}
+
+// ReadRange reads the records from..to, seeking straight to the first one
+// in each log file through its offset index.
+func (b *fileBackend) ReadRange(from, to int64) ([]Record, error) {
+	files, err := b.files(from, to)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Record, 0, to-from+1)
+	for _, f := range files {
+		start, end := from, to
+		if start < f.first {
+			start = f.first
+		}
+		if end > f.last {
+			end = f.last
+		}
+		records, err := readFileRecords(f, start, end)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, records...)
+	}
+	return out, nil
+}
+
+// readFileRecords reads from..to out of one log file. A file without an
+// index, such as a segment restored from an archive, is scanned from the
+// start instead.
+func readFileRecords(f logFile, from, to int64) ([]Record, error) {
+	offset, err := readIndexEntry(indexFile(f.path), from-f.first+1)
+	if errors.Is(err, os.ErrNotExist) {
+		offset = 0
+	} else if err != nil {
+		return nil, err
+	}
+	file, format, err := openLog(f.path, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	out := make([]Record, 0, to-from+1)
+	scanner := newFrameScanner(file, format, offset)
+	for next := from; next <= to && scanner.Scan(); {
+		rec, err := decodeFrame(format, scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("decode record %d: %w", next, err)
+		}
+		if offset == 0 && rec.Index < next {
+			continue
+		}
+		if rec.Index != next {
+			return nil, fmt.Errorf("offset index points at record %d, want %d", rec.Index, next)
+		}
+		out = append(out, rec)
+		next++
+	}
+	return out, scanner.Err()
+}
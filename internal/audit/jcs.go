@@ -0,0 +1,202 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// CanonicalJSON encodes v with the JSON Canonicalization Scheme of RFC 8785:
+// no whitespace, object members sorted by the UTF-16 code units of their
+// names, strings with only the mandatory escapes, and numbers serialized as
+// ECMAScript does for IEEE 754 doubles. Any JCS implementation in another
+// language produces the same bytes. Integers above 2^53 are therefore
+// rounded to the nearest double; see canonicalJSONExact.
+func CanonicalJSON(v interface{}) ([]byte, error) {
+	return appendJCS(nil, v, false)
+}
+
+// canonicalJSONExact is CanonicalJSON except that a json.Number integer
+// literal is written with all its digits instead of as a double. Up to 2^53
+// the two agree; beyond it only this keeps the hash on the stored value.
+func canonicalJSONExact(v interface{}) ([]byte, error) {
+	return appendJCS(nil, v, true)
+}
+
+func appendJCS(buf []byte, v interface{}, exact bool) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		return append(buf, "null"...), nil
+	case bool:
+		return strconv.AppendBool(buf, val), nil
+	case string:
+		return appendJCSString(buf, val)
+	case float64:
+		return appendJCSNumber(buf, val)
+	case json.Number:
+		if exact && isIntegerLiteral(val) {
+			return appendJCSInteger(buf, val)
+		}
+		f, err := strconv.ParseFloat(string(val), 64)
+		if err != nil {
+			return nil, fmt.Errorf("jcs: number %q: %w", val, err)
+		}
+		return appendJCSNumber(buf, f)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return lessUTF16(keys[i], keys[j]) })
+		buf = append(buf, '{')
+		for i, k := range keys {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			var err error
+			if buf, err = appendJCSString(buf, k); err != nil {
+				return nil, err
+			}
+			buf = append(buf, ':')
+			if buf, err = appendJCS(buf, val[k], exact); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, '}'), nil
+	case []interface{}:
+		buf = append(buf, '[')
+		for i, item := range val {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			var err error
+			if buf, err = appendJCS(buf, item, exact); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, ']'), nil
+	default:
+		b, err := json.Marshal(val)
+		if err != nil {
+			return nil, fmt.Errorf("jcs: %w", err)
+		}
+		var decoded interface{}
+		if err := DecodeJSON(b, &decoded); err != nil {
+			return nil, fmt.Errorf("jcs: %w", err)
+		}
+		return appendJCS(buf, decoded, exact)
+	}
+}
+
+// appendJCSString escapes only '"', '\\' and control characters, using the
+// short forms where JSON has them and lower-case \u00xx otherwise.
+func appendJCSString(buf []byte, s string) ([]byte, error) {
+	if !utf8.ValidString(s) {
+		return nil, errors.New("jcs: string is not valid UTF-8")
+	}
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c == '\b':
+			buf = append(buf, '\\', 'b')
+		case c == '\t':
+			buf = append(buf, '\\', 't')
+		case c == '\n':
+			buf = append(buf, '\\', 'n')
+		case c == '\f':
+			buf = append(buf, '\\', 'f')
+		case c == '\r':
+			buf = append(buf, '\\', 'r')
+		case c < 0x20:
+			buf = append(buf, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return append(buf, '"'), nil
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJCSNumber formats f as ECMAScript's Number.prototype.toString: the
+// shortest digits that round-trip, in plain notation for decimal exponents
+// from -6 to 20 and in exponent notation otherwise.
+func appendJCSNumber(buf []byte, f float64) ([]byte, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("jcs: %v is not a JSON number", f)
+	}
+	if f == 0 {
+		return append(buf, '0'), nil
+	}
+	if f < 0 {
+		buf = append(buf, '-')
+		f = -f
+	}
+	mantissa, exp, _ := strings.Cut(strconv.FormatFloat(f, 'e', -1, 64), "e")
+	digits := strings.Replace(mantissa, ".", "", 1)
+	e, err := strconv.Atoi(exp)
+	if err != nil {
+		return nil, err
+	}
+	// The value is 0.digits * 10^n.
+	n, k := e+1, len(digits)
+	switch {
+	case k <= n && n <= 21:
+		buf = append(buf, digits...)
+		buf = append(buf, strings.Repeat("0", n-k)...)
+	case 0 < n && n <= 21:
+		buf = append(buf, digits[:n]...)
+		buf = append(buf, '.')
+		buf = append(buf, digits[n:]...)
+	case -6 < n && n <= 0:
+		buf = append(buf, "0."...)
+		buf = append(buf, strings.Repeat("0", -n)...)
+		buf = append(buf, digits...)
+	default:
+		buf = append(buf, digits[0])
+		if k > 1 {
+			buf = append(buf, '.')
+			buf = append(buf, digits[1:]...)
+		}
+		buf = append(buf, 'e')
+		if n-1 >= 0 {
+			buf = append(buf, '+')
+		}
+		buf = strconv.AppendInt(buf, int64(n-1), 10)
+	}
+	return buf, nil
+}
+
+// appendJCSInteger writes an integer literal exactly. Up to 2^53 this is what
+// RFC 8785 produces; beyond that JCS writes the nearest double, which lets
+// the hash cover a different amount than the one stored.
+func appendJCSInteger(buf []byte, n json.Number) ([]byte, error) {
+	i, ok := new(big.Int).SetString(string(n), 10)
+	if !ok {
+		return nil, fmt.Errorf("jcs: number %q is not an integer", n)
+	}
+	return i.Append(buf, 10), nil
+}
+
+// lessUTF16 orders strings by their UTF-16 code units, as RFC 8785 sorts
+// object members. It differs from byte order only where characters above
+// U+FFFF are involved.
+func lessUTF16(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
@@ -0,0 +1,496 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// audit.kv is a single append-only key/value file. Every entry is framed as
+//
+//	crc32(key+value) uint32 | key length uint16 | value length uint32 | key | value
+//
+// with big-endian integers and a JSON value. Keys are "genesis",
+// "record/<index>", "root/<n>", "checkpoint/<n>" and "head"; a later "head"
+// replaces an earlier one. Data keys live in keys.json next to the file instead, since an
+// append-only file could never forget a shredded key. Opening the file reads every frame once to rebuild the in-memory key
+// directory, after which a record is one positioned read away.
+
+const kvHeaderSize = 10
+
+// kvMaxValue bounds a frame's value. A header claiming more is damage, not
+// a write cut short, and is never treated as a torn tail.
+const kvMaxValue = 16 << 20
+
+const (
+	kvRecord     = "record/"
+	kvRoot       = "root/"
+	kvCheckpoint = "checkpoint/"
+	kvHead       = "head"
+	kvGenesis    = "genesis"
+)
+
+// kvEntry locates one frame in the file.
+type kvEntry struct {
+	offset int64
+	size   int64
+}
+
+type kvBackend struct {
+	mu           sync.Mutex
+	path         string
+	recoveryPath string
+	durable      bool
+
+	file   *appendFile
+	reader *os.File
+	size   int64
+
+	records     []kvEntry
+	roots       []RootRecord
+	checkpoints []Checkpoint
+	head        *TrustedState
+	genesis     *Genesis
+	keysPath    string
+	recovery    *Recovery
+	closed      bool
+}
+
+// openKVBackend loads the key directory of the file at path. A frame cut
+// short at the end of the file by a crash is quarantined in recovery.log and
+// removed; a bad frame anywhere else is an error.
+func openKVBackend(path string, durable bool) (*kvBackend, error) {
+	b := &kvBackend{
+		path:         path,
+		recoveryPath: filepath.Join(filepath.Dir(path), recoveryLogName),
+		keysPath:     filepath.Join(filepath.Dir(path), dataKeysName),
+		durable:      durable,
+	}
+	reader, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	b.reader = reader
+	if err := b.load(); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	if b.file, err = openAppendFile(path); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *kvBackend) load() error {
+	info, err := b.reader.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(b.reader, 0, info.Size()))
+	var offset int64
+	for offset < info.Size() {
+		key, value, err := readKVFrame(r)
+		if err != nil {
+			return b.recoverTail(offset, info.Size(), err)
+		}
+		entry := kvEntry{offset: offset, size: kvHeaderSize + int64(len(key)+len(value))}
+		if err := b.index(key, value, entry); err != nil {
+			return fmt.Errorf("%s at offset %d: %w", filepath.Base(b.path), offset, err)
+		}
+		offset += entry.size
+	}
+	b.size = offset
+	return nil
+}
+
+// index adds one decoded frame to the key directory.
+func (b *kvBackend) index(key string, value []byte, entry kvEntry) error {
+	switch {
+	case strings.HasPrefix(key, kvRecord):
+		if want := fmt.Sprintf("%s%d", kvRecord, len(b.records)+1); key != want {
+			return fmt.Errorf("key %q out of order, want %q", key, want)
+		}
+		b.records = append(b.records, entry)
+	case strings.HasPrefix(key, kvRoot):
+		var root RootRecord
+		if err := json.Unmarshal(value, &root); err != nil {
+			return err
+		}
+		b.roots = append(b.roots, root)
+	case strings.HasPrefix(key, kvCheckpoint):
+		var c Checkpoint
+		if err := json.Unmarshal(value, &c); err != nil {
+			return err
+		}
+		b.checkpoints = append(b.checkpoints, c)
+	case key == kvHead:
+		var head TrustedState
+		if err := json.Unmarshal(value, &head); err != nil {
+			return err
+		}
+		b.head = &head
+	case key == kvGenesis:
+		if b.genesis != nil || len(b.records) > 0 {
+			return errors.New("genesis after the start of the log")
+		}
+		var g Genesis
+		if err := json.Unmarshal(value, &g); err != nil {
+			return err
+		}
+		b.genesis = &g
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+	return nil
+}
+
+// recoverTail handles a frame at offset that did not read back. Only the
+// last write can be torn, so the damaged frame must reach the end of the
+// file; the bytes are kept in the quarantine file before they are cut.
+func (b *kvBackend) recoverTail(offset, size int64, cause error) error {
+	if !errors.Is(cause, io.ErrUnexpectedEOF) && !kvFrameEndsAt(b.reader, offset, size) {
+		return fmt.Errorf("%s at offset %d: %w", filepath.Base(b.path), offset, cause)
+	}
+	tail := make([]byte, size-offset)
+	if _, err := b.reader.ReadAt(tail, offset); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(tail)
+	b.recovery = &Recovery{
+		File:       filepath.Base(b.path),
+		Offset:     offset,
+		Size:       int64(len(tail)),
+		SHA256:     hex.EncodeToString(sum[:]),
+		Data:       tail,
+		DetectedAt: time.Now().UTC(),
+	}
+	if err := appendJSONLine(b.recoveryPath, b.recovery, true); err != nil {
+		return fmt.Errorf("quarantine torn entry: %w", err)
+	}
+	if err := b.reader.Truncate(offset); err != nil {
+		return err
+	}
+	b.size = offset
+	return b.reader.Sync()
+}
+
+// kvFrameEndsAt reports whether the frame header at offset claims exactly
+// the rest of the file.
+func kvFrameEndsAt(file *os.File, offset, size int64) bool {
+	var header [kvHeaderSize]byte
+	if _, err := file.ReadAt(header[:], offset); err != nil {
+		return false
+	}
+	keyLen := int64(binary.BigEndian.Uint16(header[4:6]))
+	valLen := int64(binary.BigEndian.Uint32(header[6:10]))
+	return offset+kvHeaderSize+keyLen+valLen == size
+}
+
+var (
+	errKVChecksum = errors.New("entry checksum mismatch")
+	errKVSize     = errors.New("entry length out of range")
+)
+
+func readKVFrame(r io.Reader) (string, []byte, error) {
+	var header [kvHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", nil, unexpectedEOF(err)
+	}
+	keyLen := binary.BigEndian.Uint16(header[4:6])
+	valLen := binary.BigEndian.Uint32(header[6:10])
+	if valLen > kvMaxValue {
+		return "", nil, errKVSize
+	}
+	body := make([]byte, int(keyLen)+int(valLen))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return "", nil, unexpectedEOF(err)
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[0:4]) {
+		return "", nil, errKVChecksum
+	}
+	return string(body[:keyLen]), body[keyLen:], nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func encodeKVFrame(key string, v interface{}) ([]byte, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, kvHeaderSize, kvHeaderSize+len(key)+len(value))
+	frame = append(append(frame, key...), value...)
+	binary.BigEndian.PutUint32(frame[0:4], crc32.ChecksumIEEE(frame[kvHeaderSize:]))
+	binary.BigEndian.PutUint16(frame[4:6], uint16(len(key)))
+	binary.BigEndian.PutUint32(frame[6:10], uint32(len(value)))
+	return frame, nil
+}
+
+// put appends one entry. The caller holds b.mu.
+func (b *kvBackend) put(key string, v interface{}, sync bool) (kvEntry, error) {
+	if b.closed {
+		return kvEntry{}, ErrClosed
+	}
+	frame, err := encodeKVFrame(key, v)
+	if err != nil {
+		return kvEntry{}, err
+	}
+	if _, err := b.file.Write(frame); err != nil {
+		return kvEntry{}, err
+	}
+	entry := kvEntry{offset: b.size, size: int64(len(frame))}
+	b.size += entry.size
+	if sync {
+		return entry, b.file.Sync()
+	}
+	return entry, nil
+}
+
+func (b *kvBackend) Base() (LogHead, error) {
+	return LogHead{}, nil
+}
+
+func (b *kvBackend) Replay(visit func(Record) error) error {
+	return b.Scan(visit)
+}
+
+func (b *kvBackend) Head() (*TrustedState, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.head == nil {
+		return nil, nil
+	}
+	head := *b.head
+	return &head, nil
+}
+
+func (b *kvBackend) AppendRecord(rec Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, err := b.put(fmt.Sprintf("%s%d", kvRecord, rec.Index), rec, false)
+	if err != nil {
+		return err
+	}
+	b.records = append(b.records, entry)
+	return nil
+}
+
+func (b *kvBackend) AppendRoot(root RootRecord, head LogHead) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.put(fmt.Sprintf("%s%d", kvRoot, len(b.roots)+1), root, b.durable); err != nil {
+		return err
+	}
+	b.roots = append(b.roots, root)
+	return b.file.Flush()
+}
+
+func (b *kvBackend) AppendCheckpoint(c Checkpoint) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.put(fmt.Sprintf("%s%d", kvCheckpoint, len(b.checkpoints)+1), c, b.durable); err != nil {
+		return err
+	}
+	b.checkpoints = append(b.checkpoints, c)
+	return b.file.Flush()
+}
+
+func (b *kvBackend) SaveHead(state TrustedState) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.put(kvHead, state, b.durable); err != nil {
+		return err
+	}
+	b.head = &state
+	return b.file.Flush()
+}
+
+// entries flushes pending writes and returns the frames of records
+// from..to, clamped to what the file holds.
+func (b *kvBackend) entries(from, to int64) ([]kvEntry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		if err := b.file.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	if to > int64(len(b.records)) {
+		to = int64(len(b.records))
+	}
+	if from > to {
+		return nil, nil
+	}
+	return b.records[from-1 : to : to], nil
+}
+
+func (b *kvBackend) ReadRange(from, to int64) ([]Record, error) {
+	entries, err := b.entries(from, to)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Record, 0, len(entries))
+	for _, entry := range entries {
+		rec, err := b.readRecord(entry)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+func (b *kvBackend) readRecord(entry kvEntry) (Record, error) {
+	r := io.NewSectionReader(b.reader, entry.offset, entry.size)
+	_, value, err := readKVFrame(r)
+	if err != nil {
+		return Record{}, fmt.Errorf("%s at offset %d: %w", filepath.Base(b.path), entry.offset, err)
+	}
+	var rec Record
+	if err := DecodeJSON(value, &rec); err != nil {
+		return Record{}, err
+	}
+	return rec, nil
+}
+
+func (b *kvBackend) ReadTail(limit int) ([]Record, error) {
+	b.mu.Lock()
+	last := int64(len(b.records))
+	b.mu.Unlock()
+	from, to := tailRange(last, limit)
+	if to == 0 {
+		return []Record{}, nil
+	}
+	return b.ReadRange(from, to)
+}
+
+func (b *kvBackend) Scan(visit func(Record) error) error {
+	entries, err := b.entries(1, 1<<62)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		rec, err := b.readRecord(entry)
+		if err != nil {
+			return err
+		}
+		if err := visit(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *kvBackend) Roots() ([]RootRecord, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]RootRecord{}, b.roots...), nil
+}
+
+func (b *kvBackend) LastRoot() (*RootRecord, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.roots) == 0 {
+		return nil, nil
+	}
+	last := b.roots[len(b.roots)-1]
+	return &last, nil
+}
+
+func (b *kvBackend) Checkpoints() ([]Checkpoint, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Checkpoint(nil), b.checkpoints...), nil
+}
+
+func (b *kvBackend) DataKeys() ([]DataKey, error) {
+	return readDataKeys(b.keysPath)
+}
+
+func (b *kvBackend) SaveDataKeys(keys []DataKey) error {
+	return writeDataKeys(b.keysPath, keys)
+}
+
+func (b *kvBackend) Genesis() (*Genesis, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.genesis == nil {
+		return nil, nil
+	}
+	g := *b.genesis
+	return &g, nil
+}
+
+func (b *kvBackend) SaveGenesis(g Genesis) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.put(kvGenesis, g, true); err != nil {
+		return err
+	}
+	b.genesis = &g
+	return b.file.Flush()
+}
+
+// Recovery reports the torn entry quarantined when the backend was opened.
+func (b *kvBackend) Recovery() *Recovery {
+	return b.recovery
+}
+
+func (b *kvBackend) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	return b.file.Flush()
+}
+
+// Sync flushes pending entries under the lock and fsyncs outside it, like
+// the file backend, so group commit can keep appending meanwhile.
+func (b *kvBackend) Sync() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	file, err := b.file.file, b.file.Flush()
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+func (b *kvBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	err := b.file.Close()
+	if cerr := b.reader.Close(); err == nil {
+		err = cerr
+	}
+	b.closed = true
+	return err
+}
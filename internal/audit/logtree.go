@@ -0,0 +1,384 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+)
+
+// The log tree covers every record hash in the log, not just one batch, so
+// clients can check that a later log state extends an earlier one. It follows
+// RFC 6962: leaves and interior nodes are hashed with distinct prefixes and
+// an n-leaf tree splits at the largest power of two below n.
+
+func logLeafHash(alg HashAlgorithm, leaf []byte) []byte {
+	h := alg.new()
+	h.Write([]byte{0x00})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+func logNodeHash(alg HashAlgorithm, left, right []byte) []byte {
+	h := alg.new()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// LogRoot computes the log tree root over a slice of hex record hashes.
+func LogRoot(alg HashAlgorithm, hashes []string) (string, error) {
+	if len(hashes) == 0 {
+		return "", nil
+	}
+	leaves, err := decodeHashes(hashes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(treeHash(alg, leaves)), nil
+}
+
+// LogConsistencyProof returns the RFC 6962 consistency proof between the
+// first m leaves of hashes and all of them.
+func LogConsistencyProof(alg HashAlgorithm, hashes []string, m int) ([]string, error) {
+	if m <= 0 || m > len(hashes) {
+		return nil, fmt.Errorf("size %d out of range for %d leaves", m, len(hashes))
+	}
+	leaves, err := decodeHashes(hashes)
+	if err != nil {
+		return nil, err
+	}
+	proof := subProof(alg, m, leaves, true)
+	out := make([]string, len(proof))
+	for i, p := range proof {
+		out[i] = hex.EncodeToString(p)
+	}
+	return out, nil
+}
+
+// VerifyLogConsistency checks that newRoot (size n) is an append-only
+// extension of oldRoot (size m) using the RFC 9162 verification algorithm.
+func VerifyLogConsistency(alg HashAlgorithm, m, n int64, oldRoot, newRoot string, proof []string) bool {
+	if m <= 0 || m > n {
+		return false
+	}
+	if m == n {
+		return len(proof) == 0 && oldRoot == newRoot
+	}
+	first, err := hex.DecodeString(oldRoot)
+	if err != nil {
+		return false
+	}
+	second, err := hex.DecodeString(newRoot)
+	if err != nil {
+		return false
+	}
+	path, err := decodeHashes(proof)
+	if err != nil || len(path) == 0 {
+		return false
+	}
+	if m&(m-1) == 0 {
+		path = append([][]byte{first}, path...)
+	}
+	fn, sn := m-1, n-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := path[0], path[0]
+	for _, c := range path[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = logNodeHash(alg, c, fr)
+			sr = logNodeHash(alg, c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = logNodeHash(alg, sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(fr, first) && bytes.Equal(sr, second)
+}
+
+// LogInclusionProof returns the RFC 6962 audit path for hashes[index].
+func LogInclusionProof(alg HashAlgorithm, hashes []string, index int) ([]string, error) {
+	if index < 0 || index >= len(hashes) {
+		return nil, fmt.Errorf("leaf %d out of range for %d leaves", index, len(hashes))
+	}
+	leaves, err := decodeHashes(hashes)
+	if err != nil {
+		return nil, err
+	}
+	path := auditPath(alg, index, leaves)
+	out := make([]string, len(path))
+	for i, p := range path {
+		out[i] = hex.EncodeToString(p)
+	}
+	return out, nil
+}
+
+// VerifyLogInclusion checks an RFC 6962 audit path using the RFC 9162
+// verification algorithm.
+func VerifyLogInclusion(alg HashAlgorithm, leaf string, index, size int64, path []string, root string) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	leafBytes, err := hex.DecodeString(leaf)
+	if err != nil {
+		return false
+	}
+	nodes, err := decodeHashes(path)
+	if err != nil {
+		return false
+	}
+	fn, sn := index, size-1
+	r := logLeafHash(alg, leafBytes)
+	for _, p := range nodes {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = logNodeHash(alg, p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = logNodeHash(alg, r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && hex.EncodeToString(r) == root
+}
+
+func auditPath(alg HashAlgorithm, index int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := splitPoint(len(leaves))
+	if index < k {
+		return append(auditPath(alg, index, leaves[:k]), treeHash(alg, leaves[k:]))
+	}
+	return append(auditPath(alg, index-k, leaves[k:]), treeHash(alg, leaves[:k]))
+}
+
+func treeHash(alg HashAlgorithm, leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return logLeafHash(alg, leaves[0])
+	}
+	k := splitPoint(len(leaves))
+	return logNodeHash(alg, treeHash(alg, leaves[:k]), treeHash(alg, leaves[k:]))
+}
+
+func subProof(alg HashAlgorithm, m int, leaves [][]byte, complete bool) [][]byte {
+	n := len(leaves)
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{treeHash(alg, leaves)}
+	}
+	k := splitPoint(n)
+	if m <= k {
+		return append(subProof(alg, m, leaves[:k], complete), treeHash(alg, leaves[k:]))
+	}
+	return append(subProof(alg, m-k, leaves[k:], false), treeHash(alg, leaves[:k]))
+}
+
+// splitPoint returns the largest power of two strictly smaller than n.
+func splitPoint(n int) int {
+	return 1 << (bits.Len(uint(n-1)) - 1)
+}
+
+func decodeHashes(hashes []string) ([][]byte, error) {
+	out := make([][]byte, len(hashes))
+	for i, h := range hashes {
+		b, err := hex.DecodeString(h)
+		if err != nil {
+			return nil, fmt.Errorf("decode hash %d: %w", i, err)
+		}
+		out[i] = b
+	}
+	return out, nil
+}
+
+// logTree is a compact range over the log tree: it keeps only the roots of
+// the perfect subtrees on the right edge, so appends and root computation
+// need O(log n) memory regardless of log size. It covers the records of one
+// epoch, hashed with the epoch's algorithm; size still counts every record
+// of the log.
+type logTree struct {
+	epoch Epoch
+	size  int64
+	stack [][]byte
+}
+
+func (t *logTree) push(hash string) error {
+	leaf, err := hex.DecodeString(hash)
+	if err != nil {
+		return fmt.Errorf("decode hash: %w", err)
+	}
+	node := logLeafHash(t.epoch.HashAlgorithm, leaf)
+	for s := t.size - t.epoch.Start; s&1 == 1; s >>= 1 {
+		node = logNodeHash(t.epoch.HashAlgorithm, t.stack[len(t.stack)-1], node)
+		t.stack = t.stack[:len(t.stack)-1]
+	}
+	t.stack = append(t.stack, node)
+	t.size++
+	return nil
+}
+
+func (t *logTree) root() string {
+	if len(t.stack) == 0 {
+		return ""
+	}
+	acc := t.stack[len(t.stack)-1]
+	for i := len(t.stack) - 2; i >= 0; i-- {
+		acc = logNodeHash(t.epoch.HashAlgorithm, t.stack[i], acc)
+	}
+	return hex.EncodeToString(acc)
+}
+
+// subtreeBits sets the smallest subtree a subtreeCache keeps: 1<<subtreeBits
+// leaves.
+const subtreeBits = 6
+
+// subtreeCache keeps the hash of every complete, aligned subtree of one
+// epoch's log tree that spans at least 1<<subtreeBits leaves, about one byte
+// per record. Any subtree hash is then a few cached nodes plus, at most, the
+// leaves of one block, so a consistency proof reads two blocks of records
+// instead of the whole log.
+type subtreeCache struct {
+	epoch Epoch
+	size  int64
+	// block holds the leaves of the incomplete block at the end.
+	block [][]byte
+	// levels[i][j] covers leaves j<<(subtreeBits+i) up to (j+1)<<(subtreeBits+i).
+	levels [][][]byte
+}
+
+// pushSubtree adds rec to the cache of its epoch, starting the next epoch's
+// cache where the hash algorithm changes.
+func pushSubtree(caches []*subtreeCache, rec Record) ([]*subtreeCache, error) {
+	alg := rec.HashAlgorithm.normalize()
+	if len(caches) == 0 {
+		caches = append(caches, &subtreeCache{epoch: Epoch{HashAlgorithm: alg}})
+	} else if last := caches[len(caches)-1].epoch; last.HashAlgorithm != alg {
+		caches = append(caches, &subtreeCache{epoch: Epoch{Number: last.Number + 1, Start: rec.Index - 1, HashAlgorithm: alg}})
+	}
+	return caches, caches[len(caches)-1].push(rec.Hash)
+}
+
+func (c *subtreeCache) push(hash string) error {
+	leaf, err := hex.DecodeString(hash)
+	if err != nil {
+		return fmt.Errorf("decode hash: %w", err)
+	}
+	c.block = append(c.block, leaf)
+	c.size++
+	if len(c.block) == 1<<subtreeBits {
+		c.add(0, treeHash(c.epoch.HashAlgorithm, c.block))
+		c.block = nil
+	}
+	return nil
+}
+
+func (c *subtreeCache) add(level int, node []byte) {
+	if level == len(c.levels) {
+		c.levels = append(c.levels, nil)
+	}
+	nodes := append(c.levels[level], node)
+	c.levels[level] = nodes
+	if n := len(nodes); n%2 == 0 {
+		c.add(level+1, logNodeHash(c.epoch.HashAlgorithm, nodes[n-2], nodes[n-1]))
+	}
+}
+
+// snapshot returns a copy that later pushes to c do not change. The cached
+// levels only grow, so their backing arrays are shared.
+func (c *subtreeCache) snapshot() *subtreeCache {
+	out := *c
+	out.block = nil
+	out.levels = append([][][]byte(nil), c.levels...)
+	return &out
+}
+
+// subtreeHash returns the tree hash of leaves lo up to hi, which must be a
+// subtree of the RFC 6962 tree over the first c.size leaves. blockLeaves
+// loads the leaves of block b for the parts below the cached levels.
+func (c *subtreeCache) subtreeHash(lo, hi int64, blockLeaves func(b int64) ([][]byte, error)) ([]byte, error) {
+	alg := c.epoch.HashAlgorithm
+	size := hi - lo
+	if size >= 1<<subtreeBits && size&(size-1) == 0 {
+		level := bits.TrailingZeros64(uint64(size))
+		return c.levels[level-subtreeBits][lo>>level], nil
+	}
+	if size > 1<<subtreeBits {
+		k := int64(splitPoint(int(size)))
+		left, err := c.subtreeHash(lo, lo+k, blockLeaves)
+		if err != nil {
+			return nil, err
+		}
+		right, err := c.subtreeHash(lo+k, hi, blockLeaves)
+		if err != nil {
+			return nil, err
+		}
+		return logNodeHash(alg, left, right), nil
+	}
+	// A subtree this small never crosses a block boundary.
+	b := lo >> subtreeBits
+	leaves, err := blockLeaves(b)
+	if err != nil {
+		return nil, err
+	}
+	off := b << subtreeBits
+	if hi-off > int64(len(leaves)) {
+		return nil, fmt.Errorf("block %d has %d leaves, need %d", b, len(leaves), hi-off)
+	}
+	return treeHash(alg, leaves[lo-off:hi-off]), nil
+}
+
+// consistencyPath is subProof over the cached tree: the RFC 6962
+// consistency proof between the first m leaves of lo..hi and all of them.
+func (c *subtreeCache) consistencyPath(m, lo, hi int64, complete bool, blockLeaves func(b int64) ([][]byte, error)) ([][]byte, error) {
+	n := hi - lo
+	if m == n {
+		if complete {
+			return nil, nil
+		}
+		node, err := c.subtreeHash(lo, hi, blockLeaves)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{node}, nil
+	}
+	k := int64(splitPoint(int(n)))
+	var (
+		path [][]byte
+		node []byte
+		err  error
+	)
+	if m <= k {
+		if path, err = c.consistencyPath(m, lo, lo+k, complete, blockLeaves); err != nil {
+			return nil, err
+		}
+		node, err = c.subtreeHash(lo+k, hi, blockLeaves)
+	} else {
+		if path, err = c.consistencyPath(m-k, lo+k, hi, false, blockLeaves); err != nil {
+			return nil, err
+		}
+		node, err = c.subtreeHash(lo, lo+k, blockLeaves)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(path, node), nil
+}
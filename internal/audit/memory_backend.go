@@ -0,0 +1,161 @@
+package audit
+
+import "sync"
+
+// memoryBackend keeps the log in process memory. It is meant for tests and
+// for running the chain logic without touching disk. Close keeps the
+// contents, so a new Store opened on the same backend replays them.
+type memoryBackend struct {
+	mu          sync.RWMutex
+	records     []Record
+	roots       []RootRecord
+	checkpoints []Checkpoint
+	head        *TrustedState
+	dataKeys    []DataKey
+	genesis     *Genesis
+}
+
+// NewMemoryBackend returns an empty in-memory Backend.
+func NewMemoryBackend() Backend {
+	return newMemoryBackend()
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{}
+}
+
+func (b *memoryBackend) Base() (LogHead, error) {
+	return LogHead{}, nil
+}
+
+func (b *memoryBackend) Replay(visit func(Record) error) error {
+	return b.Scan(visit)
+}
+
+func (b *memoryBackend) Head() (*TrustedState, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.head == nil {
+		return nil, nil
+	}
+	head := *b.head
+	return &head, nil
+}
+
+func (b *memoryBackend) AppendRecord(rec Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.records = append(b.records, rec)
+	return nil
+}
+
+func (b *memoryBackend) AppendRoot(root RootRecord, head LogHead) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roots = append(b.roots, root)
+	return nil
+}
+
+func (b *memoryBackend) AppendCheckpoint(c Checkpoint) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.checkpoints = append(b.checkpoints, c)
+	return nil
+}
+
+func (b *memoryBackend) SaveHead(state TrustedState) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.head = &state
+	return nil
+}
+
+func (b *memoryBackend) ReadRange(from, to int64) ([]Record, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if to > int64(len(b.records)) {
+		to = int64(len(b.records))
+	}
+	if from > to {
+		return []Record{}, nil
+	}
+	return append([]Record(nil), b.records[from-1:to]...), nil
+}
+
+func (b *memoryBackend) ReadTail(limit int) ([]Record, error) {
+	b.mu.RLock()
+	last := int64(len(b.records))
+	b.mu.RUnlock()
+	from, to := tailRange(last, limit)
+	return b.ReadRange(from, to)
+}
+
+func (b *memoryBackend) Scan(visit func(Record) error) error {
+	b.mu.RLock()
+	records := b.records[:len(b.records):len(b.records)]
+	b.mu.RUnlock()
+	for _, rec := range records {
+		if err := visit(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackend) Roots() ([]RootRecord, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]RootRecord{}, b.roots...), nil
+}
+
+func (b *memoryBackend) LastRoot() (*RootRecord, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.roots) == 0 {
+		return nil, nil
+	}
+	last := b.roots[len(b.roots)-1]
+	return &last, nil
+}
+
+func (b *memoryBackend) Checkpoints() ([]Checkpoint, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]Checkpoint(nil), b.checkpoints...), nil
+}
+
+func (b *memoryBackend) DataKeys() ([]DataKey, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]DataKey(nil), b.dataKeys...), nil
+}
+
+func (b *memoryBackend) SaveDataKeys(keys []DataKey) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dataKeys = append([]DataKey(nil), keys...)
+	return nil
+}
+
+func (b *memoryBackend) Genesis() (*Genesis, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.genesis == nil {
+		return nil, nil
+	}
+	g := *b.genesis
+	return &g, nil
+}
+
+func (b *memoryBackend) SaveGenesis(g Genesis) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.genesis = &g
+	return nil
+}
+
+func (b *memoryBackend) Flush() error { return nil }
+
+func (b *memoryBackend) Sync() error { return nil }
+
+func (b *memoryBackend) Close() error { return nil }
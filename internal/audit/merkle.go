@@ -1,12 +1,68 @@
 package audit
 
 import (
-	"crypto/sha256"
+	"bytes"
 	"encoding/hex"
+	"fmt"
 )
 
-// MerkleRoot computes a binary Merkle root from a slice of hex hashes.
-func MerkleRoot(hashes []string) string {
+// Batch tree versions recorded in RootRecord.TreeVersion.
+const (
+	// TreeV1 is the original construction: leaves and nodes are hashed the
+	// same way and odd levels duplicate their last node. Root records
+	// written before versioning carry no version and are read as TreeV1.
+	TreeV1 = 1
+	// TreeV2 is the RFC 6962 construction also used by the log tree: leaf
+	// and node hashes are domain separated and nothing is duplicated.
+	TreeV2 = 2
+
+	DefaultTreeVersion = TreeV2
+)
+
+// BatchRoot computes the root of a batch under the given hash algorithm and
+// tree version.
+func BatchRoot(alg HashAlgorithm, version int, hashes []string) string {
+	if normalizeTreeVersion(version) == TreeV1 {
+		return MerkleRoot(alg, hashes)
+	}
+	root, err := LogRoot(alg, hashes)
+	if err != nil {
+		return ""
+	}
+	return root
+}
+
+// BatchProof returns the audit path for hashes[index] under the given tree version.
+func BatchProof(alg HashAlgorithm, version int, hashes []string, index int) ([]string, error) {
+	if normalizeTreeVersion(version) == TreeV1 {
+		return MerkleProof(alg, hashes, index)
+	}
+	return LogInclusionProof(alg, hashes, index)
+}
+
+// VerifyBatchProof checks an audit path produced by BatchProof.
+func VerifyBatchProof(alg HashAlgorithm, version int, leaf string, index, size int, path []string, root string) bool {
+	if normalizeTreeVersion(version) == TreeV1 {
+		return VerifyMerkleProof(alg, leaf, index, size, path, root)
+	}
+	return VerifyLogInclusion(alg, leaf, int64(index), int64(size), path, root)
+}
+
+func normalizeTreeVersion(version int) int {
+	if version == 0 {
+		return TreeV1
+	}
+	return version
+}
+
+func validTreeVersion(version int) bool {
+	v := normalizeTreeVersion(version)
+	return v == TreeV1 || v == TreeV2
+}
+
+// MerkleRoot computes a binary Merkle root from a slice of hex hashes using
+// the TreeV1 construction.
+func MerkleRoot(alg HashAlgorithm, hashes []string) string {
 	if len(hashes) == 0 {
 		return ""
 	}
@@ -28,16 +84,89 @@ func MerkleRoot(hashes []string) string {
 			} else {
 				right = left
 			}
-			next = append(next, hashPair(left, right))
+			next = append(next, hashPair(alg, left, right))
 		}
 		level = next
 	}
 	return hex.EncodeToString(level[0])
 }
 
-func hashPair(left, right []byte) []byte {
-	h := sha256.New()
+func hashPair(alg HashAlgorithm, left, right []byte) []byte {
+	h := alg.new()
 	h.Write(left)
 	h.Write(right)
 	return h.Sum(nil)
 }
+
+// MerkleProof returns the audit path (sibling hashes, leaf level first) that
+// links hashes[index] to MerkleRoot(hashes).
+func MerkleProof(alg HashAlgorithm, hashes []string, index int) ([]string, error) {
+	if index < 0 || index >= len(hashes) {
+		return nil, fmt.Errorf("leaf %d out of range for %d leaves", index, len(hashes))
+	}
+	level := make([][]byte, 0, len(hashes))
+	for _, h := range hashes {
+		b, err := hex.DecodeString(h)
+		if err != nil {
+			return nil, fmt.Errorf("decode leaf: %w", err)
+		}
+		level = append(level, b)
+	}
+	var path []string
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			// Odd levels duplicate their last node, so it is its own sibling.
+			sibling = index
+		}
+		path = append(path, hex.EncodeToString(level[sibling]))
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			left := level[i]
+			right := left
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			next = append(next, hashPair(alg, left, right))
+		}
+		level = next
+		index /= 2
+	}
+	return path, nil
+}
+
+// VerifyMerkleProof recomputes the root of a size-leaf batch from leaf, its
+// position and its audit path, and compares it against root.
+func VerifyMerkleProof(alg HashAlgorithm, leaf string, index, size int, path []string, root string) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	current, err := hex.DecodeString(leaf)
+	if err != nil {
+		return false
+	}
+	for size > 1 {
+		if len(path) == 0 {
+			return false
+		}
+		sibling, err := hex.DecodeString(path[0])
+		if err != nil {
+			return false
+		}
+		path = path[1:]
+		switch {
+		case index%2 == 1:
+			current = hashPair(alg, sibling, current)
+		case index+1 == size:
+			if !bytes.Equal(sibling, current) {
+				return false
+			}
+			current = hashPair(alg, current, current)
+		default:
+			current = hashPair(alg, current, sibling)
+		}
+		index /= 2
+		size = (size + 1) / 2
+	}
+	return len(path) == 0 && hex.EncodeToString(current) == root
+}
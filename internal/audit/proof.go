@@ -0,0 +1,230 @@
+package audit
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrRecordNotFound is returned when a requested index is not in the log.
+	ErrRecordNotFound = errors.New("record not found")
+	// ErrNotSealed is returned when a record is not yet covered by a batch root.
+	ErrNotSealed = errors.New("record not covered by a sealed batch")
+)
+
+// InclusionProof builds the audit path for the record at index against the
+// root of the sealed batch that contains it.
+func (s *Store) InclusionProof(index int64) (InclusionProof, error) {
+	s.mu.Lock()
+	lastIndex := s.lastIndex
+	s.mu.Unlock()
+	if index <= 0 || index > lastIndex {
+		return InclusionProof{}, ErrRecordNotFound
+	}
+
+	roots, err := s.backend.Roots()
+	if err != nil {
+		return InclusionProof{}, err
+	}
+	var batch *RootRecord
+	for i := range roots {
+		if roots[i].FromIndex <= index && index <= roots[i].ToIndex {
+			batch = &roots[i]
+			break
+		}
+	}
+	if batch == nil {
+		return InclusionProof{}, ErrNotSealed
+	}
+
+	records, err := s.storedRecords(batch.FromIndex, batch.ToIndex)
+	if err != nil {
+		return InclusionProof{}, err
+	}
+	hashes := make([]string, len(records))
+	for i, rec := range records {
+		hashes[i] = rec.Hash
+	}
+	leaf := int(index - batch.FromIndex)
+	path, err := BatchProof(batch.HashAlgorithm, batch.TreeVersion, hashes, leaf)
+	if err != nil {
+		return InclusionProof{}, err
+	}
+	return InclusionProof{
+		Record:        records[leaf].Redact(),
+		FromIndex:     batch.FromIndex,
+		ToIndex:       batch.ToIndex,
+		TreeVersion:   batch.TreeVersion,
+		HashAlgorithm: batch.HashAlgorithm,
+		Path:          path,
+		RootHash:      batch.RootHash,
+	}, nil
+}
+
+// VerifyInclusion checks a proof offline: the record hash must recompute
+// from its event and the audit path must lead to the batch root, both under
+// the batch's hash algorithm.
+func VerifyInclusion(p InclusionProof) error {
+	rec := p.Record
+	if rec.Index < p.FromIndex || rec.Index > p.ToIndex {
+		return fmt.Errorf("record %d outside batch %d-%d", rec.Index, p.FromIndex, p.ToIndex)
+	}
+	alg := p.HashAlgorithm.normalize()
+	if !alg.valid() {
+		return fmt.Errorf("unknown hash algorithm %q", p.HashAlgorithm)
+	}
+	if rec.HashAlgorithm.normalize() != alg {
+		return fmt.Errorf("record %d hashed with %s, batch with %s", rec.Index, rec.HashAlgorithm.normalize(), alg)
+	}
+	payload, err := CanonicalEvent(rec.HashScheme, rec.StoredEvent())
+	if err != nil {
+		return fmt.Errorf("canonicalize: %w", err)
+	}
+	if computed := recordHash(alg, rec.PrevHash, rec.Index, payload); computed != rec.Hash {
+		return fmt.Errorf("hash mismatch at %d", rec.Index)
+	}
+	leaf := int(rec.Index - p.FromIndex)
+	size := int(p.ToIndex - p.FromIndex + 1)
+	if !validTreeVersion(p.TreeVersion) {
+		return fmt.Errorf("unknown tree version %d", p.TreeVersion)
+	}
+	if !VerifyBatchProof(alg, p.TreeVersion, rec.Hash, leaf, size, p.Path, p.RootHash) {
+		return fmt.Errorf("audit path does not lead to root %s", p.RootHash)
+	}
+	return nil
+}
+
+// ConsistencyProof proves that the log at size to extends the log at size
+// from. A to of zero means the current log size. Both sizes must lie in the
+// same epoch, past its link record; across epochs it returns
+// ErrEpochBoundary.
+func (s *Store) ConsistencyProof(from, to int64) (ConsistencyProof, error) {
+	s.mu.Lock()
+	size := s.tree.size
+	s.mu.Unlock()
+	if to == 0 {
+		to = size
+	}
+	if from <= 0 || from > to || to > size {
+		return ConsistencyProof{}, fmt.Errorf("%w: sizes %d..%d for log of %d", ErrRecordNotFound, from, to, size)
+	}
+
+	cache, err := s.subtreeCache(to)
+	if err != nil {
+		return ConsistencyProof{}, err
+	}
+	epoch := cache.epoch
+	if from <= epoch.Start {
+		return ConsistencyProof{}, fmt.Errorf("%w: epoch %d starts after size %d, proof from %d", ErrEpochBoundary, epoch.Number, epoch.Start, from)
+	}
+	m, n := from-epoch.Start, to-epoch.Start
+	blocks := make(map[int64][][]byte)
+	blockLeaves := func(b int64) ([][]byte, error) {
+		if leaves, ok := blocks[b]; ok {
+			return leaves, nil
+		}
+		first := epoch.Start + b<<subtreeBits + 1
+		last := first + 1<<subtreeBits - 1
+		if last > to {
+			last = to
+		}
+		records, err := s.storedRecords(first, last)
+		if err != nil {
+			return nil, err
+		}
+		leaves := make([][]byte, len(records))
+		for i, rec := range records {
+			if leaves[i], err = hex.DecodeString(rec.Hash); err != nil {
+				return nil, fmt.Errorf("record %d: decode hash: %w", rec.Index, err)
+			}
+		}
+		blocks[b] = leaves
+		return leaves, nil
+	}
+	fromNode, err := cache.subtreeHash(0, m, blockLeaves)
+	if err != nil {
+		return ConsistencyProof{}, err
+	}
+	toNode, err := cache.subtreeHash(0, n, blockLeaves)
+	if err != nil {
+		return ConsistencyProof{}, err
+	}
+	nodes, err := cache.consistencyPath(m, 0, n, true, blockLeaves)
+	if err != nil {
+		return ConsistencyProof{}, err
+	}
+	path := make([]string, len(nodes))
+	for i, node := range nodes {
+		path[i] = hex.EncodeToString(node)
+	}
+	fromRoot, toRoot := hex.EncodeToString(fromNode), hex.EncodeToString(toNode)
+	return ConsistencyProof{
+		FromSize:      from,
+		ToSize:        to,
+		FromRoot:      fromRoot,
+		ToRoot:        toRoot,
+		HashAlgorithm: epoch.HashAlgorithm.recorded(),
+		EpochStart:    epoch.Start,
+		Path:          path,
+	}, nil
+}
+
+// VerifyConsistency checks a consistency proof offline.
+func VerifyConsistency(p ConsistencyProof) error {
+	alg := p.HashAlgorithm.normalize()
+	if !alg.valid() {
+		return fmt.Errorf("unknown hash algorithm %q", p.HashAlgorithm)
+	}
+	if p.EpochStart < 0 || p.FromSize <= p.EpochStart {
+		return fmt.Errorf("size %d is not in the epoch starting after %d", p.FromSize, p.EpochStart)
+	}
+	if !VerifyLogConsistency(alg, p.FromSize-p.EpochStart, p.ToSize-p.EpochStart, p.FromRoot, p.ToRoot, p.Path) {
+		return fmt.Errorf("log at size %d is not an extension of size %d", p.ToSize, p.FromSize)
+	}
+	return nil
+}
+
+// subtreeCache returns a snapshot of the cached log tree of the epoch that
+// size falls in. The first call reads the whole log once to build the
+// caches; appends keep them current after that.
+func (s *Store) subtreeCache(size int64) (*subtreeCache, error) {
+	caches := []*subtreeCache{}
+	var built int64
+	for {
+		s.mu.Lock()
+		if s.subtrees == nil && built == s.lastIndex {
+			s.subtrees = caches
+		}
+		if s.subtrees != nil {
+			defer s.mu.Unlock()
+			for i := len(s.subtrees) - 1; i >= 0; i-- {
+				if c := s.subtrees[i]; c.epoch.Start < size {
+					return c.snapshot(), nil
+				}
+			}
+			return nil, fmt.Errorf("%w: size %d", ErrRecordNotFound, size)
+		}
+		target := s.lastIndex
+		s.mu.Unlock()
+
+		// Read outside the lock, in chunks, then catch up with whatever was
+		// appended meanwhile.
+		for from := built + 1; from <= target; from += chunkRecords {
+			to := from + chunkRecords - 1
+			if to > target {
+				to = target
+			}
+			records, err := s.storedRecords(from, to)
+			if err != nil {
+				return nil, err
+			}
+			for _, rec := range records {
+				if caches, err = pushSubtree(caches, rec); err != nil {
+					return nil, err
+				}
+			}
+		}
+		built = target
+	}
+}
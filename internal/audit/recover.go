@@ -0,0 +1,189 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// IncidentRecovery is the event type the store appends after quarantining a
+// torn record, so the repair itself is part of the evidence.
+const IncidentRecovery = "audit.recovery"
+
+// Recovery describes a torn trailing record removed from the live file. The
+// bytes are kept verbatim in the quarantine file.
+type Recovery struct {
+	File       string    `json:"file"`
+	Offset     int64     `json:"offset"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	Data       []byte    `json:"data"`
+	DetectedAt time.Time `json:"detected_at"`
+	// IncidentIndex is the log index of the incident record. It is only
+	// known once the store has appended it, so it is not in the quarantine
+	// file.
+	IncidentIndex int64 `json:"incident_index,omitempty"`
+}
+
+// recoverTornTail looks at the end of the log file at path. In a JSON-lines
+// file that is the bytes after the last newline: a complete record that only
+// lost its newline is terminated in place. In a binary file it is the last
+// frame, if it is short or fails its checksum. Anything found is a write cut
+// short by a crash, which is copied to quarantinePath and then cut from the
+// log. Damage anywhere before that is left for verification to report. An
+// empty file is taken to be in format def.
+func recoverTornTail(path, quarantinePath string, def LogFormat) (*Recovery, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	format, err := detectFormat(file, def)
+	if err != nil {
+		return nil, err
+	}
+	var start int64
+	if format == FormatBinary {
+		start, err = lastFrameStart(file)
+	} else {
+		start, err = lastLineStart(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if start == info.Size() {
+		return nil, nil
+	}
+	tail := make([]byte, info.Size()-start)
+	if _, err := file.ReadAt(tail, start); err != nil {
+		return nil, err
+	}
+
+	var rec Record
+	if format == FormatJSON {
+		if err := json.Unmarshal(tail, &rec); err == nil && rec.Index > 0 && rec.Hash != "" {
+			if _, err := file.WriteAt([]byte("\n"), info.Size()); err != nil {
+				return nil, err
+			}
+			return nil, file.Sync()
+		}
+	}
+
+	sum := sha256.Sum256(tail)
+	r := &Recovery{
+		File:       filepath.Base(path),
+		Offset:     start,
+		Size:       int64(len(tail)),
+		SHA256:     hex.EncodeToString(sum[:]),
+		Data:       tail,
+		DetectedAt: time.Now().UTC(),
+	}
+	if err := appendJSONLine(quarantinePath, r, true); err != nil {
+		return nil, fmt.Errorf("quarantine torn record: %w", err)
+	}
+	if err := file.Truncate(start); err != nil {
+		return nil, err
+	}
+	return r, file.Sync()
+}
+
+// lastFrameStart returns the offset of the last frame of a binary log if it
+// was cut short or fails its checksum, and the file size otherwise. Zeros a
+// file system left past the last write read as empty frames, which no
+// record encodes to, and are cut as well. A file too short to hold the
+// header has lost the header itself.
+func lastFrameStart(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < FormatBinary.headerSize() {
+		return 0, nil
+	}
+	zeros := int64(-1)
+	scanner := newFrameScanner(io.NewSectionReader(file, 0, info.Size()), FormatBinary, 0)
+	for scanner.Scan() {
+		frame := scanner.Bytes()
+		if len(bytes.Trim(frame, "\x00")) == 0 {
+			if zeros < 0 {
+				zeros = scanner.Offset()
+			}
+			continue
+		}
+		zeros = -1
+		if scanner.End() < info.Size() {
+			continue
+		}
+		_, err := decodeFrame(FormatBinary, frame)
+		if errors.Is(err, errFrameTruncated) || errors.Is(err, errFrameChecksum) {
+			return scanner.Offset(), nil
+		}
+	}
+	if zeros >= 0 {
+		return zeros, scanner.Err()
+	}
+	return info.Size(), scanner.Err()
+}
+
+// lastLineStart returns the offset just past the last newline in file, or
+// zero if it has none, reading backwards from the end.
+func lastLineStart(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	const chunk = 64 * 1024
+	buf := make([]byte, chunk)
+	for end := info.Size(); end > 0; {
+		n := int64(chunk)
+		if end < n {
+			n = end
+		}
+		if _, err := file.ReadAt(buf[:n], end-n); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			return end - n + int64(i) + 1, nil
+		}
+		end -= n
+	}
+	return 0, nil
+}
+
+// logRecovery appends the incident record for a quarantined torn record.
+func (s *Store) logRecovery(r *Recovery) error {
+	rec, _, err := s.AppendEvent(Event{
+		Type:   IncidentRecovery,
+		Source: "assurance-service",
+		Payload: map[string]interface{}{
+			"file":       r.File,
+			"offset":     r.Offset,
+			"size":       r.Size,
+			"sha256":     r.SHA256,
+			"quarantine": recoveryLogName,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("log recovery incident: %w", err)
+	}
+	r.IncidentIndex = rec.Index
+	return nil
+}
+
+// Recovery reports the torn record quarantined when the store was opened,
+// or nil if the log ended cleanly.
+func (s *Store) Recovery() *Recovery {
+	return s.recovery
+}
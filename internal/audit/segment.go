@@ -0,0 +1,243 @@
+package audit
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The event log is a set of files: zero or more sealed segments named
+// events-NNNNNN.log, listed in order in segments.json, followed by the live
+// events.log. Segments only ever rotate at a batch boundary, so every batch
+// root covers records of a single file, and the hash chain simply continues
+// from the last record of one file into the first record of the next.
+
+const manifestName = "segments.json"
+
+// Segment describes one sealed, read-only part of the event log. The chain
+// head and log tree state at its last record let the store start without
+// reading it and let a verifier check it was not replaced. Epoch records
+// the hash algorithm of that tree; manifests written before epochs existed
+// have none, which reads as epoch 0 under HashSHA256.
+type Segment struct {
+	Seq        int       `json:"seq"`
+	File       string    `json:"file"`
+	FirstIndex int64     `json:"first_index"`
+	LastIndex  int64     `json:"last_index"`
+	LastHash   string    `json:"last_hash"`
+	TreeRoot   string    `json:"tree_root"`
+	TreeNodes  []string  `json:"tree_nodes"`
+	Epoch      Epoch     `json:"epoch"`
+	Size       int64     `json:"size"`
+	SealedAt   time.Time `json:"sealed_at"`
+	// Compression is set once the segment has been replaced by its
+	// compressed form; Size stays the plain size, which record offsets
+	// refer to.
+	Compression    string `json:"compression,omitempty"`
+	CompressedSize int64  `json:"compressed_size,omitempty"`
+}
+
+// Manifest lists the sealed segments of a log in order.
+type Manifest struct {
+	Segments []Segment `json:"segments"`
+}
+
+func segmentFile(seq int) string {
+	return fmt.Sprintf("events-%06d.log", seq)
+}
+
+// indexFile names the offset index that belongs to an event log file. A
+// compressed segment shares the index of its plain file.
+func indexFile(logPath string) string {
+	logPath = strings.TrimSuffix(logPath, gzipSuffix)
+	return logPath[:len(logPath)-len(filepath.Ext(logPath))] + ".idx"
+}
+
+// ManifestPath returns the segment manifest that sits next to eventsPath.
+func ManifestPath(eventsPath string) string {
+	return filepath.Join(filepath.Dir(eventsPath), manifestName)
+}
+
+// ReadManifest reads a segment manifest, returning an empty one if the file
+// does not exist.
+func ReadManifest(path string) (Manifest, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Manifest{}, nil
+	}
+	if err != nil {
+		return Manifest{}, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Manifest{}, err
+	}
+	return m, nil
+}
+
+// SegmentFiles returns every file of the log that ends in eventsPath, oldest
+// first: the sealed segments from the manifest, then eventsPath itself.
+func SegmentFiles(eventsPath string) ([]string, error) {
+	m, err := ReadManifest(ManifestPath(eventsPath))
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(eventsPath)
+	files := make([]string, 0, len(m.Segments)+1)
+	for _, seg := range m.Segments {
+		files = append(files, filepath.Join(dir, seg.File))
+	}
+	return append(files, eventsPath), nil
+}
+
+func (t logTree) nodes() []string {
+	out := make([]string, len(t.stack))
+	for i, node := range t.stack {
+		out[i] = hex.EncodeToString(node)
+	}
+	return out
+}
+
+func treeFromNodes(epoch Epoch, size int64, nodes []string) logTree {
+	tree := logTree{epoch: epoch.normalize(), size: size}
+	for _, node := range nodes {
+		b, _ := hex.DecodeString(node)
+		tree.stack = append(tree.stack, b)
+	}
+	return tree
+}
+
+// shouldRotate reports whether the live file has reached a rotation limit.
+// It is only consulted right after a batch seals.
+func (b *fileBackend) shouldRotate() bool {
+	if b.lastIndex < b.liveFirst {
+		return false
+	}
+	return (b.segmentMaxBytes > 0 && b.eventsSize >= b.segmentMaxBytes) ||
+		(b.segmentMaxBatches > 0 && b.segmentBatches >= b.segmentMaxBatches)
+}
+
+// rotate seals the live file, which ends at head, as the next numbered
+// segment. The manifest is written first; openFileBackend finishes the
+// renames if the process stops between the two steps. The caller holds b.mu.
+func (b *fileBackend) rotate(head LogHead) error {
+	seq := len(b.manifest.Segments) + 1
+	seg := Segment{
+		Seq:        seq,
+		File:       segmentFile(seq),
+		FirstIndex: b.liveFirst,
+		LastIndex:  head.Index,
+		LastHash:   head.Hash,
+		TreeRoot:   head.TreeRoot,
+		TreeNodes:  head.TreeNodes,
+		Epoch:      head.Epoch,
+		Size:       b.eventsSize,
+		SealedAt:   time.Now().UTC(),
+	}
+	if err := b.syncLiveLocked(); err != nil {
+		return fmt.Errorf("sync events: %w", err)
+	}
+	manifest := Manifest{Segments: append(append([]Segment(nil), b.manifest.Segments...), seg)}
+	if err := writeJSONFile(b.manifestPath, manifest, b.durable); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	b.manifest = manifest
+	if err := b.events.Close(); err != nil {
+		return err
+	}
+	if err := b.index.Close(); err != nil {
+		return err
+	}
+	if err := b.moveLiveFile(seg); err != nil {
+		return err
+	}
+	b.eventsSize = 0
+	b.liveFormat = b.format
+	if err := b.openLive(); err != nil {
+		b.closed = true
+		return err
+	}
+	if b.durable {
+		if err := syncPath(b.dataDir); err != nil {
+			return fmt.Errorf("sync data dir: %w", err)
+		}
+	}
+	b.liveFirst = head.Index + 1
+	b.segmentBatches = 0
+	return nil
+}
+
+func (b *fileBackend) moveLiveFile(seg Segment) error {
+	path := filepath.Join(b.dataDir, seg.File)
+	if err := os.Rename(b.eventsPath, path); err != nil {
+		return fmt.Errorf("seal segment %d: %w", seg.Seq, err)
+	}
+	if err := os.Rename(b.indexPath, indexFile(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("seal segment %d index: %w", seg.Seq, err)
+	}
+	return nil
+}
+
+// recoverRotation completes a rotation that was recorded in the manifest but
+// stopped before the live file was renamed. A missing segment whose records
+// are not in events.log has been archived and is left alone.
+func (b *fileBackend) recoverRotation() error {
+	if len(b.manifest.Segments) == 0 {
+		return nil
+	}
+	last := b.manifest.Segments[len(b.manifest.Segments)-1]
+	if _, err := os.Stat(filepath.Join(b.dataDir, last.File)); !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	info, err := os.Stat(b.eventsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() != last.Size {
+		return nil
+	}
+	var rec Record
+	err = scanLogFile(b.eventsPath, func(r Record) error {
+		rec = r
+		return nil
+	})
+	if err != nil || rec.Index != last.LastIndex || rec.Hash != last.LastHash {
+		return nil
+	}
+	return b.moveLiveFile(last)
+}
+
+// logFile is one file of the log and the range of records it holds.
+type logFile struct {
+	path  string
+	first int64
+	last  int64
+}
+
+// files returns the log files that hold records from..to, flushing the
+// live file's buffers so they can be read.
+func (b *fileBackend) files(from, to int64) ([]logFile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.flushLocked(); err != nil {
+		return nil, err
+	}
+	var out []logFile
+	for _, seg := range b.manifest.Segments {
+		if seg.LastIndex >= from && seg.FirstIndex <= to {
+			out = append(out, logFile{path: filepath.Join(b.dataDir, seg.File), first: seg.FirstIndex, last: seg.LastIndex})
+		}
+	}
+	if b.lastIndex >= b.liveFirst && to >= b.liveFirst {
+		out = append(out, logFile{path: b.eventsPath, first: b.liveFirst, last: b.lastIndex})
+	}
+	return out, nil
+}
@@ -0,0 +1,99 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+)
+
+// EventShred is the event type the store appends after destroying a
+// subject's keys.
+const EventShred = "audit.shred"
+
+var (
+	// ErrNoMasterKey is returned by Shred on a store opened without a
+	// master key.
+	ErrNoMasterKey = errors.New("store has no master key")
+	// ErrSubjectNotFound is returned by Shred when no key is filed under
+	// the subject.
+	ErrSubjectNotFound = errors.New("no keys for subject")
+)
+
+// ShredResult describes one Shred.
+type ShredResult struct {
+	SubjectID string   `json:"subject_id"`
+	Keys      []string `json:"keys"`
+	// Records counts the records sealed under the destroyed keys, which
+	// can no longer be decrypted.
+	Records    int64 `json:"records"`
+	EventIndex int64 `json:"event_index"`
+}
+
+// Shred erases a subject's data by deleting every data key filed under it
+// from the key store. The records stay in the log, sealed, so their hashes,
+// roots and checkpoints still verify; only their payloads become
+// unreadable. The shred is then logged as an EventShred record naming the
+// subject only by its pseudonym. Keys are destroyed before the event is
+// appended: if the append fails the shred has still happened and the error
+// says so.
+func (s *Store) Shred(subject, reason string) (ShredResult, error) {
+	s.mu.Lock()
+	if s.keys == nil {
+		s.mu.Unlock()
+		return ShredResult{}, ErrNoMasterKey
+	}
+	result := ShredResult{SubjectID: s.keys.subjectID(subject), Keys: []string{}}
+	remaining := make([]DataKey, 0, len(s.keys.keys))
+	for _, k := range s.keys.keys {
+		if s.keys.filedUnder(k, subject) {
+			result.Keys = append(result.Keys, k.ID)
+		} else {
+			remaining = append(remaining, k)
+		}
+	}
+	if len(result.Keys) == 0 {
+		s.mu.Unlock()
+		return result, fmt.Errorf("%w %s", ErrSubjectNotFound, result.SubjectID)
+	}
+	if err := s.backend.SaveDataKeys(remaining); err != nil {
+		s.mu.Unlock()
+		return result, fmt.Errorf("save data keys: %w", err)
+	}
+	for _, id := range result.Keys {
+		s.keys.drop(id)
+	}
+	s.mu.Unlock()
+
+	shredded := make(map[string]bool, len(result.Keys))
+	for _, id := range result.Keys {
+		shredded[id] = true
+	}
+	err := s.backend.Scan(func(rec Record) error {
+		if env := sealedEnvelope(rec.Event.Payload); env != nil && shredded[env.Key] {
+			result.Records++
+		}
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("keys destroyed, count records: %w", err)
+	}
+
+	keys := make([]interface{}, len(result.Keys))
+	for i, id := range result.Keys {
+		keys[i] = id
+	}
+	rec, _, err := s.AppendEvent(Event{
+		Type:   EventShred,
+		Source: "assurance-service",
+		Payload: map[string]interface{}{
+			"subject_id": result.SubjectID,
+			"keys":       keys,
+			"records":    result.Records,
+			"reason":     reason,
+		},
+	})
+	if err != nil {
+		return result, fmt.Errorf("keys destroyed, log shred event: %w", err)
+	}
+	result.EventIndex = rec.Index
+	return result, nil
+}
@@ -0,0 +1,42 @@
+package audit
+
+import "fmt"
+
+// EventShutdown is the event type of the marker record Shutdown appends.
+const EventShutdown = "audit.shutdown"
+
+// Shutdown ends a run of the store. It appends an EventShutdown marker
+// naming reason, seals the open batch with it, short if need be, so that
+// every record is covered by a root and, with a signing key, by a final
+// signed checkpoint, and then closes the store. Appends that arrive later
+// fail with ErrClosed. The marker shows in the log where a run ended
+// cleanly; a run that ends without one crashed or was killed.
+func (s *Store) Shutdown(reason string) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return Record{}, ErrClosed
+	}
+	rec, _, err := s.appendLocked(Event{
+		Type:   EventShutdown,
+		Source: "assurance-service",
+		Payload: map[string]interface{}{
+			"reason":          reason,
+			"pending_records": len(s.batchHashes),
+		},
+	}, false)
+	if err != nil {
+		if s.failed != nil {
+			// A failed store cannot log its shutdown; release it as
+			// Close would, leaving the repair to the next open.
+			s.closeLocked()
+		}
+		return rec, fmt.Errorf("log shutdown: %w", err)
+	}
+	if len(s.batchHashes) > 0 {
+		if _, err := s.sealBatchLocked(SealShutdown); err != nil {
+			return rec, fmt.Errorf("seal batch: %w", err)
+		}
+	}
+	return rec, s.closeLocked()
+}
@@ -2,164 +2,757 @@ package audit
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
 	"sync"
 	"time"
 )
 
+// ErrTruncated is returned when the log ends before a trusted high-water mark.
+var ErrTruncated = errors.New("log truncated")
+
 type Store struct {
 	mu          sync.Mutex
-	dataDir     string
-	eventsPath  string
-	rootsPath   string
+	backend     Backend
 	batchSize   int
+	treeVersion int
+	hashScheme  int
+	signingKey  ed25519.PrivateKey
+	genesis     *Genesis
+	keys        *keyRing
+	// subjectField names the payload field whose value selects a subject
+	// key; see Shred.
+	subjectField string
+	// commitFields are hashed as salted commitments; see Redact.
+	commitFields []string
+
 	lastIndex   int64
 	lastHash    string
 	batchHashes []string
 	batchStart  int64
+	tree        logTree
+	// maxBatchAge, when set, seals the open batch that long after its first
+	// record; ageTimer is armed while a batch is open, and ageErr keeps the
+	// first error of a seal it ran for Close to report.
+	maxBatchAge time.Duration
+	batchOpened time.Time
+	ageTimer    *time.Timer
+	ageErr      error
+	checkpoint  *Checkpoint
+	recovery    *Recovery
+	// subtrees caches every epoch's log tree for consistency proofs; nil
+	// until the first proof builds it.
+	subtrees []*subtreeCache
+
+	durability Durability
+	group      *groupCommit
+	written    uint64
+	closed     bool
+	// failed is the error that left the backend holding records the store
+	// may not know about; see failLocked.
+	failed error
+	// syncHead saves the high-water mark at every sync and on Close as well
+	// as when a batch seals; see saveHead. headMu orders those saves, which group
+	// commit makes without s.mu, and savedHead is the last index saved.
+	syncHead  bool
+	headMu    sync.Mutex
+	savedHead int64
+}
+
+// Options configures a Store beyond its data directory.
+type Options struct {
+	// BatchSize is the number of records per batch of a new log. A log with
+	// a genesis header keeps the size it names.
+	BatchSize int
+	// TreeVersion selects the batch tree construction for a new log. An
+	// existing log keeps the version recorded in its genesis or root
+	// records.
+	TreeVersion int
+	// HashScheme selects the event serialization new records are hashed
+	// over, DefaultHashScheme if zero. Each record carries its scheme, so
+	// a log can mix them.
+	HashScheme int
+	// HashAlgorithm selects the hash function of a new log,
+	// DefaultHashAlgorithm if empty. An existing log keeps the algorithm of
+	// its current epoch; StartEpoch moves it to another.
+	HashAlgorithm HashAlgorithm
+	// MaxBatchAge, when set, seals a batch that long after its first record
+	// was appended even if it is not full, so no record waits longer for a
+	// root and checkpoint. Zero seals only full batches.
+	MaxBatchAge time.Duration
+	// SigningKey, when set, signs a checkpoint over the log tree every time
+	// a batch seals.
+	SigningKey ed25519.PrivateKey
+	// SegmentMaxBytes and SegmentMaxBatches rotate events.log into a sealed
+	// segment once it reaches either limit. Zero disables that limit. They
+	// only apply to the file storage engine.
+	SegmentMaxBytes   int64
+	SegmentMaxBatches int
+	// Durability selects when AppendEvent returns; see DurabilityNone,
+	// DurabilityFsync and DurabilityGroup. The zero value is DurabilityNone.
+	Durability Durability
+	// Storage selects the storage engine: StorageFile (the default),
+	// StorageKV or StorageMemory. Backend, when set, is used instead.
+	Storage string
+	Backend Backend
+	// LogFormat is the record encoding for new log files of the file
+	// engine, FormatJSON by default. A live file already holding records
+	// keeps its format until it is rotated.
+	LogFormat LogFormat
+	// SegmentCompression, when set to CompressionGzip, compresses sealed
+	// segments of the file engine in the background after they rotate.
+	SegmentCompression string
+	// MasterKey, when set, encrypts event payloads at rest under a data key
+	// per segment wrapped by this 32-byte key; see LoadOrCreateMasterKey.
+	MasterKey []byte
+	// SubjectField, with MasterKey, seals each payload that has this field
+	// under a key of its own for the field's value, so Shred can erase one
+	// subject's data.
+	SubjectField string
+	// CommitFields lists payload fields hashed as salted commitments rather
+	// than their values, so records can be served or exported without them
+	// and still verify; see Record.Redact.
+	CommitFields []string
 }
 
 func NewStore(dataDir string, batchSize int) (*Store, error) {
+	return OpenStore(dataDir, Options{BatchSize: batchSize})
+}
+
+func OpenStore(dataDir string, opts Options) (*Store, error) {
 	if dataDir == "" {
 		dataDir = "./data"
 	}
-	if batchSize <= 0 {
-		batchSize = 100
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
 	}
-	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+	if opts.TreeVersion == 0 {
+		opts.TreeVersion = DefaultTreeVersion
+	}
+	if !validTreeVersion(opts.TreeVersion) {
+		return nil, fmt.Errorf("unknown tree version %d", opts.TreeVersion)
+	}
+	if opts.HashScheme == 0 {
+		opts.HashScheme = DefaultHashScheme
+	}
+	if !validHashScheme(opts.HashScheme) {
+		return nil, fmt.Errorf("unknown hash scheme %d", opts.HashScheme)
+	}
+	hashAlg, err := ParseHashAlgorithm(string(opts.HashAlgorithm))
+	if err != nil {
 		return nil, err
 	}
+	durability, err := ParseDurability(string(opts.Durability))
+	if err != nil {
+		return nil, err
+	}
+	if opts.LogFormat, err = ParseLogFormat(string(opts.LogFormat)); err != nil {
+		return nil, err
+	}
+	if opts.SegmentCompression, err = ParseCompression(opts.SegmentCompression); err != nil {
+		return nil, err
+	}
+	if opts.SubjectField != "" && opts.MasterKey == nil {
+		return nil, errors.New("subject keys need a master key")
+	}
+	backend := opts.Backend
+	if backend == nil {
+		if err := os.MkdirAll(dataDir, 0o755); err != nil {
+			return nil, err
+		}
+		durable := durability == DurabilityFsync || durability == DurabilityGroup
+		if backend, err = openBackend(dataDir, opts, durable); err != nil {
+			return nil, err
+		}
+	}
 	store := &Store{
-		dataDir:    dataDir,
-		eventsPath: filepath.Join(dataDir, "events.log"),
-		rootsPath:  filepath.Join(dataDir, "roots.log"),
-		batchSize:  batchSize,
+		backend:     backend,
+		batchSize:   opts.BatchSize,
+		treeVersion: opts.TreeVersion,
+		hashScheme:  opts.HashScheme,
+		signingKey:  opts.SigningKey,
+		maxBatchAge: opts.MaxBatchAge,
+		tree:        logTree{epoch: Epoch{HashAlgorithm: hashAlg}},
+
+		subjectField: opts.SubjectField,
+		commitFields: opts.CommitFields,
+		durability:   durability,
+		group:        newGroupCommit(),
 	}
+	// Only a head kept apart from the records shows records cut from the
+	// end of the log; one appended to the same file is cut with them.
+	_, store.syncHead = backend.(*fileBackend)
 	if err := store.loadState(); err != nil {
+		backend.Close()
 		return nil, err
 	}
+	if err := store.loadGenesis(opts); err != nil {
+		backend.Close()
+		return nil, err
+	}
+	if opts.MasterKey != nil {
+		if err := store.loadKeys(opts.MasterKey); err != nil {
+			backend.Close()
+			return nil, err
+		}
+	}
+	if len(store.batchHashes) > 0 {
+		// A batch left open by the last run keeps the age of its first
+		// record, so a restart cannot postpone its seal.
+		store.mu.Lock()
+		store.armAgeLocked()
+		store.mu.Unlock()
+	}
+	if r, ok := backend.(interface{ Recovery() *Recovery }); ok {
+		store.recovery = r.Recovery()
+	}
+	if store.recovery != nil {
+		if err := store.logRecovery(store.recovery); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
 	return store, nil
 }
 
+// AppendEvent adds event to the log and returns once the record has reached
+// the store's durability point.
 func (s *Store) AppendEvent(event Event) (Record, *RootRecord, error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	rec, root, err := s.appendLocked(event, false)
+	seq := s.written
+	s.mu.Unlock()
+	if err != nil || s.durability != DurabilityGroup {
+		return rec, root, err
+	}
+	if err := s.group.wait(seq, s.syncEvents); err != nil {
+		return rec, root, fmt.Errorf("sync events: %w", err)
+	}
+	return rec, root, nil
+}
 
+// appendLocked appends event as the next record. A link record (see
+// StartEpoch) is neither committed nor encrypted: verifiers read it to follow
+// the log into its new epoch.
+func (s *Store) appendLocked(event Event, link bool) (Record, *RootRecord, error) {
+	if s.closed {
+		return Record{}, nil, ErrClosed
+	}
+	if s.failed != nil {
+		return Record{}, nil, fmt.Errorf("%w: %v", ErrFailed, s.failed)
+	}
 	if event.Timestamp.IsZero() {
 		event.Timestamp = time.Now().UTC()
 	}
+	if _, ok := event.Payload[sealedField]; ok {
+		return Record{}, nil, ErrReservedPayload
+	}
 	index := s.lastIndex + 1
-	payload, err := StableJSON(event)
+	stored := event
+	var disclosures map[string]Disclosure
+	if !link {
+		committed, d, err := commitFields(event.Payload, s.commitFields, s.hashScheme)
+		if err != nil {
+			return Record{}, nil, err
+		}
+		stored.Payload, disclosures = committed, d
+	}
+	storedDisclosures := disclosures
+	var sealed *SealedPayload
+	if s.keys != nil && event.Payload != nil && !link {
+		env, sealedDisclosures, err := s.sealLocked(index, stored, disclosures)
+		if err != nil {
+			return Record{}, nil, fmt.Errorf("encrypt payload: %w", err)
+		}
+		sealed = &env
+		stored.Payload = env.payload()
+		storedDisclosures = sealedDisclosures
+	}
+	payload, err := CanonicalEvent(s.hashScheme, stored)
 	if err != nil {
 		return Record{}, nil, err
 	}
+	alg := s.tree.epoch.HashAlgorithm
 	rec := Record{
-		Index:     index,
-		Timestamp: time.Now().UTC(),
-		Event:     event,
-		PrevHash:  s.lastHash,
-		Hash:      hashBytes([]byte(s.lastHash), []byte(fmt.Sprintf("|%d|", index)), payload),
+		Index:         index,
+		Timestamp:     time.Now().UTC(),
+		Event:         stored,
+		PrevHash:      s.lastHash,
+		Hash:          recordHash(alg, s.lastHash, index, payload),
+		HashScheme:    s.hashScheme,
+		HashAlgorithm: alg.recorded(),
+		Disclosures:   storedDisclosures,
 	}
 
-	if err := appendJSONLine(s.eventsPath, rec); err != nil {
-		return Record{}, nil, err
+	if err := s.backend.AppendRecord(rec); err != nil {
+		return Record{}, nil, s.failLocked(err)
+	}
+	// Group commit leaves the record buffered for the next shared sync.
+	switch s.durability {
+	case DurabilityNone:
+		err = s.backend.Flush()
+	case DurabilityFsync:
+		err = s.backend.Sync()
 	}
+	if err != nil {
+		return Record{}, nil, s.failLocked(err)
+	}
+	s.written++
 
+	if err := s.tree.push(rec.Hash); err != nil {
+		return rec, nil, err
+	}
+	if s.subtrees != nil {
+		if s.subtrees, err = pushSubtree(s.subtrees, rec); err != nil {
+			return rec, nil, err
+		}
+	}
 	s.lastIndex = rec.Index
 	s.lastHash = rec.Hash
 
 	if len(s.batchHashes) == 0 {
 		s.batchStart = rec.Index
+		s.batchOpened = rec.Timestamp
+		s.armAgeLocked()
 	}
 	s.batchHashes = append(s.batchHashes, rec.Hash)
 
 	var root *RootRecord
 	if len(s.batchHashes) >= s.batchSize {
-		r := RootRecord{
-			FromIndex: s.batchStart,
-			ToIndex:   rec.Index,
-			RootHash:  MerkleRoot(s.batchHashes),
-			CreatedAt: time.Now().UTC(),
-		}
-		if r.RootHash != "" {
-			if err := appendJSONLine(s.rootsPath, r); err != nil {
-				return rec, nil, err
-			}
-			root = &r
+		if root, err = s.sealBatchLocked(""); err != nil {
+			return rec, root, err
+		}
+	} else if s.durability == DurabilityFsync && s.syncHead {
+		if err := s.saveHead(s.headLocked()); err != nil {
+			return rec, nil, fmt.Errorf("save high-water mark: %w", err)
 		}
-		s.batchHashes = nil
-		s.batchStart = 0
 	}
 
+	rec.Event, rec.Sealed, rec.Disclosures = event, sealed, disclosures
 	return rec, root, nil
 }
 
+// failLocked stops appends after err hit a record on its way to the backend.
+// The record may be there in part or in full, so the next one can neither
+// reuse its index nor chain to it; only reopening, which replays and repairs
+// what the backend holds, finds out which. The caller holds s.mu.
+func (s *Store) failLocked(err error) error {
+	if s.failed == nil {
+		s.failed = err
+	}
+	return err
+}
+
+// Reasons a batch is sealed before it is full; see RootRecord.SealReason.
+const (
+	SealMaxAge   = "max_age"
+	SealEpoch    = "epoch"
+	SealShutdown = "shutdown"
+)
+
+func validSealReason(reason string) bool {
+	return reason == SealMaxAge || reason == SealEpoch || reason == SealShutdown
+}
+
+// sealBatchLocked writes the root of the open batch, which ends at the last
+// record, then signs a checkpoint and saves the high-water mark. reason is
+// recorded if the batch is short. The caller holds s.mu.
+func (s *Store) sealBatchLocked(reason string) (*RootRecord, error) {
+	s.disarmAgeLocked()
+	alg := s.tree.epoch.HashAlgorithm
+	r := RootRecord{
+		FromIndex:     s.batchStart,
+		ToIndex:       s.lastIndex,
+		RootHash:      BatchRoot(alg, s.treeVersion, s.batchHashes),
+		TreeVersion:   s.treeVersion,
+		HashAlgorithm: alg.recorded(),
+		CreatedAt:     time.Now().UTC(),
+	}
+	if len(s.batchHashes) < s.batchSize {
+		r.SealReason = reason
+	}
+	var root *RootRecord
+	if r.RootHash != "" {
+		if err := s.syncLiveLocked(); err != nil {
+			return nil, fmt.Errorf("sync events: %w", err)
+		}
+		if err := s.backend.AppendRoot(r, s.logHeadLocked()); err != nil {
+			return nil, err
+		}
+		root = &r
+		if err := s.signCheckpoint(); err != nil {
+			return root, err
+		}
+		if err := s.saveHead(s.headLocked()); err != nil {
+			return root, err
+		}
+	}
+	s.batchHashes = nil
+	s.batchStart = 0
+	return root, nil
+}
+
+// armAgeLocked schedules the open batch to be sealed once it is
+// maxBatchAge old. The caller holds s.mu.
+func (s *Store) armAgeLocked() {
+	if s.maxBatchAge <= 0 {
+		return
+	}
+	start := s.batchStart
+	s.ageTimer = time.AfterFunc(time.Until(s.batchOpened.Add(s.maxBatchAge)), func() {
+		s.sealAged(start)
+	})
+}
+
+func (s *Store) disarmAgeLocked() {
+	if s.ageTimer != nil {
+		s.ageTimer.Stop()
+		s.ageTimer = nil
+	}
+}
+
+// sealAged seals the batch starting at start if it is still open: a timer
+// that fired while the batch was being sealed by an append finds another
+// batch, or none, and leaves it alone.
+func (s *Store) sealAged(start int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.failed != nil || len(s.batchHashes) == 0 || s.batchStart != start {
+		return
+	}
+	if _, err := s.sealBatchLocked(SealMaxAge); err != nil && s.ageErr == nil {
+		s.ageErr = fmt.Errorf("seal aged batch %d-%d: %w", start, s.lastIndex, err)
+	}
+}
+
 func (s *Store) LastRoot() (*RootRecord, error) {
-	return readLastRoot(s.rootsPath)
+	return s.backend.LastRoot()
+}
+
+// Roots returns every batch root in log order.
+func (s *Store) Roots() ([]RootRecord, error) {
+	return s.backend.Roots()
 }
 
 func (s *Store) CurrentBatchRoot() string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return MerkleRoot(s.batchHashes)
+	return BatchRoot(s.tree.epoch.HashAlgorithm, s.treeVersion, s.batchHashes)
+}
+
+// TreeVersion reports the batch tree construction this log uses.
+func (s *Store) TreeVersion() int {
+	return s.treeVersion
+}
+
+// LatestCheckpoint returns the most recent signed checkpoint, or nil if the
+// store has no signing key or no batch has sealed yet.
+func (s *Store) LatestCheckpoint() *Checkpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoint
+}
+
+func (s *Store) signCheckpoint() error {
+	if s.signingKey == nil {
+		return nil
+	}
+	c := SignCheckpoint(s.signingKey, s.tree.epoch, s.tree.size, s.tree.root(), time.Now())
+	if err := s.backend.AppendCheckpoint(c); err != nil {
+		return err
+	}
+	s.checkpoint = &c
+	return nil
+}
+
+// HighWater returns the live head of the log. Verifying against it detects
+// records removed from the end of the log while the server is running.
+// Buffered records are flushed first so the head never runs ahead of what
+// readers of the backend see.
+func (s *Store) HighWater() TrustedState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.backend.Flush()
+	return s.headLocked()
+}
+
+// saveHead persists state as the high-water mark unless one at or past its
+// index has been saved already, so saves racing each other never move the
+// mark back. The records up to state.Index must be at least as durable as
+// the mark is about to be.
+func (s *Store) saveHead(state TrustedState) error {
+	s.headMu.Lock()
+	defer s.headMu.Unlock()
+	if state.Index <= s.savedHead {
+		return nil
+	}
+	if err := s.backend.SaveHead(state); err != nil {
+		return err
+	}
+	s.savedHead = state.Index
+	return nil
+}
+
+func (s *Store) headLocked() TrustedState {
+	return TrustedState{
+		Index:     s.lastIndex,
+		Hash:      s.lastHash,
+		TreeRoot:  s.tree.root(),
+		UpdatedAt: time.Now().UTC(),
+	}
+}
+
+func (s *Store) logHeadLocked() LogHead {
+	return LogHead{Index: s.lastIndex, Hash: s.lastHash, TreeRoot: s.tree.root(), TreeNodes: s.tree.nodes(), Epoch: s.tree.epoch}
+}
+
+// TreeHead returns the size and root of the log tree of the current epoch.
+func (s *Store) TreeHead() (int64, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.size, s.tree.root()
+}
+
+// Record reads the record at index.
+func (s *Store) Record(index int64) (Record, error) {
+	records, err := s.Records(index, index)
+	if err != nil {
+		return Record{}, err
+	}
+	return records[0], nil
+}
+
+// Records reads the records from..to inclusive, with their payloads
+// decrypted if the store has the key.
+func (s *Store) Records(from, to int64) ([]Record, error) {
+	out, err := s.storedRecords(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return s.openRecords(out)
+}
+
+// storedRecords reads the records from..to exactly as they were hashed.
+func (s *Store) storedRecords(from, to int64) ([]Record, error) {
+	s.mu.Lock()
+	lastIndex := s.lastIndex
+	s.mu.Unlock()
+	if from <= 0 || from > to || to > lastIndex {
+		return nil, fmt.Errorf("%w: range %d..%d for log of %d", ErrRecordNotFound, from, to, lastIndex)
+	}
+	out, err := s.backend.ReadRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) != to-from+1 {
+		return nil, fmt.Errorf("range %d..%d: found %d records", from, to, len(out))
+	}
+	return out, nil
+}
+
+// Tail returns up to limit of the most recent records, oldest first.
+func (s *Store) Tail(limit int) ([]Record, error) {
+	if limit <= 0 {
+		return []Record{}, nil
+	}
+	out, err := s.backend.ReadTail(limit)
+	if err != nil {
+		return nil, err
+	}
+	return s.openRecords(out)
+}
+
+// Scan visits every readable record in log order, with payloads decrypted
+// where the store has the key.
+func (s *Store) Scan(visit func(Record) error) error {
+	return s.backend.Scan(func(rec Record) error {
+		out, err := s.openRecords([]Record{rec})
+		if err != nil {
+			return err
+		}
+		return visit(out[0])
+	})
+}
+
+func (s *Store) loadKeys(master []byte) error {
+	if len(master) != dataKeySize {
+		return fmt.Errorf("master key must be %d bytes", dataKeySize)
+	}
+	keys, err := s.backend.DataKeys()
+	if err != nil {
+		return fmt.Errorf("read data keys: %w", err)
+	}
+	s.keys, err = newKeyRing(master, keys)
+	return err
 }
 
 func (s *Store) loadState() error {
-	lastRoot, err := readLastRoot(s.rootsPath)
+	lastRoot, err := s.backend.LastRoot()
 	if err != nil {
 		return err
 	}
+	checkpoints, err := s.backend.Checkpoints()
+	if err != nil {
+		return fmt.Errorf("read checkpoints: %w", err)
+	}
+	if len(checkpoints) > 0 {
+		s.checkpoint = &checkpoints[len(checkpoints)-1]
+	}
+	head, err := s.backend.Head()
+	if err != nil {
+		return fmt.Errorf("read high-water mark: %w", err)
+	}
+	if head != nil {
+		s.savedHead = head.Index
+	}
 	lastCompletedIndex := int64(0)
 	if lastRoot != nil {
 		lastCompletedIndex = lastRoot.ToIndex
+		s.treeVersion = normalizeTreeVersion(lastRoot.TreeVersion)
 	}
 
-	file, err := os.OpenFile(s.eventsPath, os.O_RDONLY|os.O_CREATE, 0o644)
+	base, err := s.backend.Base()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	if base.Index > 0 {
+		s.lastIndex, s.lastHash = base.Index, base.Hash
+		s.tree = treeFromNodes(base.Epoch, base.Index, base.TreeNodes)
+		if head != nil && head.Index == base.Index {
+			if base.Hash != head.Hash || (head.TreeRoot != "" && base.TreeRoot != head.TreeRoot) {
+				return fmt.Errorf("sealed log at %d diverges from high-water mark", base.Index)
+			}
+		}
+	}
 
-	scanner := bufio.NewScanner(file)
-	scanner.Buffer(make([]byte, 0, 64*1024), 5*1024*1024)
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		if len(line) == 0 {
-			continue
+	err = s.backend.Replay(func(rec Record) error {
+		if alg := rec.HashAlgorithm.normalize(); alg != s.tree.epoch.HashAlgorithm {
+			if !alg.valid() {
+				return fmt.Errorf("record %d: unknown hash algorithm %q", rec.Index, rec.HashAlgorithm)
+			}
+			if s.lastIndex == 0 {
+				// A log keeps the algorithm it was created with.
+				s.tree.epoch.HashAlgorithm = alg
+			} else {
+				s.tree = logTree{epoch: Epoch{Number: s.tree.epoch.Number + 1, Start: s.lastIndex, HashAlgorithm: alg}, size: s.lastIndex}
+			}
 		}
-		var rec Record
-		if err := json.Unmarshal(line, &rec); err != nil {
-			return fmt.Errorf("decode record: %w", err)
+		if err := s.tree.push(rec.Hash); err != nil {
+			return fmt.Errorf("record %d: %w", rec.Index, err)
+		}
+		if head != nil && rec.Index == head.Index {
+			if rec.Hash != head.Hash || (head.TreeRoot != "" && s.tree.root() != head.TreeRoot) {
+				return fmt.Errorf("record %d diverges from high-water mark", rec.Index)
+			}
 		}
 		s.lastIndex = rec.Index
 		s.lastHash = rec.Hash
 		if rec.Index > lastCompletedIndex {
 			if s.batchStart == 0 {
 				s.batchStart = rec.Index
+				s.batchOpened = rec.Timestamp
 			}
 			s.batchHashes = append(s.batchHashes, rec.Hash)
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if head != nil && s.lastIndex < head.Index {
+		return fmt.Errorf("%w: log ends at index %d, high-water mark is %d", ErrTruncated, s.lastIndex, head.Index)
+	}
+	return nil
+}
+
+func appendJSONLine(path string, v interface{}, sync bool) error {
+	line, err := encodeJSONLine(v)
+	if err != nil {
+		return err
 	}
-	return scanner.Err()
+	return appendLine(path, line, sync)
 }
 
-func appendJSONLine(path string, v interface{}) error {
+func encodeJSONLine(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func appendLine(path string, line []byte, sync bool) error {
 	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	enc := json.NewEncoder(file)
-	enc.SetEscapeHTML(false)
-	return enc.Encode(v)
+	if _, err := file.Write(line); err != nil {
+		return err
+	}
+	if sync {
+		return file.Sync()
+	}
+	return nil
+}
+
+// writeJSONFile replaces path atomically so readers never see a partial
+// file. With sync set the new contents are on disk before the rename.
+func writeJSONFile(path string, v interface{}, sync bool) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if sync {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadTrustedState reads a persisted high-water mark, returning nil if the
+// file does not exist.
+func ReadTrustedState(path string) (*TrustedState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state TrustedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
 }
 
 func readLastRoot(path string) (*RootRecord, error) {
-	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0o644)
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,9 @@
 package audit
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 // Event is the raw event ingested by the assurance service.
 type Event struct {
@@ -11,6 +14,17 @@ type Event struct {
 	Payload   map[string]interface{} `json:"payload"`
 }
 
+// reservedTypePrefix marks the event types the store writes itself:
+// EventShutdown, EventShred, EventEpoch and IncidentRecovery.
+const reservedTypePrefix = "audit."
+
+// ReservedEventType reports whether t is reserved for records the store
+// writes itself. Producers must not send such events: readers and
+// auditors take them as the store's own account of the log.
+func ReservedEventType(t string) bool {
+	return strings.HasPrefix(t, reservedTypePrefix)
+}
+
 // Record is a tamper-evident log entry that wraps an Event.
 type Record struct {
 	Index     int64     `json:"index"`
@@ -18,22 +32,96 @@ type Record struct {
 	Event     Event     `json:"event"`
 	PrevHash  string    `json:"prev_hash"`
 	Hash      string    `json:"hash"`
+	// HashScheme is the event serialization the hash was computed over;
+	// zero means HashSchemeStable.
+	HashScheme int `json:"hash_scheme,omitempty"`
+	// HashAlgorithm is the hash function of the record's epoch; empty
+	// means HashSHA256.
+	HashAlgorithm HashAlgorithm `json:"hash_algorithm,omitempty"`
+	// Sealed is the encrypted payload the hash covers, set when the store
+	// returns the record with its payload decrypted; see StoredEvent.
+	Sealed *SealedPayload `json:"sealed,omitempty"`
+	// Disclosures open the payload fields that were hashed as commitments.
+	// They are not covered by the hash; see Redact.
+	Disclosures map[string]Disclosure `json:"disclosures,omitempty"`
 }
 
 // RootRecord captures the Merkle root for a batch of event hashes.
 type RootRecord struct {
-	FromIndex int64     `json:"from_index"`
-	ToIndex   int64     `json:"to_index"`
-	RootHash  string    `json:"root_hash"`
-	CreatedAt time.Time `json:"created_at"`
+	FromIndex     int64         `json:"from_index"`
+	ToIndex       int64         `json:"to_index"`
+	RootHash      string        `json:"root_hash"`
+	TreeVersion   int           `json:"tree_version,omitempty"`
+	HashAlgorithm HashAlgorithm `json:"hash_algorithm,omitempty"`
+	// SealReason says why a batch was sealed before it reached the log's
+	// batch size, SealMaxAge, SealEpoch or SealShutdown; it is empty for a
+	// full batch.
+	// Verify only accepts a short batch whose root says so.
+	SealReason string    `json:"seal_reason,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
 }
 
 // VerifyReport summarizes chain verification.
 type VerifyReport struct {
-	OK           bool     `json:"ok"`
-	Total        int64    `json:"total"`
-	LastIndex    int64    `json:"last_index"`
-	LastHash     string   `json:"last_hash"`
-	RootsChecked int      `json:"roots_checked"`
-	Errors       []string `json:"errors"`
+	OK                 bool   `json:"ok"`
+	Total              int64  `json:"total"`
+	LastIndex          int64  `json:"last_index"`
+	LastHash           string `json:"last_hash"`
+	TreeRoot           string `json:"tree_root"`
+	RootsChecked       int    `json:"roots_checked"`
+	CheckpointsChecked int    `json:"checkpoints_checked"`
+	Truncated          bool   `json:"truncated"`
+	// Epoch and HashAlgorithm describe the epoch the log ends in; TreeRoot
+	// is the root of its log tree.
+	Epoch         int           `json:"epoch"`
+	HashAlgorithm HashAlgorithm `json:"hash_algorithm"`
+	// LogID and BatchSize come from the genesis header; a log without one
+	// has no ID and is checked at VerifyOptions.BatchSize.
+	LogID     string `json:"log_id,omitempty"`
+	BatchSize int    `json:"batch_size"`
+	// ResumedFrom is the index an incremental run picked up after; zero
+	// means every record was processed.
+	ResumedFrom int64 `json:"resumed_from"`
+	// ArchivedSegments lists the sealed segments that were not on disk.
+	// Verification continued from the head the manifest recorded for each,
+	// so their records were not checked.
+	ArchivedSegments []int     `json:"archived_segments,omitempty"`
+	Findings         []Finding `json:"findings"`
+	// Errors mirrors Findings as plain messages for older clients.
+	Errors []string `json:"errors"`
+}
+
+// TrustedState is a log position a verifier already trusts, such as the
+// server's persisted high-water mark or a previously verified checkpoint.
+// A log that ends before Index has been truncated.
+type TrustedState struct {
+	Index     int64     `json:"index"`
+	Hash      string    `json:"hash,omitempty"`
+	TreeRoot  string    `json:"tree_root,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// InclusionProof shows that a single record is covered by a sealed batch root
+// without revealing any other record in the batch.
+type InclusionProof struct {
+	Record        Record        `json:"record"`
+	FromIndex     int64         `json:"from_index"`
+	ToIndex       int64         `json:"to_index"`
+	TreeVersion   int           `json:"tree_version,omitempty"`
+	HashAlgorithm HashAlgorithm `json:"hash_algorithm,omitempty"`
+	Path          []string      `json:"path"`
+	RootHash      string        `json:"root_hash"`
+}
+
+// ConsistencyProof shows that the log at ToSize records is an append-only
+// extension of the log at FromSize records. Both sizes lie in one epoch,
+// whose log tree starts after EpochStart records.
+type ConsistencyProof struct {
+	FromSize      int64         `json:"from_size"`
+	ToSize        int64         `json:"to_size"`
+	FromRoot      string        `json:"from_root"`
+	ToRoot        string        `json:"to_root"`
+	HashAlgorithm HashAlgorithm `json:"hash_algorithm,omitempty"`
+	EpochStart    int64         `json:"epoch_start,omitempty"`
+	Path          []string      `json:"path"`
 }
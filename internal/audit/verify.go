@@ -2,99 +2,846 @@ package audit
 
 import (
 	"bufio"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
+// VerifyOptions extends Verify with optional signed-checkpoint checks.
+type VerifyOptions struct {
+	// BatchSize is the number of records per batch of a log without a
+	// genesis header. A log with one is checked at the size it names.
+	BatchSize int
+	// CheckpointsPath and PublicKey enable checkpoint verification: every
+	// checkpoint must carry a valid signature from PublicKey and match the
+	// log tree root recomputed at its size.
+	CheckpointsPath string
+	PublicKey       ed25519.PublicKey
+	// Expect lists trusted states the log must still contain. A log that
+	// ends before one of them is reported as truncated.
+	Expect []TrustedState
+	// StatePath enables incremental verification: a clean run saves its
+	// position there and the next run resumes from it, only processing
+	// records appended since. Full ignores the saved position.
+	StatePath string
+	Full      bool
+	// Workers, when greater than one, decodes and hashes chunks of the log
+	// concurrently, along with the roots of the batches inside each chunk.
+	// The report is identical to a sequential run.
+	Workers int
+}
+
+// VerifyState is the verifier's position after a clean run. It holds
+// everything needed to continue as if the earlier records had just been
+// scanned: the chain head, the byte offsets of the last record, the pending
+// batch and the log tree's compact range.
+type VerifyState struct {
+	Index              int64     `json:"index"`
+	Hash               string    `json:"hash"`
+	RecordOffset       int64     `json:"record_offset"`
+	Offset             int64     `json:"offset"`
+	BatchHashes        []string  `json:"batch_hashes"`
+	RootsChecked       int       `json:"roots_checked"`
+	CheckpointsChecked int       `json:"checkpoints_checked"`
+	TreeSize           int64     `json:"tree_size"`
+	TreeNodes          []string  `json:"tree_nodes"`
+	Epoch              Epoch     `json:"epoch"`
+	LogID              string    `json:"log_id,omitempty"`
+	VerifiedAt         time.Time `json:"verified_at"`
+}
+
 func Verify(eventsPath, rootsPath string, batchSize int) VerifyReport {
-	report := VerifyReport{OK: true}
-	file, err := os.OpenFile(eventsPath, os.O_RDONLY|os.O_CREATE, 0o644)
+	return VerifyWithOptions(eventsPath, rootsPath, VerifyOptions{BatchSize: batchSize})
+}
+
+func VerifyWithOptions(eventsPath, rootsPath string, opts VerifyOptions) VerifyReport {
+	v := &verifier{opts: opts, report: VerifyReport{OK: true}, file: filepath.Base(eventsPath)}
+	manifest, err := ReadManifest(ManifestPath(eventsPath))
 	if err != nil {
-		report.OK = false
-		report.Errors = append(report.Errors, fmt.Sprintf("open events: %v", err))
-		return report
+		v.report.fail(Finding{Code: FindingIO, Message: fmt.Sprintf("read manifest: %v", err), File: manifestName})
+		return v.report
+	}
+	genesis, err := ReadGenesis(GenesisPath(eventsPath))
+	if err != nil {
+		v.report.fail(Finding{Code: FindingIO, Message: fmt.Sprintf("read genesis: %v", err), File: genesisName})
+		return v.report
+	}
+	v.useGenesis(genesis)
+	if !v.load(rootsPath) {
+		return v.report
+	}
+	files := verifyFiles(eventsPath, manifest)
+
+	start := 0
+	var offset, recordOffset int64
+	if opts.StatePath != "" && !opts.Full {
+		if state, i := v.resumable(files); state != nil {
+			v.resume(*state)
+			start, offset, recordOffset = i, state.Offset, state.RecordOffset
+		}
+	}
+
+	// offset and recordOffset always describe the file holding the last
+	// verified record, which is what a saved state points into.
+	for i := start; i < len(files); i++ {
+		f := files[i]
+		v.file = filepath.Base(f.path)
+		pos := int64(0)
+		if i == start {
+			pos = offset
+		}
+		if f.segment != nil && (i > start || v.report.ResumedFrom == 0) {
+			v.checkSegmentStart(*f.segment)
+		}
+		end, last, ok := v.scanFile(f, pos)
+		if !ok {
+			break
+		}
+		if last >= 0 {
+			offset, recordOffset = end, last
+		} else if i == start {
+			offset = end
+		}
+		if f.segment != nil {
+			v.checkSegmentEnd(*f.segment)
+		}
+	}
+	v.finish()
+
+	if opts.StatePath != "" && v.report.OK && v.expectedIndex > 0 {
+		_ = writeJSONFile(opts.StatePath, v.state(recordOffset, offset), false)
+	}
+	return v.report
+}
+
+// Verify checks the store's own log. With the file storage engine this is
+// VerifyWithOptions over its files, with CheckpointsPath defaulting to the
+// store's. Other engines are read back through their Backend; StatePath and
+// Workers do not apply to them, so every run is a full sequential one.
+func (s *Store) Verify(opts VerifyOptions) VerifyReport {
+	if b, ok := s.backend.(*fileBackend); ok {
+		if err := b.Flush(); err != nil {
+			report := VerifyReport{OK: true}
+			report.fail(Finding{Code: FindingIO, Message: fmt.Sprintf("flush events: %v", err)})
+			return report
+		}
+		if opts.CheckpointsPath == "" {
+			opts.CheckpointsPath = b.checkpointsPath
+		}
+		return VerifyWithOptions(b.eventsPath, b.rootsPath, opts)
+	}
+
+	v := &verifier{opts: opts, report: VerifyReport{OK: true}}
+	genesis, err := s.backend.Genesis()
+	if err != nil {
+		v.report.fail(Finding{Code: FindingIO, Message: fmt.Sprintf("read genesis: %v", err)})
+		return v.report
+	}
+	v.useGenesis(genesis)
+	roots, err := s.backend.Roots()
+	if err != nil {
+		v.report.fail(Finding{Code: FindingIO, Message: fmt.Sprintf("read roots: %v", err)})
+		return v.report
+	}
+	var checkpoints []Checkpoint
+	if opts.PublicKey != nil {
+		if checkpoints, err = s.backend.Checkpoints(); err != nil {
+			v.report.fail(Finding{Code: FindingIO, Message: fmt.Sprintf("read checkpoints: %v", err)})
+			return v.report
+		}
+	}
+	v.use(roots, checkpoints)
+	err = s.backend.Scan(func(rec Record) error {
+		v.apply(checkDecoded(rec, 0))
+		return nil
+	})
+	if err != nil {
+		v.report.fail(Finding{Code: FindingIO, Message: fmt.Sprintf("scan: %v", err)})
+	}
+	v.finish()
+	return v.report
+}
+
+// verifyFile is one file of the log in verification order. segment is nil
+// for the live file.
+type verifyFile struct {
+	path    string
+	segment *Segment
+}
+
+func verifyFiles(eventsPath string, manifest Manifest) []verifyFile {
+	dir := filepath.Dir(eventsPath)
+	files := make([]verifyFile, 0, len(manifest.Segments)+1)
+	for i := range manifest.Segments {
+		seg := &manifest.Segments[i]
+		files = append(files, verifyFile{path: filepath.Join(dir, seg.File), segment: seg})
+	}
+	return append(files, verifyFile{path: eventsPath})
+}
+
+// scanFile checks one log file from byte offset pos. It returns the offset
+// past the last line, the offset of the last decoded record (-1 if none)
+// and false if the file could not be read at all. A sealed segment that is
+// no longer on disk is skipped; see skipArchived.
+func (v *verifier) scanFile(f verifyFile, pos int64) (int64, int64, bool) {
+	file, format, err := openLog(f.path, pos)
+	if errors.Is(err, os.ErrNotExist) && f.segment != nil {
+		v.skipArchived(*f.segment)
+		return pos, -1, true
+	}
+	if err != nil {
+		v.report.fail(Finding{Code: FindingIO, Message: fmt.Sprintf("open events: %v", err), File: v.file, Offset: pos})
+		return pos, -1, false
 	}
 	defer file.Close()
+	v.format = format
+	if v.opts.Workers > 1 {
+		end, last := v.scanParallel(file, pos, -1)
+		return end, last, true
+	}
+	end, last := v.scan(file, pos, -1)
+	return end, last, true
+}
 
+// skipArchived continues past a sealed segment that has been moved off disk,
+// such as to cold storage, from the chain head and log tree the manifest
+// recorded for it. Its records and roots cannot be checked and are counted
+// as neither; the segment is listed in the report instead. Expectations and
+// checkpoints at its last index are still checked against the manifest.
+func (v *verifier) skipArchived(seg Segment) {
+	v.report.ArchivedSegments = append(v.report.ArchivedSegments, seg.Seq)
+	for v.rootIndex < len(v.roots) && v.roots[v.rootIndex].ToIndex <= seg.LastIndex {
+		v.rootIndex++
+	}
+	for v.checkpointIndex < len(v.checkpoints) && v.checkpoints[v.checkpointIndex].TreeSize < seg.LastIndex {
+		v.checkpointIndex++
+	}
+	v.currentBatch = nil
+	v.tree = treeFromNodes(seg.Epoch, seg.LastIndex, seg.TreeNodes)
+	v.expectedIndex = seg.LastIndex
+	v.expectedPrev = seg.LastHash
+	at := func(f Finding) Finding {
+		f.File = seg.File
+		return f
+	}
+	v.checkExpected(seg.LastIndex, seg.LastHash, at)
+	v.checkCheckpoints()
+	v.report.Total = seg.LastIndex
+	v.report.LastIndex = seg.LastIndex
+	v.report.LastHash = seg.LastHash
+}
+
+func (v *verifier) checkSegmentStart(seg Segment) {
+	if next := v.expectedIndex + 1; seg.FirstIndex != next {
+		v.report.fail(Finding{
+			Code:     FindingSegmentMismatch,
+			Message:  fmt.Sprintf("segment %d starts at index %d, log continues at %d", seg.Seq, seg.FirstIndex, next),
+			Index:    next,
+			Expected: strconv.FormatInt(next, 10),
+			Actual:   strconv.FormatInt(seg.FirstIndex, 10),
+			File:     seg.File,
+		})
+	}
+}
+
+// checkSegmentEnd compares the chain head and log tree after a sealed
+// segment with what the manifest recorded when it was sealed.
+func (v *verifier) checkSegmentEnd(seg Segment) {
+	mismatch := func(what, expected, actual string) {
+		v.report.fail(Finding{
+			Code:      FindingSegmentMismatch,
+			Message:   fmt.Sprintf("segment %d %s does not match manifest", seg.Seq, what),
+			FromIndex: seg.FirstIndex,
+			ToIndex:   seg.LastIndex,
+			Expected:  expected,
+			Actual:    actual,
+			File:      seg.File,
+		})
+	}
+	if v.expectedIndex != seg.LastIndex {
+		mismatch("last index", strconv.FormatInt(seg.LastIndex, 10), strconv.FormatInt(v.expectedIndex, 10))
+		return
+	}
+	if v.expectedPrev != seg.LastHash {
+		mismatch("last hash", seg.LastHash, v.expectedPrev)
+	}
+	if root := v.tree.root(); root != seg.TreeRoot {
+		mismatch("tree root", seg.TreeRoot, root)
+	}
+	if want, got := seg.Epoch.normalize(), v.tree.epoch.normalize(); want != got {
+		mismatch("epoch", fmt.Sprintf("%d/%s", want.Number, want.HashAlgorithm), fmt.Sprintf("%d/%s", got.Number, got.HashAlgorithm))
+	}
+}
+
+// scan checks every record from r, which starts at byte offset, and returns
+// the offset past the last one and the offset of the last decoded record.
+func (v *verifier) scan(r io.Reader, offset, recordOffset int64) (int64, int64) {
+	scanner := newFrameScanner(r, v.format, offset)
+	for scanner.Scan() {
+		if v.apply(checkRecord(v.format, scanner.Bytes(), scanner.Offset())) {
+			recordOffset = scanner.Offset()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		v.report.fail(Finding{Code: FindingIO, Message: fmt.Sprintf("scan: %v", err), File: v.file, Offset: scanner.End()})
+	}
+	return scanner.End(), recordOffset
+}
+
+// ReadVerifyState reads a saved verifier position, returning nil if the
+// file does not exist.
+func ReadVerifyState(path string) (*VerifyState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state VerifyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (st VerifyState) logTree() logTree {
+	return treeFromNodes(st.Epoch, st.TreeSize, st.TreeNodes)
+}
+
+// verifier carries the sequential checks across records so a run can start
+// from scratch or from a saved VerifyState.
+type verifier struct {
+	opts   VerifyOptions
+	report VerifyReport
+	file   string
+	format LogFormat
+
+	// genesis is the log's header, nil for a log without one, and
+	// batchSize the batch size it names or, failing that, opts.BatchSize.
+	genesis   *Genesis
+	batchSize int
+
+	roots           []RootRecord
+	rootIndex       int
+	checkpoints     []Checkpoint
+	checkpointIndex int
+
+	currentBatch []string
+	// batchRoots are the roots scanParallel's workers computed for the
+	// chunk being applied; see batchRoot.
+	batchRoots    map[int64]batchRoot
+	expectedPrev  string
+	expectedIndex int64
+	tree          logTree
+}
+
+// useGenesis checks the log's genesis header and takes the batch size, first
+// prev_hash and first hash algorithm from it. Without one the log is checked
+// as it was before headers existed: from opts, with an empty first prev_hash.
+func (v *verifier) useGenesis(g *Genesis) {
+	v.batchSize = v.opts.BatchSize
+	if g == nil {
+		return
+	}
+	v.genesis = g
+	v.report.LogID = g.LogID
+	if err := g.Check(v.opts.PublicKey); err != nil {
+		v.report.fail(Finding{Code: FindingGenesis, Message: err.Error(), File: genesisName})
+	}
+	if g.BatchSize > 0 {
+		v.batchSize = g.BatchSize
+	}
+	if g.HashAlgorithm.valid() {
+		v.tree.epoch.HashAlgorithm = g.HashAlgorithm.normalize()
+	}
+	hash, err := g.Hash()
+	if err != nil {
+		v.report.fail(Finding{Code: FindingGenesis, Message: fmt.Sprintf("hash genesis: %v", err), File: genesisName})
+	}
+	v.expectedPrev = hash
+}
+
+// load reads the root and checkpoint files the record checks compare against.
+func (v *verifier) load(rootsPath string) bool {
 	roots, err := readRoots(rootsPath)
 	if err != nil {
-		report.OK = false
-		report.Errors = append(report.Errors, fmt.Sprintf("read roots: %v", err))
-		return report
+		v.report.fail(Finding{Code: FindingIO, Message: fmt.Sprintf("read roots: %v", err), File: filepath.Base(rootsPath)})
+		return false
+	}
+	var checkpoints []Checkpoint
+	if v.opts.PublicKey != nil {
+		checkpoints, err = readCheckpoints(v.opts.CheckpointsPath)
+		if err != nil {
+			v.report.fail(Finding{Code: FindingIO, Message: fmt.Sprintf("read checkpoints: %v", err), File: filepath.Base(v.opts.CheckpointsPath)})
+			return false
+		}
 	}
-	rootIndex := 0
-	var currentBatch []string
-	var expectedPrev string
-	var expectedIndex int64
+	v.use(roots, checkpoints)
+	return true
+}
 
-	scanner := bufio.NewScanner(file)
-	scanner.Buffer(make([]byte, 0, 64*1024), 5*1024*1024)
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		if len(line) == 0 {
-			continue
+// use installs the roots and, with a public key, the checkpoints to check
+// records against, verifying each checkpoint's signature up front.
+func (v *verifier) use(roots []RootRecord, checkpoints []Checkpoint) {
+	v.roots = roots
+	if v.opts.PublicKey == nil {
+		return
+	}
+	v.checkpoints = checkpoints
+	if len(checkpoints) == 0 && len(roots) > 0 {
+		v.report.fail(Finding{Code: FindingCheckpointMissing, Message: "no signed checkpoint"})
+	}
+	for _, c := range checkpoints {
+		if err := VerifyCheckpoint(c, v.opts.PublicKey); err != nil {
+			v.report.fail(Finding{Code: FindingCheckpointInvalid, Message: err.Error(), Index: c.TreeSize})
 		}
-		var rec Record
-		if err := json.Unmarshal(line, &rec); err != nil {
-			report.OK = false
-			report.Errors = append(report.Errors, fmt.Sprintf("decode record: %v", err))
-			continue
+	}
+}
+
+// resumable returns the saved state and the position in files of the file
+// holding its record, if it still describes this log: that record must be
+// unchanged and every expectation must lie at or after it. Anything else
+// falls back to a full run, which reports the cause.
+func (v *verifier) resumable(files []verifyFile) (*VerifyState, int) {
+	state, err := ReadVerifyState(v.opts.StatePath)
+	if err != nil || state == nil || state.Index <= 0 || state.LogID != v.report.LogID {
+		return nil, 0
+	}
+	tree := state.logTree()
+	for _, want := range v.opts.Expect {
+		if want.Index < state.Index {
+			return nil, 0
 		}
-		expectedIndex++
-		if rec.Index != expectedIndex {
-			report.OK = false
-			report.Errors = append(report.Errors, fmt.Sprintf("index mismatch at %d", rec.Index))
+		if want.Index == state.Index {
+			if (want.Hash != "" && want.Hash != state.Hash) || (want.TreeRoot != "" && want.TreeRoot != tree.root()) {
+				return nil, 0
+			}
+		}
+	}
+	if v.opts.PublicKey != nil {
+		// A checkpoint written after the state was saved but covering an
+		// earlier size could never be checked on resume.
+		covered := 0
+		for _, c := range v.checkpoints {
+			if c.TreeSize <= state.TreeSize {
+				covered++
+			}
 		}
-		if rec.PrevHash != expectedPrev {
-			report.OK = false
-			report.Errors = append(report.Errors, fmt.Sprintf("prev_hash mismatch at %d", rec.Index))
+		if covered != state.CheckpointsChecked {
+			return nil, 0
 		}
-		payload, err := StableJSON(rec.Event)
-		if err != nil {
-			report.OK = false
-			report.Errors = append(report.Errors, fmt.Sprintf("stable json: %v", err))
+	}
+	i := len(files) - 1
+	for j, f := range files {
+		if f.segment != nil && state.Index <= f.segment.LastIndex {
+			i = j
+			break
+		}
+	}
+	file, format, err := openLog(files[i].path, state.RecordOffset)
+	if err != nil {
+		return nil, 0
+	}
+	defer file.Close()
+	scanner := newFrameScanner(file, format, state.RecordOffset)
+	if !scanner.Scan() || scanner.End() != state.Offset {
+		return nil, 0
+	}
+	rec, err := decodeFrame(format, scanner.Bytes())
+	if err != nil || rec.Index != state.Index || rec.Hash != state.Hash {
+		return nil, 0
+	}
+	if !rec.HashAlgorithm.valid() {
+		return nil, 0
+	}
+	payload, err := CanonicalEvent(rec.HashScheme, rec.Event)
+	if err != nil || recordHash(rec.HashAlgorithm, rec.PrevHash, rec.Index, payload) != rec.Hash {
+		return nil, 0
+	}
+	return state, i
+}
+
+func (v *verifier) resume(state VerifyState) {
+	v.expectedIndex = state.Index
+	v.expectedPrev = state.Hash
+	v.currentBatch = append([]string(nil), state.BatchHashes...)
+	v.rootIndex = state.RootsChecked
+	v.tree = state.logTree()
+	for v.checkpointIndex < len(v.checkpoints) && v.checkpoints[v.checkpointIndex].TreeSize <= state.TreeSize {
+		v.checkpointIndex++
+	}
+	v.report.RootsChecked = state.RootsChecked
+	v.report.CheckpointsChecked = v.checkpointIndex
+	v.report.Total = state.Index
+	v.report.LastIndex = state.Index
+	v.report.LastHash = state.Hash
+	v.report.ResumedFrom = state.Index
+}
+
+func (v *verifier) state(recordOffset, offset int64) VerifyState {
+	return VerifyState{
+		Index:              v.expectedIndex,
+		Hash:               v.expectedPrev,
+		RecordOffset:       recordOffset,
+		Offset:             offset,
+		BatchHashes:        v.currentBatch,
+		RootsChecked:       v.report.RootsChecked,
+		CheckpointsChecked: v.report.CheckpointsChecked,
+		TreeSize:           v.tree.size,
+		TreeNodes:          v.tree.nodes(),
+		Epoch:              v.tree.epoch.normalize(),
+		LogID:              v.report.LogID,
+		VerifiedAt:         time.Now().UTC(),
+	}
+}
+
+// recordCheck is the expensive, order-independent part of verifying one log
+// record: decoding it and recomputing its hash. The checks that link records
+// together run afterwards, in log order, in apply.
+type recordCheck struct {
+	offset    int64
+	index     int64
+	prevHash  string
+	hash      string
+	computed  string
+	decodeErr error
+	canonErr  error
+	// alg is the record's hash algorithm; algErr is set if it is unknown.
+	alg    HashAlgorithm
+	algErr error
+	// link is the payload of an EventEpoch record.
+	link    *epochLink
+	linkErr error
+	// disclosureErr is set when a clear-text disclosure does not open its
+	// commitment; the hash does not cover disclosures, so only this
+	// catches one altered on disk.
+	disclosureErr error
+}
+
+func checkRecord(format LogFormat, frame []byte, offset int64) recordCheck {
+	rec, err := decodeFrame(format, frame)
+	if err != nil {
+		return recordCheck{offset: offset, decodeErr: err}
+	}
+	return checkDecoded(rec, offset)
+}
+
+// checkDecoded is checkRecord for a record a backend has already decoded.
+func checkDecoded(rec Record, offset int64) recordCheck {
+	c := recordCheck{offset: offset, index: rec.Index, prevHash: rec.PrevHash, hash: rec.Hash, alg: rec.HashAlgorithm.normalize()}
+	if !c.alg.valid() {
+		c.algErr = fmt.Errorf("unknown hash algorithm %q at %d", rec.HashAlgorithm, rec.Index)
+		return c
+	}
+	if rec.Event.Type == EventEpoch {
+		link, err := parseEpochLink(rec.Event.Payload)
+		c.link, c.linkErr = &link, err
+	}
+	payload, err := CanonicalEvent(rec.HashScheme, rec.Event)
+	if err != nil {
+		c.canonErr = err
+		return c
+	}
+	c.computed = recordHash(c.alg, rec.PrevHash, rec.Index, payload)
+	c.disclosureErr = checkDisclosures(rec)
+	return c
+}
+
+// apply runs the sequential checks for one checked line and reports whether
+// it decoded.
+func (v *verifier) apply(c recordCheck) bool {
+	report := &v.report
+	at := func(f Finding) Finding {
+		f.File, f.Offset = v.file, c.offset
+		return f
+	}
+	if c.decodeErr != nil {
+		report.fail(at(Finding{Code: FindingDecode, Message: fmt.Sprintf("decode record: %v", c.decodeErr), Index: v.expectedIndex + 1}))
+		return false
+	}
+	rec := Record{Index: c.index, PrevHash: c.prevHash, Hash: c.hash}
+	v.expectedIndex++
+	if rec.Index != v.expectedIndex {
+		report.fail(at(Finding{
+			Code:     FindingIndexMismatch,
+			Message:  fmt.Sprintf("index mismatch at %d", rec.Index),
+			Index:    rec.Index,
+			Expected: strconv.FormatInt(v.expectedIndex, 10),
+			Actual:   strconv.FormatInt(rec.Index, 10),
+		}))
+	}
+	if rec.PrevHash != v.expectedPrev && rec.Index == 1 {
+		msg := "record 1 does not chain to the genesis header"
+		if v.genesis == nil {
+			msg = "record 1 chains to a genesis header, but the log has none"
+		}
+		report.fail(at(Finding{Code: FindingGenesis, Message: msg, Index: 1, Expected: v.expectedPrev, Actual: rec.PrevHash}))
+	} else if rec.PrevHash != v.expectedPrev {
+		report.fail(at(Finding{
+			Code:     FindingPrevHashMismatch,
+			Message:  fmt.Sprintf("prev_hash mismatch at %d", rec.Index),
+			Index:    rec.Index,
+			Expected: v.expectedPrev,
+			Actual:   rec.PrevHash,
+		}))
+	}
+	if c.algErr != nil {
+		report.fail(at(Finding{Code: FindingHashAlgorithm, Message: c.algErr.Error(), Index: rec.Index}))
+		return true
+	}
+	if c.alg != v.tree.epoch.HashAlgorithm.normalize() {
+		v.enterEpoch(c, at)
+	}
+	if c.canonErr != nil {
+		report.fail(at(Finding{Code: FindingCanonicalization, Message: fmt.Sprintf("canonicalize: %v", c.canonErr), Index: rec.Index}))
+		return true
+	}
+	computed := c.computed
+	if computed != rec.Hash {
+		report.fail(at(Finding{
+			Code:     FindingHashMismatch,
+			Message:  fmt.Sprintf("hash mismatch at %d", rec.Index),
+			Index:    rec.Index,
+			Expected: computed,
+			Actual:   rec.Hash,
+		}))
+	}
+	if c.disclosureErr != nil {
+		report.fail(at(Finding{Code: FindingDisclosureMismatch, Message: c.disclosureErr.Error(), Index: rec.Index}))
+	}
+	if err := v.tree.push(rec.Hash); err != nil {
+		report.fail(at(Finding{Code: FindingDecode, Message: fmt.Sprintf("hash decode at %d", rec.Index), Index: rec.Index, Actual: rec.Hash}))
+	}
+	v.checkExpected(rec.Index, rec.Hash, at)
+	v.checkCheckpoints()
+	v.expectedPrev = rec.Hash
+	report.Total = rec.Index
+	report.LastIndex = rec.Index
+	report.LastHash = rec.Hash
+
+	v.currentBatch = append(v.currentBatch, rec.Hash)
+	if (v.batchSize > 0 && len(v.currentBatch) == v.batchSize) || v.sealedShort(rec.Index) {
+		v.sealBatch(rec.Index)
+	}
+	return true
+}
+
+// checkExpected compares the record at index, whose hash is hash and after
+// which the log tree is v.tree, with the trusted states expected there.
+func (v *verifier) checkExpected(index int64, hash string, at func(Finding) Finding) {
+	for _, want := range v.opts.Expect {
+		if want.Index != index {
 			continue
 		}
-		computed := hashBytes([]byte(rec.PrevHash), []byte(fmt.Sprintf("|%d|", rec.Index)), payload)
-		if computed != rec.Hash {
-			report.OK = false
-			report.Errors = append(report.Errors, fmt.Sprintf("hash mismatch at %d", rec.Index))
-		}
-		expectedPrev = rec.Hash
-		report.Total = rec.Index
-		report.LastIndex = rec.Index
-		report.LastHash = rec.Hash
-
-		currentBatch = append(currentBatch, rec.Hash)
-		if batchSize > 0 && len(currentBatch) == batchSize {
-			if rootIndex >= len(roots) {
-				report.OK = false
-				report.Errors = append(report.Errors, "missing root record")
-				currentBatch = nil
-				continue
-			}
-			root := MerkleRoot(currentBatch)
-			expected := roots[rootIndex]
-			if expected.RootHash != root {
-				report.OK = false
-				report.Errors = append(report.Errors, fmt.Sprintf("root mismatch for batch ending %d", rec.Index))
-			}
-			report.RootsChecked++
-			rootIndex++
-			currentBatch = nil
+		if want.Hash != "" && want.Hash != hash {
+			v.report.fail(at(Finding{
+				Code:     FindingExpectedMismatch,
+				Message:  fmt.Sprintf("expected hash mismatch at %d", index),
+				Index:    index,
+				Expected: want.Hash,
+				Actual:   hash,
+			}))
+		}
+		if root := v.tree.root(); want.TreeRoot != "" && want.TreeRoot != root {
+			v.report.fail(at(Finding{
+				Code:     FindingExpectedMismatch,
+				Message:  fmt.Sprintf("expected tree root mismatch at size %d", v.tree.size),
+				Index:    index,
+				Expected: want.TreeRoot,
+				Actual:   root,
+			}))
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		report.OK = false
-		report.Errors = append(report.Errors, fmt.Sprintf("scan: %v", err))
+}
+
+// checkCheckpoints checks every checkpoint up to the current tree size
+// against the log tree.
+func (v *verifier) checkCheckpoints() {
+	for v.checkpointIndex < len(v.checkpoints) && v.checkpoints[v.checkpointIndex].TreeSize <= v.tree.size {
+		c := v.checkpoints[v.checkpointIndex]
+		epoch := v.tree.epoch.normalize()
+		if root := v.tree.root(); c.TreeSize != v.tree.size || c.RootHash != root ||
+			c.HashAlgorithm.normalize() != epoch.HashAlgorithm || c.EpochStart != epoch.Start {
+			v.report.fail(Finding{
+				Code:     FindingCheckpointMismatch,
+				Message:  fmt.Sprintf("checkpoint mismatch at size %d", c.TreeSize),
+				Index:    c.TreeSize,
+				Expected: c.RootHash,
+				Actual:   root,
+			})
+		}
+		v.report.CheckpointsChecked++
+		v.checkpointIndex++
+	}
+}
+
+// sealedShort reports whether the next root closes the open batch at index
+// before it is full. Only a root that names why it was sealed early may: one
+// that just ends short is checked against a full batch and fails.
+func (v *verifier) sealedShort(index int64) bool {
+	if v.rootIndex >= len(v.roots) {
+		return false
 	}
+	next := v.roots[v.rootIndex]
+	return validSealReason(next.SealReason) && next.ToIndex == index &&
+		next.FromIndex == index-int64(len(v.currentBatch))+1
+}
+
+// enterEpoch handles a record hashed with another algorithm than the
+// records before it. At the start of the log that is simply the log's
+// algorithm; later the record must be a link record that matches the epoch
+// it closes. Either way the verifier follows the log into the new epoch, so
+// one bad record does not fail every record after it. The store seals a
+// partial batch before it appends a link record, and so does this.
+func (v *verifier) enterEpoch(c recordCheck, at func(Finding) Finding) {
+	if v.tree.size == 0 {
+		if v.genesis != nil {
+			v.report.fail(at(Finding{
+				Code:     FindingGenesis,
+				Message:  fmt.Sprintf("record %d is hashed with %s, genesis names %s", c.index, c.alg, v.tree.epoch.HashAlgorithm.normalize()),
+				Index:    c.index,
+				Expected: string(v.tree.epoch.HashAlgorithm.normalize()),
+				Actual:   string(c.alg),
+			}))
+		}
+		v.tree.epoch.HashAlgorithm = c.alg
+		return
+	}
+	var err error
+	switch {
+	case c.link == nil:
+		err = fmt.Errorf("record %d is hashed with %s but is not an epoch link; log uses %s", c.index, c.alg, v.tree.epoch.HashAlgorithm.normalize())
+	case c.linkErr != nil:
+		err = c.linkErr
+	default:
+		err = c.link.check(v.tree, v.expectedPrev, c.alg)
+	}
+	if err != nil {
+		v.report.fail(at(Finding{
+			Code:     FindingEpochLink,
+			Message:  err.Error(),
+			Index:    c.index,
+			Expected: string(v.tree.epoch.HashAlgorithm.normalize()),
+			Actual:   string(c.alg),
+		}))
+	}
+	if len(v.currentBatch) > 0 {
+		if v.batchSize > 0 {
+			v.sealBatch(v.tree.size)
+		}
+		v.currentBatch = nil
+	}
+	v.tree = logTree{epoch: Epoch{Number: v.tree.epoch.Number + 1, Start: v.tree.size, HashAlgorithm: c.alg}, size: v.tree.size}
+}
+
+func (v *verifier) sealBatch(to int64) {
+	report := &v.report
+	from := to - int64(len(v.currentBatch)) + 1
+	defer func() { v.currentBatch = nil }()
+	if v.rootIndex >= len(v.roots) {
+		report.fail(Finding{Code: FindingMissingRoot, Message: "missing root record", FromIndex: from, ToIndex: to})
+		return
+	}
+	expected := v.roots[v.rootIndex]
+	if !validTreeVersion(expected.TreeVersion) {
+		report.fail(Finding{
+			Code:      FindingTreeVersion,
+			Message:   fmt.Sprintf("unknown tree version %d for batch ending %d", expected.TreeVersion, to),
+			FromIndex: from,
+			ToIndex:   to,
+			Actual:    strconv.Itoa(expected.TreeVersion),
+		})
+	}
+	if want, ok := v.treeVersion(); ok && normalizeTreeVersion(expected.TreeVersion) != want {
+		report.fail(Finding{
+			Code:      FindingTreeVersion,
+			Message:   fmt.Sprintf("tree version changed for batch ending %d", to),
+			FromIndex: from,
+			ToIndex:   to,
+			Expected:  strconv.Itoa(want),
+			Actual:    strconv.Itoa(normalizeTreeVersion(expected.TreeVersion)),
+		})
+	}
+	alg := v.tree.epoch.HashAlgorithm.normalize()
+	if expected.HashAlgorithm.normalize() != alg {
+		report.fail(Finding{
+			Code:      FindingHashAlgorithm,
+			Message:   fmt.Sprintf("hash algorithm mismatch for batch ending %d", to),
+			FromIndex: from,
+			ToIndex:   to,
+			Expected:  string(alg),
+			Actual:    string(expected.HashAlgorithm.normalize()),
+		})
+	}
+	root := v.batchRoot(alg, expected.TreeVersion, to)
+	if expected.RootHash != root {
+		report.fail(Finding{
+			Code:      FindingRootMismatch,
+			Message:   fmt.Sprintf("root mismatch for batch ending %d", to),
+			FromIndex: from,
+			ToIndex:   to,
+			Expected:  expected.RootHash,
+			Actual:    root,
+		})
+	}
+	report.RootsChecked++
+	v.rootIndex++
+}
+
+// treeVersion is the tree version the next root must use: the genesis
+// value, or else that of the root before it.
+func (v *verifier) treeVersion() (int, bool) {
+	switch {
+	case v.genesis != nil:
+		return normalizeTreeVersion(v.genesis.TreeVersion), true
+	case v.rootIndex > 0:
+		return normalizeTreeVersion(v.roots[v.rootIndex-1].TreeVersion), true
+	}
+	return 0, false
+}
 
-	return report
+// finish runs the end-of-log checks and fills in the log tree root.
+func (v *verifier) finish() {
+	report := &v.report
+	for _, c := range v.checkpoints[v.checkpointIndex:] {
+		report.fail(Finding{
+			Code:     FindingTruncated,
+			Message:  fmt.Sprintf("truncated: checkpoint at size %d beyond log end %d", c.TreeSize, v.tree.size),
+			Index:    c.TreeSize,
+			Expected: strconv.FormatInt(c.TreeSize, 10),
+			Actual:   strconv.FormatInt(v.tree.size, 10),
+		})
+	}
+	for _, want := range v.opts.Expect {
+		if want.Index > report.LastIndex {
+			report.fail(Finding{
+				Code:     FindingTruncated,
+				Message:  fmt.Sprintf("truncated: log ends at index %d, expected at least %d", report.LastIndex, want.Index),
+				Index:    want.Index,
+				Expected: strconv.FormatInt(want.Index, 10),
+				Actual:   strconv.FormatInt(report.LastIndex, 10),
+			})
+		}
+	}
+	report.TreeRoot = v.tree.root()
+	report.BatchSize = v.batchSize
+	report.Epoch = v.tree.epoch.Number
+	report.HashAlgorithm = v.tree.epoch.HashAlgorithm.normalize()
 }
 
+// readRoots reads every root record; a missing file is an empty list.
 func readRoots(path string) ([]RootRecord, error) {
-	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0o644)
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []RootRecord{}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,139 @@
+package audit
+
+import (
+	"fmt"
+	"io"
+	"slices"
+)
+
+// chunkRecords is the number of lines handed to one worker. Batch roots are
+// computed by the workers for batches that lie wholly inside a chunk; a
+// batch split between two chunks is left to the stitcher.
+const chunkRecords = 1024
+
+type verifyChunk struct {
+	lines   [][]byte
+	offsets []int64
+	checks  []recordCheck
+	// roots holds the batch roots computed by the worker, by last index.
+	roots map[int64]batchRoot
+	done  chan struct{}
+}
+
+// batchRoot is a batch root computed ahead of the stitcher, with everything
+// it was computed from so sealBatch can tell whether it applies.
+type batchRoot struct {
+	alg     HashAlgorithm
+	version int
+	hashes  []string
+	root    string
+}
+
+// scanParallel is scan with the per-record decoding and hashing, and the
+// batch roots, spread over opts.Workers goroutines. Chunks are checked
+// concurrently but applied strictly in log order, so prev-hash links, batch
+// boundaries and checkpoints are stitched exactly as a sequential run would.
+func (v *verifier) scanParallel(r io.Reader, offset, recordOffset int64) (int64, int64) {
+	starts := make(map[int64]int, len(v.roots)-v.rootIndex)
+	for i := v.rootIndex; i < len(v.roots); i++ {
+		starts[v.roots[i].FromIndex] = i
+	}
+
+	jobs := make(chan *verifyChunk, v.opts.Workers)
+	ordered := make(chan *verifyChunk, v.opts.Workers*2)
+	for w := 0; w < v.opts.Workers; w++ {
+		go func() {
+			for c := range jobs {
+				c.checks = make([]recordCheck, len(c.lines))
+				for i, line := range c.lines {
+					c.checks[i] = checkRecord(v.format, line, c.offsets[i])
+				}
+				c.computeRoots(v.roots, starts)
+				close(c.done)
+			}
+		}()
+	}
+	stitched := make(chan struct{})
+	go func() {
+		defer close(stitched)
+		for c := range ordered {
+			<-c.done
+			v.batchRoots = c.roots
+			for _, check := range c.checks {
+				if v.apply(check) {
+					recordOffset = check.offset
+				}
+			}
+			v.batchRoots = nil
+		}
+	}()
+
+	current := &verifyChunk{done: make(chan struct{})}
+	dispatch := func() {
+		ordered <- current
+		jobs <- current
+		current = &verifyChunk{done: make(chan struct{})}
+	}
+	scanner := newFrameScanner(r, v.format, offset)
+	for scanner.Scan() {
+		current.lines = append(current.lines, append([]byte(nil), scanner.Bytes()...))
+		current.offsets = append(current.offsets, scanner.Offset())
+		if len(current.lines) == chunkRecords {
+			dispatch()
+		}
+	}
+	if len(current.lines) > 0 {
+		dispatch()
+	}
+	close(jobs)
+	close(ordered)
+	<-stitched
+
+	if err := scanner.Err(); err != nil {
+		v.report.fail(Finding{Code: FindingIO, Message: fmt.Sprintf("scan: %v", err), File: v.file, Offset: scanner.End()})
+	}
+	return scanner.End(), recordOffset
+}
+
+// computeRoots computes the root of every batch that the root records,
+// indexed by first index in starts, place wholly inside the chunk. The root
+// records only say where to look: sealBatch still decides where batches end
+// and uses a root only if it covers exactly the hashes it collected.
+func (c *verifyChunk) computeRoots(roots []RootRecord, starts map[int64]int) {
+	for i, check := range c.checks {
+		ri, ok := starts[check.index]
+		if !ok || check.decodeErr != nil {
+			continue
+		}
+		r := roots[ri]
+		n := int(r.ToIndex - r.FromIndex + 1)
+		if n <= 0 || i+n > len(c.checks) {
+			continue
+		}
+		hashes := make([]string, n)
+		for k, b := range c.checks[i : i+n] {
+			if b.decodeErr != nil || b.index != r.FromIndex+int64(k) {
+				hashes = nil
+				break
+			}
+			hashes[k] = b.hash
+		}
+		if hashes == nil {
+			continue
+		}
+		if c.roots == nil {
+			c.roots = make(map[int64]batchRoot)
+		}
+		alg := r.HashAlgorithm.normalize()
+		c.roots[r.ToIndex] = batchRoot{alg: alg, version: r.TreeVersion, hashes: hashes, root: BatchRoot(alg, r.TreeVersion, hashes)}
+	}
+}
+
+// batchRoot returns the root of the open batch, which ends at to: the one a
+// worker computed if it was over the same hashes, else a fresh one.
+func (v *verifier) batchRoot(alg HashAlgorithm, version int, to int64) string {
+	if b, ok := v.batchRoots[to]; ok && b.alg == alg && b.version == version && slices.Equal(b.hashes, v.currentBatch) {
+		return b.root
+	}
+	return BatchRoot(alg, version, v.currentBatch)
+}
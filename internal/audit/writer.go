@@ -0,0 +1,218 @@
+package audit
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+)
+
+var (
+	// ErrClosed is returned by AppendEvent after the store has been closed.
+	ErrClosed = errors.New("audit store closed")
+	// ErrFailed is returned by AppendEvent after a write or sync failed
+	// with a record possibly on disk. Reopening the store recovers the log
+	// from what actually reached the backend.
+	ErrFailed = errors.New("audit store failed; reopen it to recover")
+)
+
+const writeBufferSize = 64 * 1024
+
+var _ io.Closer = (*Store)(nil)
+
+// appendFile is a long-lived append-only handle. Writes collect in a buffer
+// until Flush, Sync or Close, so appends do not pay for an open and a close
+// and concurrent group commits can share one write.
+type appendFile struct {
+	file *os.File
+	buf  *bufio.Writer
+}
+
+func openAppendFile(path string) (*appendFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &appendFile{file: file, buf: bufio.NewWriterSize(file, writeBufferSize)}, nil
+}
+
+func (f *appendFile) Write(p []byte) (int, error) {
+	return f.buf.Write(p)
+}
+
+func (f *appendFile) Flush() error {
+	return f.buf.Flush()
+}
+
+// Sync flushes the buffer and commits the file to disk.
+func (f *appendFile) Sync() error {
+	if err := f.buf.Flush(); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+func (f *appendFile) Close() error {
+	err := f.buf.Flush()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeLine writes one JSON line and flushes it, syncing as well if asked.
+func (f *appendFile) writeLine(v interface{}, sync bool) error {
+	line, err := encodeJSONLine(v)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		return err
+	}
+	if sync {
+		return f.Sync()
+	}
+	return f.Flush()
+}
+
+// openWriters opens the handles appends write through. It runs after
+// Replay, which may still rename or rewrite the files.
+func (b *fileBackend) openWriters() error {
+	var err error
+	if err := b.openLive(); err != nil {
+		return err
+	}
+	if b.roots, err = openAppendFile(b.rootsPath); err != nil {
+		return err
+	}
+	b.checkpoints, err = openAppendFile(b.checkpointsPath)
+	return err
+}
+
+// openLive opens events.log and its index for appending, starting a new
+// binary file with its header.
+func (b *fileBackend) openLive() error {
+	var err error
+	if b.events, err = openAppendFile(b.eventsPath); err != nil {
+		return err
+	}
+	if b.index, err = openAppendFile(b.indexPath); err != nil {
+		return err
+	}
+	if b.eventsSize == 0 && b.liveFormat == FormatBinary {
+		if _, err := b.events.Write([]byte(binaryMagic)); err != nil {
+			return err
+		}
+		b.eventsSize = b.liveFormat.headerSize()
+	}
+	return nil
+}
+
+// flushLocked pushes buffered records and index entries to the OS so that
+// readers going through the file system see every appended record.
+func (b *fileBackend) flushLocked() error {
+	if b.closed {
+		return nil
+	}
+	if err := b.events.Flush(); err != nil {
+		return err
+	}
+	return b.index.Flush()
+}
+
+func (b *fileBackend) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flushLocked()
+}
+
+// Sync flushes the live file and commits it to disk. The fsync runs outside
+// the lock so appends can keep buffering behind it; a file closed underneath
+// it was synced by the rotation or Close that closed it.
+func (b *fileBackend) Sync() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	file, err := b.events.file, b.events.Flush()
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// syncLiveLocked makes the live file at least as durable as the segment
+// about to describe it. The caller holds b.mu.
+func (b *fileBackend) syncLiveLocked() error {
+	if !b.durable {
+		return b.events.Flush()
+	}
+	return b.events.Sync()
+}
+
+func (b *fileBackend) Close() error {
+	b.compressing.Wait()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	err := b.compressErr
+	for _, f := range []*appendFile{b.events, b.index, b.roots, b.checkpoints} {
+		if f == nil {
+			continue
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	b.closed = true
+	return err
+}
+
+// Flush makes every appended record visible to readers of the backend.
+func (s *Store) Flush() error {
+	return s.backend.Flush()
+}
+
+// Close flushes buffered writes, syncs them in the durable modes, moves the
+// high-water mark up to the last record and releases the backend. Appends after Close fail with ErrClosed. An open
+// batch stays unsealed until the store is opened again; Shutdown seals it
+// first.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeLocked()
+}
+
+func (s *Store) closeLocked() error {
+	if s.closed {
+		return nil
+	}
+	s.disarmAgeLocked()
+	err := s.ageErr
+	var serr error
+	if s.durable() {
+		serr = s.backend.Sync()
+		s.group.advance(s.written)
+	} else {
+		serr = s.backend.Flush()
+	}
+	if serr == nil && s.failed == nil && s.syncHead {
+		// Records appended since the last seal or sync are in the mark too.
+		serr = s.saveHead(s.headLocked())
+	}
+	if err == nil {
+		err = serr
+	}
+	if cerr := s.backend.Close(); err == nil {
+		err = cerr
+	}
+	s.closed = true
+	return err
+}
@@ -3,20 +3,63 @@ package config
 import (
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
+
+	"assurance_service/internal/audit"
 )
 
 type Config struct {
 	Port         int
 	DataDir      string
 	SharedSecret string
+	SigningKey   string
 	BatchSize    int
+	// BatchMaxAge seals a batch that has waited this long for more records;
+	// zero seals only full batches.
+	BatchMaxAge  time.Duration
+	TreeVersion  int
+	HashScheme   int
 	KAnonymity   int
 	DPEpsilon    float64
 	DPSeed       int64
 	WriteTimeout time.Duration
 	ReadTimeout  time.Duration
+	// ShutdownTimeout bounds how long a SIGTERM waits for in-flight
+	// requests before the log is sealed.
+	ShutdownTimeout time.Duration
+
+	// SegmentMaxBytes and SegmentMaxBatches rotate events.log into sealed
+	// segments; zero disables a limit.
+	SegmentMaxBytes   int64
+	SegmentMaxBatches int
+	// Durability is the audit store durability mode: none, fsync or group.
+	Durability string
+	// Storage is the audit storage engine: file, kv or memory.
+	Storage string
+	// LogFormat is the record encoding for new event log files: json or
+	// binary.
+	LogFormat string
+	// SegmentCompression compresses sealed segments: none or gzip.
+	SegmentCompression string
+	// MasterKey is the file holding the master key for payload encryption
+	// at rest; empty leaves payloads in cleartext.
+	MasterKey string
+	// SubjectField is the payload field whose value gets its own key for
+	// crypto-shredding; empty disables subject keys.
+	SubjectField string
+	// CommitFields are payload fields hashed as salted commitments, so
+	// they can be withheld from readers without breaking verification.
+	CommitFields []string
+	// DisclosureToken is the bearer token that lets /audit/events callers
+	// see committed fields; empty redacts them for everyone.
+	DisclosureToken string
+	// HashAlgorithm is the hash function of a new log: sha256,
+	// sha512-256 or blake2b-256. An existing log keeps its own; see
+	// "assurectl epoch".
+	HashAlgorithm string
 }
 
 func Load() Config {
@@ -53,25 +96,71 @@ func Load() Config {
 		}
 		return d
 	}
+	getList := func(key string) []string {
+		var out []string
+		for _, f := range strings.Split(os.Getenv(key), ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				out = append(out, f)
+			}
+		}
+		return out
+	}
 
 	cfg := Config{
 		Port:         getInt("ASSURE_PORT", 9010),
 		DataDir:      os.Getenv("ASSURE_DATA_DIR"),
 		SharedSecret: os.Getenv("ASSURE_SHARED_SECRET"),
+		SigningKey:   os.Getenv("ASSURE_SIGNING_KEY_FILE"),
 		BatchSize:    getInt("ASSURE_BATCH_SIZE", 100),
+		BatchMaxAge:  getDuration("ASSURE_BATCH_MAX_AGE", 5*time.Minute),
+		TreeVersion:  getInt("ASSURE_TREE_VERSION", 2),
+		HashScheme:   getInt("ASSURE_HASH_SCHEME", audit.DefaultHashScheme),
 		KAnonymity:   getInt("ASSURE_K_ANON", 5),
 		DPEpsilon:    getFloat("ASSURE_DP_EPS", 0.7),
 		DPSeed:       int64(getInt("ASSURE_DP_SEED", 0)),
 		WriteTimeout: getDuration("ASSURE_WRITE_TIMEOUT", 5*time.Second),
 		ReadTimeout:  getDuration("ASSURE_READ_TIMEOUT", 5*time.Second),
+
+		ShutdownTimeout: getDuration("ASSURE_SHUTDOWN_TIMEOUT", 15*time.Second),
+
+		SegmentMaxBytes:   int64(getInt("ASSURE_SEGMENT_MAX_BYTES", 64<<20)),
+		SegmentMaxBatches: getInt("ASSURE_SEGMENT_MAX_BATCHES", 0),
+		Durability:        os.Getenv("ASSURE_DURABILITY"),
+		Storage:           os.Getenv("ASSURE_STORAGE"),
+		LogFormat:         os.Getenv("ASSURE_LOG_FORMAT"),
+
+		SegmentCompression: os.Getenv("ASSURE_SEGMENT_COMPRESSION"),
+		MasterKey:          os.Getenv("ASSURE_MASTER_KEY_FILE"),
+		SubjectField:       os.Getenv("ASSURE_SUBJECT_FIELD"),
+		CommitFields:       getList("ASSURE_COMMIT_FIELDS"),
+		DisclosureToken:    os.Getenv("ASSURE_DISCLOSURE_TOKEN"),
+		HashAlgorithm:      os.Getenv("ASSURE_HASH_ALGORITHM"),
 	}
 
 	if cfg.DataDir == "" {
 		cfg.DataDir = "./data"
 	}
+	if cfg.SigningKey == "" {
+		cfg.SigningKey = filepath.Join(cfg.DataDir, "signing.key")
+	}
+	if cfg.Durability == "" {
+		cfg.Durability = "group"
+	}
+	if cfg.Storage == "" {
+		cfg.Storage = "file"
+	}
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = "json"
+	}
+	if cfg.SegmentCompression == "" {
+		cfg.SegmentCompression = "none"
+	}
 	if cfg.BatchSize <= 0 {
 		cfg.BatchSize = 100
 	}
+	if cfg.BatchMaxAge < 0 {
+		cfg.BatchMaxAge = 0
+	}
 	if cfg.KAnonymity <= 1 {
 		cfg.KAnonymity = 2
 	}
@@ -80,3 +169,26 @@ func Load() Config {
 	}
 	return cfg
 }
+
+// StoreOptions returns the audit store options the configuration selects:
+// engine, formats and log parameters. Keys are loaded by the caller, so
+// SigningKey and MasterKey are left unset. The server and every assurectl
+// command that opens the store use it, so they all open the same log.
+func (c Config) StoreOptions() audit.Options {
+	return audit.Options{
+		BatchSize:         c.BatchSize,
+		MaxBatchAge:       c.BatchMaxAge,
+		TreeVersion:       c.TreeVersion,
+		HashScheme:        c.HashScheme,
+		SegmentMaxBytes:   c.SegmentMaxBytes,
+		SegmentMaxBatches: c.SegmentMaxBatches,
+		Durability:        audit.Durability(c.Durability),
+		Storage:           c.Storage,
+		LogFormat:         audit.LogFormat(c.LogFormat),
+
+		SegmentCompression: c.SegmentCompression,
+		SubjectField:       c.SubjectField,
+		CommitFields:       c.CommitFields,
+		HashAlgorithm:      audit.HashAlgorithm(c.HashAlgorithm),
+	}
+}
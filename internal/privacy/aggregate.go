@@ -1,11 +1,8 @@
 package privacy
 
 import (
-	"bufio"
-	"encoding/json"
 	"math"
 	"math/rand"
-	"os"
 	"sort"
 	"strings"
 	"time"
@@ -28,40 +25,33 @@ type TokenSummary struct {
 	AppliedEpsilon float64      `json:"epsilon"`
 }
 
-func TokenCounts(eventsPath string, window time.Duration) (map[string]int, error) {
+// RecordScanner is the part of audit.Store that TokenCounts reads from.
+type RecordScanner interface {
+	Scan(visit func(audit.Record) error) error
+}
+
+func TokenCounts(src RecordScanner, window time.Duration) (map[string]int, error) {
 	counts := map[string]int{}
 	cutoff := time.Now().Add(-window)
 
-	file, err := os.OpenFile(eventsPath, os.O_RDONLY|os.O_CREATE, 0o644)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	scanner.Buffer(make([]byte, 0, 64*1024), 5*1024*1024)
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		if len(line) == 0 {
-			continue
-		}
-		var rec audit.Record
-		if err := json.Unmarshal(line, &rec); err != nil {
-			return nil, err
-		}
+	err := src.Scan(func(rec audit.Record) error {
 		if rec.Event.Type != "trade" {
-			continue
+			return nil
 		}
 		if !rec.Event.Timestamp.IsZero() && rec.Event.Timestamp.Before(cutoff) {
-			continue
+			return nil
 		}
 		mint := extractMint(rec.Event.Payload)
 		if mint == "" {
-			continue
+			return nil
 		}
 		counts[mint]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return counts, scanner.Err()
+	return counts, nil
 }
 
 func SummarizeTokenCounts(counts map[string]int, k int, epsilon float64, seed int64, windowHours int) TokenSummary {
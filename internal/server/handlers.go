@@ -1,13 +1,16 @@
 package server
 
 import (
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"assurance_service/internal/audit"
@@ -19,11 +22,15 @@ type Handler struct {
 	Store        *audit.Store
 	Policy       *policy.Engine
 	SharedSecret string
-	EventsPath   string
-	RootsPath    string
+	VerifyState  string
+	PublicKey    ed25519.PublicKey
 	BatchSize    int
 	KAnonymity   int
 	DPEpsilon    float64
+
+	// DisclosureToken, when set, is the bearer token that lets a caller of
+	// /audit/events see committed fields; everyone else gets commitments.
+	DisclosureToken string
 }
 
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
@@ -46,7 +53,7 @@ func (h *Handler) IngestEvent(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var event audit.Event
-	if err := json.Unmarshal(body, &event); err != nil {
+	if err := audit.DecodeJSON(body, &event); err != nil {
 		writeJSON(w, http.StatusBadRequest, errorPayload("invalid json"))
 		return
 	}
@@ -54,6 +61,14 @@ func (h *Handler) IngestEvent(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusBadRequest, errorPayload("event type required"))
 		return
 	}
+	if err := audit.CheckNumbers(event.Payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorPayload(err.Error()))
+		return
+	}
+	if audit.ReservedEventType(event.Type) {
+		writeJSON(w, http.StatusBadRequest, errorPayload("event type "+event.Type+" is reserved"))
+		return
+	}
 	if event.Timestamp.IsZero() {
 		event.Timestamp = time.Now().UTC()
 	}
@@ -64,6 +79,10 @@ func (h *Handler) IngestEvent(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rec, root, err := h.Store.AppendEvent(event)
+	if errors.Is(err, audit.ErrReservedPayload) {
+		writeJSON(w, http.StatusBadRequest, errorPayload(err.Error()))
+		return
+	}
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, errorPayload("append failed"))
 		return
@@ -84,11 +103,18 @@ func (h *Handler) LatestRoot(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusInternalServerError, errorPayload("root read failed"))
 		return
 	}
+	treeSize, treeRoot := h.Store.TreeHead()
 	payload := map[string]interface{}{
 		"ok":              true,
 		"last_root":       last,
 		"current_root":    h.Store.CurrentBatchRoot(),
+		"tree_size":       treeSize,
+		"tree_root":       treeRoot,
+		"checkpoint":      h.Store.LatestCheckpoint(),
+		"genesis":         h.Store.Genesis(),
 		"batch_size":      h.BatchSize,
+		"tree_version":    h.Store.TreeVersion(),
+		"epoch":           h.Store.Epoch(),
 		"k_anonymity":     h.KAnonymity,
 		"dp_epsilon":      h.DPEpsilon,
 		"server_time_utc": time.Now().UTC(),
@@ -97,7 +123,13 @@ func (h *Handler) LatestRoot(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) VerifyAudit(w http.ResponseWriter, r *http.Request) {
-	report := audit.Verify(h.EventsPath, h.RootsPath, h.BatchSize)
+	report := h.Store.Verify(audit.VerifyOptions{
+		BatchSize: h.BatchSize,
+		PublicKey: h.PublicKey,
+		Expect:    []audit.TrustedState{h.Store.HighWater()},
+		StatePath: h.VerifyState,
+		Full:      r.URL.Query().Get("full") == "1",
+	})
 	status := http.StatusOK
 	if !report.OK {
 		status = http.StatusConflict
@@ -105,16 +137,71 @@ func (h *Handler) VerifyAudit(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, status, map[string]interface{}{"ok": report.OK, "report": report})
 }
 
+func (h *Handler) InclusionProof(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.ParseInt(r.URL.Query().Get("index"), 10, 64)
+	if err != nil || index <= 0 {
+		writeJSON(w, http.StatusBadRequest, errorPayload("index required"))
+		return
+	}
+	proof, err := h.Store.InclusionProof(index)
+	switch {
+	case errors.Is(err, audit.ErrRecordNotFound):
+		writeJSON(w, http.StatusNotFound, errorPayload(err.Error()))
+		return
+	case errors.Is(err, audit.ErrNotSealed):
+		writeJSON(w, http.StatusConflict, errorPayload(err.Error()))
+		return
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, errorPayload("proof failed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "proof": proof})
+}
+
+func (h *Handler) ConsistencyProof(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+	if err != nil || from <= 0 {
+		writeJSON(w, http.StatusBadRequest, errorPayload("from required"))
+		return
+	}
+	var to int64
+	if raw := r.URL.Query().Get("to"); raw != "" {
+		to, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || to < from {
+			writeJSON(w, http.StatusBadRequest, errorPayload("invalid to"))
+			return
+		}
+	}
+	proof, err := h.Store.ConsistencyProof(from, to)
+	switch {
+	case errors.Is(err, audit.ErrRecordNotFound):
+		writeJSON(w, http.StatusNotFound, errorPayload(err.Error()))
+		return
+	case errors.Is(err, audit.ErrEpochBoundary):
+		writeJSON(w, http.StatusConflict, errorPayload(err.Error()))
+		return
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, errorPayload("proof failed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "proof": proof})
+}
+
 func (h *Handler) ListEvents(w http.ResponseWriter, r *http.Request) {
 	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
 	if limit <= 0 || limit > 500 {
 		limit = 100
 	}
-	events, err := readLastEvents(h.EventsPath, limit)
+	events, err := h.Store.Tail(limit)
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, errorPayload("event read failed"))
 		return
 	}
+	if !h.mayDisclose(r) {
+		for i := range events {
+			events[i] = events[i].Redact()
+		}
+	}
 	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "items": events})
 }
 
@@ -147,7 +234,7 @@ func (h *Handler) PrivacyTokenSummary(w http.ResponseWriter, r *http.Request) {
 	}
 	seed, _ := strconv.ParseInt(r.URL.Query().Get("seed"), 10, 64)
 
-	counts, err := privacy.TokenCounts(h.EventsPath, time.Duration(windowHours)*time.Hour)
+	counts, err := privacy.TokenCounts(h.Store, time.Duration(windowHours)*time.Hour)
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, errorPayload("aggregate failed"))
 		return
@@ -156,6 +243,19 @@ func (h *Handler) PrivacyTokenSummary(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "summary": summary})
 }
 
+// mayDisclose reports whether r carries the disclosure token.
+func (h *Handler) mayDisclose(r *http.Request) bool {
+	if h.DisclosureToken == "" {
+		return false
+	}
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	return hmac.Equal([]byte(header[len(prefix):]), []byte(h.DisclosureToken))
+}
+
 func verifySignature(body []byte, header string, secret string) bool {
 	if header == "" || secret == "" {
 		return false
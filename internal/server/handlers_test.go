@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"assurance_service/internal/audit"
+)
+
+func TestIngestRejectsReservedTypes(t *testing.T) {
+	store, err := audit.OpenStore(t.TempDir(), audit.Options{BatchSize: 2, Storage: audit.StorageMemory})
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	defer store.Close()
+	h := &Handler{Store: store}
+
+	ingest := func(body string) int {
+		w := httptest.NewRecorder()
+		h.IngestEvent(w, httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body)))
+		return w.Code
+	}
+	for _, typ := range []string{audit.EventShutdown, audit.EventShred, audit.EventEpoch, audit.IncidentRecovery, "audit.other"} {
+		if code := ingest(`{"type":"` + typ + `","payload":{"reason":"forged"}}`); code != http.StatusBadRequest {
+			t.Fatalf("ingest of %s: status %d, want %d", typ, code, http.StatusBadRequest)
+		}
+	}
+	if size, _ := store.TreeHead(); size != 0 {
+		t.Fatalf("reserved events appended: tree size %d", size)
+	}
+	if code := ingest(`{"type":"trade","payload":{"mint":"M"}}`); code != http.StatusOK {
+		t.Fatalf("ingest of trade: status %d", code)
+	}
+}
+
+func TestIngestRejectsNonFiniteNumbers(t *testing.T) {
+	store, err := audit.OpenStore(t.TempDir(), audit.Options{BatchSize: 2, Storage: audit.StorageMemory})
+	if err != nil {
+		t.Fatalf("store init: %v", err)
+	}
+	defer store.Close()
+	h := &Handler{Store: store}
+
+	ingest := func(body string) int {
+		w := httptest.NewRecorder()
+		h.IngestEvent(w, httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body)))
+		return w.Code
+	}
+	for _, payload := range []string{`{"amount":1e400}`, `{"legs":[{"amount":-1e400}]}`} {
+		if code := ingest(`{"type":"trade","payload":` + payload + `}`); code != http.StatusBadRequest {
+			t.Fatalf("ingest of %s: status %d, want %d", payload, code, http.StatusBadRequest)
+		}
+	}
+	if size, _ := store.TreeHead(); size != 0 {
+		t.Fatalf("rejected events appended: tree size %d", size)
+	}
+	if code := ingest(`{"type":"trade","payload":{"amount":1e300,"lamports":18446744073709551615}}`); code != http.StatusOK {
+		t.Fatalf("ingest of finite numbers: status %d", code)
+	}
+}
@@ -12,6 +12,8 @@ func New(handler *Handler) http.Handler {
 	mux.HandleFunc("/audit/root/latest", handler.LatestRoot)
 	mux.HandleFunc("/audit/verify", handler.VerifyAudit)
 	mux.HandleFunc("/audit/events", handler.ListEvents)
+	mux.HandleFunc("/audit/proof/inclusion", handler.InclusionProof)
+	mux.HandleFunc("/audit/proof/consistency", handler.ConsistencyProof)
 	mux.HandleFunc("/policy/check", handler.PolicyCheck)
 	mux.HandleFunc("/privacy/tokens", handler.PrivacyTokenSummary)
 